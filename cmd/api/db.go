@@ -2,9 +2,12 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"time"
 
 	"github.com/jackc/pgx/v4"
+
+	"github.com/delicb/toy-cqrs/cqrs/sqlitestore"
 )
 
 // DBManager describes database operations needed by this service.
@@ -36,3 +39,28 @@ func (d *dbManager) GetUser(id string) (*UserModel, error) {
 	u := &UserModel{}
 	return u, row.Scan(&u.ID, &u.Email, &u.Enabled)
 }
+
+type sqliteDBManager struct {
+	db *sql.DB
+}
+
+// NewSqliteDBManager returns instance of a DB manager reading users table from SQLite
+// database in file at provided path (populated by denormalizer).
+func NewSqliteDBManager(path string) *sqliteDBManager {
+	db, err := sqlitestore.Open(path)
+	if err != nil {
+		panic(err)
+	}
+	return &sqliteDBManager{db}
+}
+
+func (d *sqliteDBManager) GetUser(id string) (*UserModel, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	row := d.db.QueryRowContext(ctx,
+		`SELECT id, email, enabled FROM users WHERE id = ?`,
+		id,
+	)
+	u := &UserModel{}
+	return u, row.Scan(&u.ID, &u.Email, &u.Enabled)
+}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"os"
 
+	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/nats-io/nats.go"
@@ -18,11 +19,23 @@ func main() {
 	rootContext, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	db := NewDBManager(rootContext, os.Getenv("DATABASE_URL"))
+	// users are read from postgres, or from SQLite if SQLITE_PATH is set
+	var db DBManager
+	if path := os.Getenv("SQLITE_PATH"); path != "" {
+		db = NewSqliteDBManager(path)
+	} else {
+		db = NewDBManager(rootContext, os.Getenv("DATABASE_URL"))
+	}
 	natsConn, err := nats.Connect(os.Getenv("NATS_URL"))
 	if err != nil {
 		panic(err)
 	}
+	// commands are sent as JSON by default, userservice understands both formats
+	if contentType := os.Getenv("COMMAND_CONTENT_TYPE"); contentType != "" {
+		if err := users.SetCommandContentType(contentType); err != nil {
+			panic(err)
+		}
+	}
 	usersClient := users.NewClient(natsConn)
 
 	httpServer := &server{
@@ -39,6 +52,8 @@ func main() {
 	app.PUT("/users/:id/passwordChange", httpServer.passwordChange)
 	app.PUT("/users/:id/enable", httpServer.enableUser)
 	app.PUT("/users/:id/disable", httpServer.disableUser)
+	app.POST("/users/:id/scheduledDisable", httpServer.scheduleDisable)
+	app.DELETE("/scheduled/:correlationID", httpServer.cancelScheduled)
 	app.Logger.Fatal(app.Start("0.0.0.0:8001"))
 }
 
@@ -166,6 +181,37 @@ func (s *server) disableUser(c echo.Context) error {
 	return c.JSON(http.StatusOK, user)
 }
 
+func (s *server) scheduleDisable(c echo.Context) error {
+	c.Logger().Debug("scheduling user disable")
+	request := &scheduleRequest{}
+	if err := (&echo.DefaultBinder{}).BindBody(c, request); err != nil {
+		c.Logger().Errorf("failed to bind body to the request: %v", err)
+		return err
+	}
+	if err := request.Validate(); err != nil {
+		return err
+	}
+	correlationID, err := s.users.DisableAt(c.Param("id"), request.At)
+	if err != nil {
+		c.Logger().Errorf("got error during scheduling command: %v", err)
+		return err
+	}
+	return c.JSON(http.StatusAccepted, map[string]string{"correlation_id": correlationID})
+}
+
+func (s *server) cancelScheduled(c echo.Context) error {
+	c.Logger().Debug("cancelling scheduled commands")
+	correlationID := c.Param("correlationID")
+	if _, err := uuid.Parse(correlationID); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "correlation ID is not valid UUID")
+	}
+	if err := s.users.CancelScheduled(correlationID); err != nil {
+		c.Logger().Errorf("got error during cancelling scheduled commands: %v", err)
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
 func hashPassword(in string) (string, error) {
 	pwd, err := bcrypt.GenerateFromPassword([]byte(in), bcrypt.DefaultCost)
 	if err != nil {
@@ -2,6 +2,7 @@ package main
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/labstack/echo/v4"
 )
@@ -49,3 +50,14 @@ func (p *passwordChangeRequest) Validate() error {
 	}
 	return nil
 }
+
+type scheduleRequest struct {
+	At time.Time `json:"at"`
+}
+
+func (s *scheduleRequest) Validate() error {
+	if s.At.IsZero() {
+		return echo.NewHTTPError(http.StatusBadRequest, "at is required")
+	}
+	return nil
+}
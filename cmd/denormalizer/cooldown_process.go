@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/delicb/toy-cqrs/cqrs"
+	"github.com/delicb/toy-cqrs/users"
+)
+
+// cooldownTimeout is name of timeout after which disabled user is enabled again.
+const cooldownTimeout = "cooldown"
+
+// cooldownState is state of a single cooldown, started by disabling a user.
+type cooldownState struct {
+	UserID string `json:"user_id"`
+}
+
+// cooldownProcess enables users again once cooldown after they have been disabled expires.
+type cooldownProcess struct {
+	cooldown time.Duration
+}
+
+func newCooldownProcess(cooldown time.Duration) *cooldownProcess {
+	return &cooldownProcess{cooldown: cooldown}
+}
+
+func (p *cooldownProcess) Name() string { return "user_cooldown" }
+
+func (p *cooldownProcess) NewState() interface{} { return &cooldownState{} }
+
+func (p *cooldownProcess) Handlers() map[cqrs.EventID]cqrs.ProcessHandler {
+	return map[cqrs.EventID]cqrs.ProcessHandler{
+		users.DisabledID: p.startCooldown,
+	}
+}
+
+func (p *cooldownProcess) Timeouts() map[string]cqrs.ProcessTimeoutHandler {
+	return map[string]cqrs.ProcessTimeoutHandler{
+		cooldownTimeout: p.enableUser,
+	}
+}
+
+func (p *cooldownProcess) startCooldown(_ context.Context, pc *cqrs.ProcessContext, ev *cqrs.Event) error {
+	state := pc.State.(*cooldownState)
+	state.UserID = ev.AggregateID
+	pc.ScheduleTimeout(cooldownTimeout, ev.CreatedAt.Add(p.cooldown))
+	return nil
+}
+
+func (p *cooldownProcess) enableUser(_ context.Context, pc *cqrs.ProcessContext) error {
+	state := pc.State.(*cooldownState)
+	pc.Send(&users.EnableUser{BaseCommand: cqrs.BaseCommand{
+		CommandID:     users.EnableUserID,
+		AggregateID:   state.UserID,
+		AggregateType: "user",
+		Actor:         p.Name(),
+	}})
+	pc.Complete()
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+
+	"github.com/delicb/toy-cqrs/cqrs"
+	"github.com/delicb/toy-cqrs/cqrs/pgbus"
+	"github.com/delicb/toy-cqrs/cqrs/pgstore"
+	"github.com/delicb/toy-cqrs/cqrs/sqlitestore"
+	"github.com/delicb/toy-cqrs/users"
+)
+
+// sqlitePollInterval is how often SQLite database is checked for new events,
+// since it can not notify other processes about them.
+const sqlitePollInterval = 250 * time.Millisecond
+
+// database groups stores denormalizer reads events from and writes projections to.
+type database struct {
+	events      cqrs.EventReader
+	checkpoints cqrs.CheckpointStore
+	users       cqrs.Projection
+	processes   cqrs.ProcessStore
+	// watch calls notify whenever new events might have been stored.
+	watch func(ctx context.Context, notify func()) error
+	// rebuild regenerates projection with provided name from all events.
+	rebuild func(ctx context.Context, name string) error
+}
+
+// openPsql returns database on top of postgres at provided DSN.
+func openPsql(ctx context.Context, dsn string) (*database, error) {
+	pool, err := pgxpool.Connect(ctx, dsn)
+	if err != nil {
+		return nil, err
+	}
+	events := pgstore.NewEventStore(pool, users.EventSerializer, pgstore.Options{})
+	return &database{
+		events:      events,
+		checkpoints: &checkpointStore{pool},
+		users:       newUsersProjection(pool, "users"),
+		processes:   &processStore{pool},
+		watch: func(ctx context.Context, notify func()) error {
+			// payload of notification is not decoded, events are read from the store,
+			// notification only triggers reading (even if event in it is not known)
+			bus := pgbus.NewEventBus(pool, pgbus.DefaultChannel, users.EventSerializer)
+			_, err := bus.Watch(ctx, notify)
+			return err
+		},
+		rebuild: func(ctx context.Context, name string) error {
+			return rebuild(ctx, pool, events, name)
+		},
+	}, nil
+}
+
+// openSqlite returns database on top of SQLite database in file at provided path.
+// State of process managers is kept in memory, so their timeouts are lost on restart.
+func openSqlite(path string) (*database, error) {
+	db, err := sqlitestore.Open(path, sqliteUsersSchema)
+	if err != nil {
+		return nil, err
+	}
+	return &database{
+		events:      sqlitestore.NewEventStore(db, users.EventSerializer),
+		checkpoints: sqlitestore.NewCheckpointStore(db),
+		users:       newSqliteUsersProjection(db),
+		processes:   cqrs.NewInMemoryProcessStore(),
+		watch: func(ctx context.Context, notify func()) error {
+			go func() {
+				ticker := time.NewTicker(sqlitePollInterval)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case <-ticker.C:
+						notify()
+					}
+				}
+			}()
+			return nil
+		},
+		rebuild: func(context.Context, string) error {
+			return errors.New("rebuilding projections is not supported with SQLite")
+		},
+	}, nil
+}
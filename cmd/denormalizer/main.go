@@ -7,41 +7,88 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
-	"github.com/jackc/pgx/v4"
-	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/nats-io/nats.go"
 
 	"github.com/delicb/toy-cqrs/cqrs"
+	"github.com/delicb/toy-cqrs/cqrs/natsbus"
 	"github.com/delicb/toy-cqrs/users"
 )
 
-const notificationChannel = "new_event"
-
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 	log.Println("Starting denormalizer")
-	// connect to database to receive events
-	pool, err := pgxpool.Connect(context.Background(), os.Getenv("DATABASE_URL"))
+	rootCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// connect to database to receive events, postgres, or SQLite if SQLITE_PATH is set
+	var db *database
+	var err error
+	if path := os.Getenv("SQLITE_PATH"); path != "" {
+		db, err = openSqlite(path)
+	} else {
+		db, err = openPsql(rootCtx, os.Getenv("DATABASE_URL"))
+	}
 	if err != nil {
 		panic(err)
 	}
 
+	// denormalizer rebuild <projection> regenerates projection from all events and exits
+	if len(os.Args) > 1 && os.Args[1] == "rebuild" {
+		if len(os.Args) != 3 {
+			log.Fatalln("usage: denormalizer rebuild <projection>")
+		}
+		if err := db.rebuild(rootCtx, os.Args[2]); err != nil {
+			log.Fatalln("rebuild failed:", err)
+		}
+		return
+	}
+
 	natsConn, err := nats.Connect(os.Getenv("NATS_URL"))
 	if err != nil {
 		panic(err)
 	}
 
-	usersDbManager := &dbManager{pool}
+	// commands are sent and their outcome reported over nats
+	bus := natsbus.NewCommandBus(natsConn, users.CommandSerializer)
+
+	// process managers react to events by sending commands to userservice
+	var processes []cqrs.ProcessManager
+	if cooldown := os.Getenv("DISABLE_COOLDOWN"); cooldown != "" {
+		d, err := time.ParseDuration(cooldown)
+		if err != nil {
+			log.Fatalln("invalid DISABLE_COOLDOWN:", err)
+		}
+		processes = append(processes, newCooldownProcess(d))
+	}
 
-	publishManager := &natsManager{natsConn}
+	// projections, each of them first processes all events stored since its last
+	// checkpoint, then continues with new events as notifications arrive
+	projector := cqrs.NewProjector(db.events, db.checkpoints)
+	projector.Register(db.users, cqrs.SkipOnError)
+	for _, manager := range processes {
+		runner := cqrs.NewProcessRunner(manager, db.processes, bus)
+		// process must not miss an event, so failed ones (e.g. userservice is unavailable) are retried
+		projector.Register(runner, cqrs.RetryOnError)
+		go runner.RunTimeouts(rootCtx)
+	}
+	// let waiting clients know how processing of events they caused went
+	projector.AddHook(reportingHook(bus))
 
-	events := make(chan *cqrs.Event, 32)
+	// start watching for new events before catching up, so that none of them is missed
+	if err := db.watch(rootCtx, projector.Notify); err != nil {
+		panic(err)
+	}
 
-	// start listener
-	go listen(pool, events)
-	// start event processor
-	go eventProcessor(usersDbManager, publishManager, events)
+	if err := projector.Start(rootCtx); err != nil {
+		panic(err)
+	}
+	go func() {
+		if err := projector.Wait(); err != nil {
+			log.Fatalln("processing events failed:", err)
+		}
+	}()
 
 	signalCh := make(chan os.Signal, 1)
 	signal.Notify(signalCh, syscall.SIGTERM, syscall.SIGINT)
@@ -52,135 +99,27 @@ func main() {
 
 	// cleanup
 	// pool.Close() // TODO: Check why this blocks when shutting down
-	close(events)
-
-}
-
-func listen(pool *pgxpool.Pool, events chan<- *cqrs.Event) {
-
-	conn, err := pool.Acquire(context.Background())
-	if err != nil {
-		log.Println("--> error getting connection from pool: ", err)
-
-	}
-	defer conn.Release()
-
-	_, err = conn.Exec(context.Background(), "listen "+notificationChannel)
-	if err != nil {
-		log.Println("--> error listening for events:", err)
-	}
-
-	for {
-		// blocks
-		notification, err := conn.Conn().WaitForNotification(context.Background())
-
-		if err != nil {
-			log.Println("--> error getting notification from database")
-		}
-
-		if notification.Channel != notificationChannel {
-			log.Println("got message from unexpected channel:", notification.Channel)
-			continue
-		}
-
-		ev, err := users.EventSerializer.Unmarshal([]byte(notification.Payload))
-		if err != nil {
-			log.Println("failed to unmarshal event from database into event structure:", err)
-			continue
-		}
-
-		events <- ev
+	if err := projector.Stop(context.Background()); err != nil {
+		log.Println("stopping projections failed:", err)
 	}
 }
 
-func eventProcessor(db *dbManager, publish *natsManager, events <-chan *cqrs.Event) {
-	for ev := range events {
-		var err error
-		switch ev.EventID {
-		case users.UserCreatedID:
-			err = db.insertUser(ev)
-		case users.PasswordChangedID:
-			err = db.updateUserPassword(ev)
-		case users.EmailChangedID:
-			err = db.updateUserEmail(ev)
-		case users.EnabledID:
-			err = db.enableUser(ev)
-		case users.DisabledID:
-			err = db.disableUser(ev)
-		default:
-			err = fmt.Errorf("unkonwn event while applying: %v", ev.EventID)
+// reportingHook returns projection hook that reports outcome of processing an event
+// to whoever sent command that caused it.
+func reportingHook(reporter cqrs.CommandReporter) cqrs.ProjectionHook {
+	return func(projection string, ev *cqrs.Event, err error) {
+		// clients wait for users table to be updated, other projections and processes are not reported
+		if projection != "users" {
+			return
 		}
-
 		if err != nil {
-			log.Println("failed to apply event to database: ", err)
-			if publishErr := publish.eventFailed(ev.CorrelationID, []byte(err.Error())); publishErr != nil {
-				log.Printf("ERROR: Failed to publish event processing failure: %v (original error: %v)\n", publishErr, err)
+			if reportErr := reporter.ReportFailure(ev.CorrelationID, err); reportErr != nil {
+				log.Printf("ERROR: Failed to publish event processing failure: %v (original error: %v)\n", reportErr, err)
 			}
+			return
 		}
-		if publishErr := publish.eventSuccess(ev.CorrelationID, []byte(ev.AggregateID)); publishErr != nil {
-			log.Printf("ERROR: failed to publish event success message: %v", err)
+		if reportErr := reporter.ReportSuccess(ev.CorrelationID, []byte(ev.AggregateID)); reportErr != nil {
+			log.Printf("ERROR: failed to publish event success message: %v", reportErr)
 		}
 	}
 }
-
-type dbManager struct {
-	db *pgxpool.Pool
-}
-
-func (m *dbManager) insertUser(ev *cqrs.Event) error {
-	payload := ev.Data.(*users.UserCreated)
-	return m.db.BeginFunc(context.Background(), func(tx pgx.Tx) error {
-		_, err := tx.Exec(context.Background(), `
-			INSERT INTO users 
-				(id, email, password, enabled, last_event_time, last_correlation_id) 
-			VALUES ($1, $2, $3, $4, $5, $6)`,
-			ev.AggregateID, payload.Email, payload.Password, payload.IsEnabled, ev.CreatedAt, ev.CorrelationID)
-		return err
-	})
-}
-
-func (m *dbManager) updateUserPassword(ev *cqrs.Event) error {
-	payload := ev.Data.(*users.UserPasswordChanged)
-	return m.db.BeginFunc(context.Background(), func(tx pgx.Tx) error {
-		_, err := tx.Exec(context.Background(), `UPDATE users SET password=$1 WHERE id=$2`,
-			payload.NewPassword, ev.AggregateID)
-		return err
-	})
-}
-
-func (m *dbManager) updateUserEmail(ev *cqrs.Event) error {
-	payload := ev.Data.(*users.UserEmailChanged)
-	return m.db.BeginFunc(context.Background(), func(tx pgx.Tx) error {
-		_, err := tx.Exec(context.Background(), `UPDATE users SET email=$1 WHERE id=$2`,
-			payload.NewEmail, ev.AggregateID)
-		return err
-	})
-}
-
-func (m *dbManager) enableUser(ev *cqrs.Event) error {
-	return m.db.BeginFunc(context.Background(), func(tx pgx.Tx) error {
-		_, err := tx.Exec(context.Background(), `UPDATE users SET enabled=$1 WHERE id=$2`,
-			true, ev.AggregateID)
-		return err
-	})
-}
-
-func (m *dbManager) disableUser(ev *cqrs.Event) error {
-	return m.db.BeginFunc(context.Background(), func(tx pgx.Tx) error {
-		_, err := tx.Exec(context.Background(), `UPDATE users SET enabled=$1 WHERE id=$2`,
-			false, ev.AggregateID)
-		return err
-	})
-}
-
-type natsManager struct {
-	conn *nats.Conn
-}
-
-func (n *natsManager) eventSuccess(correlationID string, payload []byte) error {
-	return n.conn.Publish(fmt.Sprintf("event.%v.success", correlationID), payload)
-}
-
-func (n *natsManager) eventFailed(correlationID string, payload []byte) error {
-	return n.conn.Publish(fmt.Sprintf("event.%v.error", correlationID), payload)
-}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+
+	"github.com/delicb/toy-cqrs/cqrs"
+)
+
+// processStore implements cqrs.ProcessStore on top of process_states table.
+type processStore struct {
+	db *pgxpool.Pool
+}
+
+func (s *processStore) Load(ctx context.Context, process, correlationID string) (*cqrs.ProcessState, error) {
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+	row := s.db.QueryRow(ctx,
+		`SELECT process, correlation_id, version, position, data, timeouts, completed, updated_at
+			FROM process_states
+			WHERE process = $1 AND correlation_id = $2`, process, correlationID)
+	state, err := scanProcessState(row)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	return state, err
+}
+
+func (s *processStore) Save(ctx context.Context, state *cqrs.ProcessState) error {
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+	timeouts, err := json.Marshal(state.Timeouts)
+	if err != nil {
+		return err
+	}
+	// earliest timeout is stored separately, so that due instances can be found by index
+	var nextTimeout *time.Time
+	for _, at := range state.Timeouts {
+		at := at
+		if nextTimeout == nil || at.Before(*nextTimeout) {
+			nextTimeout = &at
+		}
+	}
+
+	var query string
+	if state.Version == 1 {
+		query = `
+			INSERT INTO process_states (process, correlation_id, version, position, data, timeouts, next_timeout, completed, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			ON CONFLICT (process, correlation_id) DO NOTHING`
+	} else {
+		query = `
+			UPDATE process_states
+			SET version = $3, position = $4, data = $5, timeouts = $6, next_timeout = $7, completed = $8, updated_at = $9
+			WHERE process = $1 AND correlation_id = $2 AND version = $3 - 1`
+	}
+	tag, err := s.db.Exec(ctx, query,
+		state.Process, state.CorrelationID, state.Version, state.Position, state.Data,
+		timeouts, nextTimeout, state.Completed, state.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		var actual int
+		err := s.db.QueryRow(ctx,
+			`SELECT version FROM process_states WHERE process = $1 AND correlation_id = $2`,
+			state.Process, state.CorrelationID,
+		).Scan(&actual)
+		if err != nil && err != pgx.ErrNoRows {
+			return err
+		}
+		return cqrs.NewConcurrencyConflictError(state.CorrelationID, state.Version-1, actual)
+	}
+	return nil
+}
+
+func (s *processStore) DueTimeouts(ctx context.Context, process string, now time.Time) ([]*cqrs.ProcessState, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	rows, err := s.db.Query(ctx,
+		`SELECT process, correlation_id, version, position, data, timeouts, completed, updated_at
+			FROM process_states
+			WHERE process = $1 AND NOT completed AND next_timeout <= $2
+			ORDER BY next_timeout ASC`, process, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	states := make([]*cqrs.ProcessState, 0)
+	for rows.Next() {
+		state, err := scanProcessState(rows)
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, state)
+	}
+	return states, rows.Err()
+}
+
+func scanProcessState(row pgx.Row) (*cqrs.ProcessState, error) {
+	state := &cqrs.ProcessState{}
+	var timeouts []byte
+	if err := row.Scan(&state.Process, &state.CorrelationID, &state.Version, &state.Position,
+		&state.Data, &timeouts, &state.Completed, &state.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(timeouts, &state.Timeouts); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
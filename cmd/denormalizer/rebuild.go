@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+
+	"github.com/delicb/toy-cqrs/cqrs"
+)
+
+// rebuildBatchSize is number of events read from the store at once during rebuild.
+const rebuildBatchSize = 500
+
+// rebuildProgressInterval is how often progress of rebuild is reported.
+const rebuildProgressInterval = 2 * time.Second
+
+// rebuildableProjection describes projection that maintains a single table,
+// so it can be rebuilt into a shadow table and swapped in.
+type rebuildableProjection struct {
+	// table is name of the table projection normally writes to.
+	table string
+	// new returns instance of projection writing to provided table.
+	new func(db *pgxpool.Pool, table string) cqrs.Projection
+}
+
+// eventTable is event store keeping events in Postgres table (see pgstore), rebuild
+// reads events through it and locks its table.
+type eventTable interface {
+	cqrs.EventReader
+	// Table returns quoted, schema qualified name of events table.
+	Table() string
+}
+
+var rebuildableProjections = map[string]rebuildableProjection{
+	"users": {
+		table: "users",
+		new: func(db *pgxpool.Pool, table string) cqrs.Projection {
+			return newUsersProjection(db, table)
+		},
+	},
+}
+
+// rebuild regenerates projection with provided name from scratch.
+// All events are replayed into shadow table (created to look like projection's table),
+// and once it has caught up, shadow table replaces projection's table and projection's
+// checkpoint is moved to the last replayed event. New events are blocked only for the
+// short time while the last few events are replayed and tables are swapped.
+// It is safe to run while denormalizer is running, since projection handlers are idempotent.
+func rebuild(ctx context.Context, pool *pgxpool.Pool, events eventTable, name string) error {
+	def, ok := rebuildableProjections[name]
+	if !ok {
+		return fmt.Errorf("unknown projection: %v", name)
+	}
+	shadow := def.table + "_rebuild"
+
+	log.Printf("rebuilding projection %v into table %v\n", name, shadow)
+	if err := createShadowTable(ctx, pool, def.table, shadow); err != nil {
+		return err
+	}
+
+	projection := def.new(pool, shadow)
+	position, err := replay(ctx, pool, events, projection, 0)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("caught up at position %d, swapping %v with %v\n", position, shadow, def.table)
+	err = pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		// block new events until tables are swapped, so that none of them is missed
+		if _, err := tx.Exec(ctx, `LOCK TABLE `+events.Table()+` IN EXCLUSIVE MODE`); err != nil {
+			return err
+		}
+		position, err = replay(ctx, pool, events, projection, position)
+		if err != nil {
+			return err
+		}
+		if err := swapTables(ctx, tx, def.table, shadow); err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `
+			INSERT INTO projection_checkpoints (name, position, updated_at)
+			VALUES ($1, $2, now())
+			ON CONFLICT (name) DO UPDATE SET position = excluded.position, updated_at = excluded.updated_at`,
+			projection.Name(), position)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("projection %v rebuilt up to position %d\n", name, position)
+	return nil
+}
+
+// createShadowTable creates empty table with the same structure as provided one,
+// dropping leftovers of previous unfinished rebuild, if any.
+func createShadowTable(ctx context.Context, pool *pgxpool.Pool, table, shadow string) error {
+	if _, err := pool.Exec(ctx, `DROP TABLE IF EXISTS `+pgx.Identifier{shadow}.Sanitize()); err != nil {
+		return err
+	}
+	_, err := pool.Exec(ctx, fmt.Sprintf(`CREATE TABLE %s (LIKE %s INCLUDING ALL)`,
+		pgx.Identifier{shadow}.Sanitize(), pgx.Identifier{table}.Sanitize()))
+	return err
+}
+
+// swapTables replaces table with shadow table, including names of its indexes,
+// so that the next rebuild can create shadow table again.
+func swapTables(ctx context.Context, tx pgx.Tx, table, shadow string) error {
+	old := table + "_old"
+	statements := []string{
+		fmt.Sprintf(`ALTER TABLE %s RENAME TO %s`, pgx.Identifier{table}.Sanitize(), pgx.Identifier{old}.Sanitize()),
+		fmt.Sprintf(`ALTER TABLE %s RENAME TO %s`, pgx.Identifier{shadow}.Sanitize(), pgx.Identifier{table}.Sanitize()),
+		fmt.Sprintf(`DROP TABLE %s`, pgx.Identifier{old}.Sanitize()),
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(ctx, stmt); err != nil {
+			return err
+		}
+	}
+
+	rows, err := tx.Query(ctx,
+		`SELECT indexname FROM pg_indexes WHERE schemaname = current_schema() AND tablename = $1`, table)
+	if err != nil {
+		return err
+	}
+	var indexes []string
+	for rows.Next() {
+		var index string
+		if err := rows.Scan(&index); err != nil {
+			rows.Close()
+			return err
+		}
+		indexes = append(indexes, index)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, index := range indexes {
+		if !strings.HasPrefix(index, shadow) {
+			continue
+		}
+		renamed := table + strings.TrimPrefix(index, shadow)
+		_, err := tx.Exec(ctx, fmt.Sprintf(`ALTER INDEX %s RENAME TO %s`,
+			pgx.Identifier{index}.Sanitize(), pgx.Identifier{renamed}.Sanitize()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replay applies all events after provided position to projection, reporting progress
+// as it goes, and returns position of the last replayed event.
+func replay(ctx context.Context, pool *pgxpool.Pool, events eventTable, projection cqrs.Projection, from int64) (int64, error) {
+	head, err := headPosition(ctx, pool, events.Table())
+	if err != nil {
+		return from, err
+	}
+
+	handlers := projection.Handlers()
+	it := cqrs.NewEventIterator(ctx, events, from, rebuildBatchSize)
+	lastReport := time.Now()
+	count := 0
+	for it.Next() {
+		if err := ctx.Err(); err != nil {
+			return it.Position(), err
+		}
+		ev := it.Event()
+		if h, ok := handlers[ev.EventID]; ok {
+			if err := h(ctx, ev); err != nil {
+				return it.Position(), fmt.Errorf("replaying event %d (%v): %w", ev.Position, ev.EventID, err)
+			}
+		}
+		count++
+
+		if time.Since(lastReport) >= rebuildProgressInterval {
+			reportProgress(ev.Position, head)
+			lastReport = time.Now()
+		}
+	}
+	if err := it.Err(); err != nil {
+		return it.Position(), err
+	}
+	log.Printf("replayed %d events\n", count)
+	return it.Position(), nil
+}
+
+func reportProgress(position, head int64) {
+	if position > head {
+		head = position
+	}
+	log.Printf("rebuild progress: %d/%d (%.1f%%)\n", position, head, float64(position)/float64(head)*100)
+}
+
+// headPosition returns position of the last event stored in provided table.
+func headPosition(ctx context.Context, pool *pgxpool.Pool, table string) (int64, error) {
+	var head int64
+	err := pool.QueryRow(ctx, `SELECT coalesce(max(position), 0) FROM `+table).Scan(&head)
+	return head, err
+}
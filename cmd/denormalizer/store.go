@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// checkpointStore implements cqrs.CheckpointStore on top of projection_checkpoints table.
+type checkpointStore struct {
+	db *pgxpool.Pool
+}
+
+func (s *checkpointStore) LoadCheckpoint(ctx context.Context, name string) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+	var position int64
+	err := s.db.QueryRow(ctx,
+		`SELECT position FROM projection_checkpoints WHERE name = $1`, name,
+	).Scan(&position)
+	if err == pgx.ErrNoRows {
+		return 0, nil
+	}
+	return position, err
+}
+
+func (s *checkpointStore) SaveCheckpoint(ctx context.Context, name string, position int64) error {
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+	_, err := s.db.Exec(ctx, `
+		INSERT INTO projection_checkpoints (name, position, updated_at)
+		VALUES ($1, $2, now())
+		ON CONFLICT (name) DO UPDATE SET position = excluded.position, updated_at = excluded.updated_at`,
+		name, position)
+	return err
+}
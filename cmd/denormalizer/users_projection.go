@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+
+	"github.com/delicb/toy-cqrs/cqrs"
+	"github.com/delicb/toy-cqrs/users"
+)
+
+// usersProjection maintains users table, view of users suitable for returning to API clients.
+type usersProjection struct {
+	db    *pgxpool.Pool
+	table string
+}
+
+// newUsersProjection returns users projection writing to provided table. Normally, that is
+// users table, but it can be different one, e.g. when projection is being rebuilt.
+func newUsersProjection(db *pgxpool.Pool, table string) *usersProjection {
+	return &usersProjection{
+		db:    db,
+		table: table,
+	}
+}
+
+func (m *usersProjection) Name() string { return "users" }
+
+func (m *usersProjection) Handlers() map[cqrs.EventID]cqrs.EventHandler {
+	return map[cqrs.EventID]cqrs.EventHandler{
+		users.UserCreatedID:     m.insertUser,
+		users.PasswordChangedID: m.updateUserPassword,
+		users.EmailChangedID:    m.updateUserEmail,
+		users.EnabledID:         m.enableUser,
+		users.DisabledID:        m.disableUser,
+	}
+}
+
+func (m *usersProjection) insertUser(ctx context.Context, ev *cqrs.Event) error {
+	payload := ev.Data.(*users.UserCreated)
+	return m.db.BeginFunc(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `
+			INSERT INTO `+m.quotedTable()+`
+				(id, email, password, enabled, last_event_time, last_correlation_id) 
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (id) DO NOTHING`, // event might be processed again after restart
+			ev.AggregateID, payload.Email, payload.Password, payload.IsEnabled, ev.CreatedAt, ev.CorrelationID)
+		return err
+	})
+}
+
+func (m *usersProjection) updateUserPassword(ctx context.Context, ev *cqrs.Event) error {
+	payload := ev.Data.(*users.UserPasswordChanged)
+	return m.db.BeginFunc(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `UPDATE `+m.quotedTable()+` SET password=$1 WHERE id=$2`,
+			payload.NewPassword, ev.AggregateID)
+		return err
+	})
+}
+
+func (m *usersProjection) updateUserEmail(ctx context.Context, ev *cqrs.Event) error {
+	payload := ev.Data.(*users.UserEmailChanged)
+	return m.db.BeginFunc(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `UPDATE `+m.quotedTable()+` SET email=$1 WHERE id=$2`,
+			payload.NewEmail, ev.AggregateID)
+		return err
+	})
+}
+
+func (m *usersProjection) enableUser(ctx context.Context, ev *cqrs.Event) error {
+	return m.db.BeginFunc(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `UPDATE `+m.quotedTable()+` SET enabled=$1 WHERE id=$2`,
+			true, ev.AggregateID)
+		return err
+	})
+}
+
+func (m *usersProjection) disableUser(ctx context.Context, ev *cqrs.Event) error {
+	return m.db.BeginFunc(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `UPDATE `+m.quotedTable()+` SET enabled=$1 WHERE id=$2`,
+			false, ev.AggregateID)
+		return err
+	})
+}
+
+func (m *usersProjection) quotedTable() string {
+	return pgx.Identifier{m.table}.Sanitize()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/delicb/toy-cqrs/cqrs"
+	"github.com/delicb/toy-cqrs/users"
+)
+
+// sqliteUsersSchema creates users table in SQLite database, same as one in schema.sql.
+const sqliteUsersSchema = `
+create table if not exists users (
+	id text,
+	email varchar(128) not null,
+	password varchar(128) not null,
+	enabled bool not null,
+	last_event_time timestamp not null,
+	last_correlation_id text not null,
+	primary key(id)
+);
+`
+
+// sqliteUsersProjection maintains users table in SQLite database, see usersProjection.
+type sqliteUsersProjection struct {
+	db *sql.DB
+}
+
+func newSqliteUsersProjection(db *sql.DB) *sqliteUsersProjection {
+	return &sqliteUsersProjection{db: db}
+}
+
+func (m *sqliteUsersProjection) Name() string { return "users" }
+
+func (m *sqliteUsersProjection) Handlers() map[cqrs.EventID]cqrs.EventHandler {
+	return map[cqrs.EventID]cqrs.EventHandler{
+		users.UserCreatedID:     m.insertUser,
+		users.PasswordChangedID: m.updateUserPassword,
+		users.EmailChangedID:    m.updateUserEmail,
+		users.EnabledID:         m.enableUser,
+		users.DisabledID:        m.disableUser,
+	}
+}
+
+func (m *sqliteUsersProjection) insertUser(ctx context.Context, ev *cqrs.Event) error {
+	payload := ev.Data.(*users.UserCreated)
+	_, err := m.db.ExecContext(ctx, `
+		INSERT INTO users
+			(id, email, password, enabled, last_event_time, last_correlation_id)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO NOTHING`, // event might be processed again after restart
+		ev.AggregateID, payload.Email, payload.Password, payload.IsEnabled, ev.CreatedAt, ev.CorrelationID)
+	return err
+}
+
+func (m *sqliteUsersProjection) updateUserPassword(ctx context.Context, ev *cqrs.Event) error {
+	payload := ev.Data.(*users.UserPasswordChanged)
+	_, err := m.db.ExecContext(ctx, `UPDATE users SET password=? WHERE id=?`,
+		payload.NewPassword, ev.AggregateID)
+	return err
+}
+
+func (m *sqliteUsersProjection) updateUserEmail(ctx context.Context, ev *cqrs.Event) error {
+	payload := ev.Data.(*users.UserEmailChanged)
+	_, err := m.db.ExecContext(ctx, `UPDATE users SET email=? WHERE id=?`,
+		payload.NewEmail, ev.AggregateID)
+	return err
+}
+
+func (m *sqliteUsersProjection) enableUser(ctx context.Context, ev *cqrs.Event) error {
+	_, err := m.db.ExecContext(ctx, `UPDATE users SET enabled=? WHERE id=?`,
+		true, ev.AggregateID)
+	return err
+}
+
+func (m *sqliteUsersProjection) disableUser(ctx context.Context, ev *cqrs.Event) error {
+	_, err := m.db.ExecContext(ctx, `UPDATE users SET enabled=? WHERE id=?`,
+		false, ev.AggregateID)
+	return err
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/delicb/toy-cqrs/cqrs"
+)
+
+const (
+	// exportBatchSize is number of events read from the store at once.
+	exportBatchSize = 500
+	// maxLineSize is maximal length of a line of imported file.
+	maxLineSize = 16 << 20
+)
+
+// record is single line of exported file, event serialized by event serializer
+// and SHA-256 checksum of serialized event.
+type record struct {
+	Event    json.RawMessage `json:"event"`
+	Checksum string          `json:"checksum"`
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// exportFilter selects exported aggregates, empty fields match any aggregate. Aggregates are always
+// exported with their whole history (imported aggregates can not have gaps in versions), so EventID,
+// Since and Until select aggregates that have at least one matching event.
+type exportFilter struct {
+	AggregateID   string
+	AggregateType string
+	EventID       cqrs.EventID
+	// Since and Until limit time of creation of events to [Since, Until)
+	Since time.Time
+	Until time.Time
+}
+
+func (f exportFilter) matchesAggregate(ev *cqrs.Event) bool {
+	return (f.AggregateID == "" || f.AggregateID == ev.AggregateID) &&
+		(f.AggregateType == "" || f.AggregateType == ev.AggregateType)
+}
+
+func (f exportFilter) matches(ev *cqrs.Event) bool {
+	return f.matchesAggregate(ev) &&
+		(f.EventID == "" || f.EventID == ev.EventID) &&
+		(f.Since.IsZero() || !ev.CreatedAt.Before(f.Since)) &&
+		(f.Until.IsZero() || ev.CreatedAt.Before(f.Until))
+}
+
+// filtersEvents reports whether filter looks at individual events, not only at aggregates they belong to.
+func (f exportFilter) filtersEvents() bool {
+	return f.EventID != "" || !f.Since.IsZero() || !f.Until.IsZero()
+}
+
+// matchingAggregates returns IDs of aggregates with at least one event matched by filter.
+func matchingAggregates(ctx context.Context, reader cqrs.EventReader, filter exportFilter) (map[string]bool, error) {
+	aggregates := make(map[string]bool)
+	it := cqrs.NewEventIterator(ctx, reader, 0, exportBatchSize)
+	for it.Next() {
+		if ev := it.Event(); filter.matches(ev) {
+			aggregates[ev.AggregateID] = true
+		}
+	}
+	return aggregates, it.Err()
+}
+
+// exportEvents writes all events of aggregates selected by filter from reader to w, one record
+// per line, in order of their positions, and returns number of written events. If filter looks at
+// individual events, events are read twice, first to find aggregates and then to export them.
+func exportEvents(ctx context.Context, reader cqrs.EventReader, serializer cqrs.EventSerializer, filter exportFilter, w io.Writer) (int, error) {
+	selected := filter.matchesAggregate
+	if filter.filtersEvents() {
+		aggregates, err := matchingAggregates(ctx, reader, filter)
+		if err != nil {
+			return 0, err
+		}
+		selected = func(ev *cqrs.Event) bool { return aggregates[ev.AggregateID] }
+	}
+
+	out := bufio.NewWriter(w)
+	encoder := json.NewEncoder(out)
+	// serialized events are written as they are, so that checksums match
+	encoder.SetEscapeHTML(false)
+	count := 0
+	it := cqrs.NewEventIterator(ctx, reader, 0, exportBatchSize)
+	for it.Next() {
+		ev := it.Event()
+		if !selected(ev) {
+			continue
+		}
+		data, err := serializer.Marshal(ev)
+		if err != nil {
+			return count, fmt.Errorf("serializing event at position %d: %w", ev.Position, err)
+		}
+		// encoder terminates each record with new line
+		if err := encoder.Encode(&record{Event: data, Checksum: checksum(data)}); err != nil {
+			return count, err
+		}
+		count++
+	}
+	if err := it.Err(); err != nil {
+		return count, err
+	}
+	return count, out.Flush()
+}
+
+// importEvents saves events read from r (in format written by exportEvents) to store and returns
+// number of saved events. Checksums of all events are verified before any of them is saved, and
+// events are saved at once, so import is all or nothing. Events keep their versions, creation times
+// and correlation IDs, and get new positions, so histories of imported aggregates have to be complete
+// and must not already be in the store, otherwise saving fails with concurrency conflict.
+func importEvents(ctx context.Context, store cqrs.EventStore, serializer cqrs.EventSerializer, r io.Reader) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	line := 0
+	var events []*cqrs.Event
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		rec := &record{}
+		if err := json.Unmarshal(scanner.Bytes(), rec); err != nil {
+			return 0, fmt.Errorf("line %d: %w", line, err)
+		}
+		if sum := checksum(rec.Event); sum != rec.Checksum {
+			return 0, fmt.Errorf("line %d: checksum mismatch, expected %v, got %v", line, rec.Checksum, sum)
+		}
+		ev, err := serializer.Unmarshal(rec.Event)
+		if err != nil {
+			return 0, fmt.Errorf("line %d: %w", line, err)
+		}
+		events = append(events, ev)
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	if len(events) == 0 {
+		return 0, nil
+	}
+	if err := store.Save(ctx, events); err != nil {
+		return 0, fmt.Errorf("saving events: %w", err)
+	}
+	return len(events), nil
+}
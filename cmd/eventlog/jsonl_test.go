@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/delicb/toy-cqrs/cqrs"
+	"github.com/delicb/toy-cqrs/users"
+)
+
+func userEvent(ID cqrs.EventID, aggregateID string, version int, createdAt time.Time, data interface{}) *cqrs.Event {
+	return &cqrs.Event{
+		EventID:       ID,
+		AggregateID:   aggregateID,
+		AggregateType: "user",
+		CreatedAt:     createdAt,
+		CorrelationID: "corr-" + aggregateID,
+		Version:       version,
+		Data:          data,
+	}
+}
+
+func sourceStore(t *testing.T) cqrs.EventStore {
+	may := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	june := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	store := cqrs.NewInMemoryEventStore()
+	require.NoError(t, store.Save(context.Background(), []*cqrs.Event{
+		userEvent(users.UserCreatedID, "u1", 1, may, &users.UserCreated{Email: "u1@example.com", IsEnabled: true}),
+		userEvent(users.UserCreatedID, "u2", 1, may, &users.UserCreated{Email: "u2@example.com"}),
+		userEvent(users.EmailChangedID, "u1", 2, june, &users.UserEmailChanged{NewEmail: "new@example.com"}),
+	}))
+	return store
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	var buf bytes.Buffer
+	count, err := exportEvents(ctx, sourceStore(t), users.EventSerializer, exportFilter{AggregateID: "u1"}, &buf)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, 2, strings.Count(buf.String(), "\n"))
+
+	target := cqrs.NewInMemoryEventStore()
+	count, err = importEvents(ctx, target, users.EventSerializer, &buf)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	events, err := target.Load(ctx, "u1")
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, "corr-u1", events[1].CorrelationID)
+	assert.True(t, events[1].CreatedAt.Equal(time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)))
+	assert.Equal(t, "new@example.com", events[1].Data.(*users.UserEmailChanged).NewEmail)
+}
+
+func TestExportFilters(t *testing.T) {
+	ctx := context.Background()
+	store := sourceStore(t)
+	for name, tc := range map[string]struct {
+		filter   exportFilter
+		expected int
+	}{
+		"all":       {exportFilter{}, 3},
+		"type":      {exportFilter{AggregateType: "account"}, 0},
+		"aggregate": {exportFilter{AggregateID: "u2"}, 1},
+		// filters of events select aggregates, which are exported with whole history
+		"event ID": {exportFilter{EventID: users.EmailChangedID}, 2},
+		"created":  {exportFilter{EventID: users.UserCreatedID}, 3},
+		"since":    {exportFilter{Since: time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)}, 2},
+		"until":    {exportFilter{Until: time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)}, 3},
+		"combined": {exportFilter{AggregateID: "u2", Since: time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)}, 0},
+	} {
+		t.Run(name, func(t *testing.T) {
+			count, err := exportEvents(ctx, store, users.EventSerializer, tc.filter, &bytes.Buffer{})
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, count)
+		})
+	}
+}
+
+func TestFilteredExportCanBeImported(t *testing.T) {
+	ctx := context.Background()
+	var buf bytes.Buffer
+	filter := exportFilter{Since: time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)}
+	_, err := exportEvents(ctx, sourceStore(t), users.EventSerializer, filter, &buf)
+	require.NoError(t, err)
+
+	target := cqrs.NewInMemoryEventStore()
+	count, err := importEvents(ctx, target, users.EventSerializer, &buf)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	// u1 is changed in June, its creation in May is exported as well
+	events, err := target.Load(ctx, "u1")
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, users.UserCreatedID, events[0].EventID)
+	events, err = target.Load(ctx, "u2")
+	require.NoError(t, err)
+	assert.Empty(t, events)
+}
+
+func TestImportRejectsDamagedRecord(t *testing.T) {
+	ctx := context.Background()
+	var buf bytes.Buffer
+	_, err := exportEvents(ctx, sourceStore(t), users.EventSerializer, exportFilter{}, &buf)
+	require.NoError(t, err)
+	damaged := strings.Replace(buf.String(), "u2@example.com", "u3@example.com", 1)
+
+	target := cqrs.NewInMemoryEventStore()
+	_, err = importEvents(ctx, target, users.EventSerializer, strings.NewReader(damaged))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "line 2: checksum mismatch")
+
+	// records are verified before anything is saved, so nothing before damaged record is saved either
+	events, err := target.ReadAll(ctx, 0, 0)
+	require.NoError(t, err)
+	assert.Empty(t, events)
+}
+
+func TestImportIsAllOrNothing(t *testing.T) {
+	ctx := context.Background()
+	at := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	source := cqrs.NewInMemoryEventStore()
+	for i := 1; i <= 250; i++ {
+		ev := userEvent(users.EmailChangedID, "u1", i, at, &users.UserEmailChanged{NewEmail: fmt.Sprintf("u%d@example.com", i)})
+		require.NoError(t, source.Save(ctx, []*cqrs.Event{ev}))
+	}
+	var buf bytes.Buffer
+	_, err := exportEvents(ctx, source, users.EventSerializer, exportFilter{}, &buf)
+	require.NoError(t, err)
+	damaged := strings.Replace(buf.String(), "u240@example.com", "u241@example.com", 1)
+
+	target := cqrs.NewInMemoryEventStore()
+	count, err := importEvents(ctx, target, users.EventSerializer, strings.NewReader(damaged))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "line 240: checksum mismatch")
+	assert.Equal(t, 0, count)
+
+	events, err := target.ReadAll(ctx, 0, 0)
+	require.NoError(t, err)
+	assert.Empty(t, events)
+}
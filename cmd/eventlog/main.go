@@ -0,0 +1,205 @@
+// Command eventlog exports events from an event store to JSON Lines file and imports
+// such files into an event store, e.g. to move history of events between environments
+// or to attach it to a bug report.
+//
+//	eventlog export [-store postgres|sqlite|file] [-location ...] [-aggregate-id ...] [-aggregate-type ...]
+//	    [-event-id ...] [-since 2021-05-01T00:00:00Z] [-until ...] [-out events.jsonl]
+//	eventlog import [-store postgres|sqlite|file] [-location ...] [events.jsonl]
+//
+// Each line of the file holds one event, serialized by users.EventSerializer, and its checksum.
+// Selected aggregates are always exported with all their events, so that they can be imported.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+
+	"github.com/delicb/toy-cqrs/cqrs"
+	"github.com/delicb/toy-cqrs/cqrs/filestore"
+	"github.com/delicb/toy-cqrs/cqrs/pgstore"
+	"github.com/delicb/toy-cqrs/cqrs/sqlitestore"
+	"github.com/delicb/toy-cqrs/users"
+)
+
+const usage = `usage:
+  eventlog export [flags]         writes events to file (stdout by default)
+  eventlog import [flags] [file]  saves events from file (stdin by default) to the store`
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		log.Fatalln(usage)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "export":
+		err = runExport(os.Args[2:])
+	case "import":
+		err = runImport(os.Args[2:])
+	default:
+		log.Fatalln(usage)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// storeFlags are flags selecting event store, shared by all commands.
+type storeFlags struct {
+	kind     string
+	location string
+}
+
+func (f *storeFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.kind, "store", "postgres", "kind of event store: postgres, sqlite or file")
+	fs.StringVar(&f.location, "location", "",
+		"DSN for postgres (DATABASE_URL by default), database file for sqlite or directory for file store")
+}
+
+// open returns event store selected by flags and function closing it. Store is created, migrated
+// or otherwise changed only if write is set, export opens it read-only so that source is left as it is.
+func (f *storeFlags) open(ctx context.Context, write bool) (cqrs.EventStore, func() error, error) {
+	switch f.kind {
+	case "postgres":
+		dsn := f.location
+		if dsn == "" {
+			dsn = os.Getenv("DATABASE_URL")
+		}
+		pool, err := pgxpool.Connect(ctx, dsn)
+		if err != nil {
+			return nil, nil, err
+		}
+		store := pgstore.NewEventStore(pool, users.EventSerializer, pgstore.Options{})
+		if !write {
+			return store, func() error { pool.Close(); return nil }, nil
+		}
+		if err := store.Migrate(ctx); err != nil {
+			pool.Close()
+			return nil, nil, err
+		}
+		return store, func() error { pool.Close(); return nil }, nil
+	case "sqlite":
+		var db *sql.DB
+		var err error
+		if write {
+			db, err = sqlitestore.Open(f.location)
+		} else {
+			db, err = sqlitestore.OpenReadOnly(f.location)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return sqlitestore.NewEventStore(db, users.EventSerializer), db.Close, nil
+	case "file":
+		if !write {
+			store, err := filestore.OpenReadOnly(f.location, users.EventSerializer)
+			if err != nil {
+				return nil, nil, err
+			}
+			return store, store.Close, nil
+		}
+		store, err := filestore.Open(f.location, users.EventSerializer, filestore.Options{Sync: filestore.SyncNever})
+		if err != nil {
+			return nil, nil, err
+		}
+		// Close flushes everything written to disk
+		return store, store.Close, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown store: %v", f.kind)
+	}
+}
+
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	var sf storeFlags
+	sf.register(fs)
+	var filter exportFilter
+	var eventID, since, until, out string
+	fs.StringVar(&filter.AggregateID, "aggregate-id", "", "export only events of aggregate with this ID")
+	fs.StringVar(&filter.AggregateType, "aggregate-type", "", "export only events of aggregates of this type")
+	fs.StringVar(&eventID, "event-id", "", "export only aggregates with event with this ID (e.g. user.created)")
+	fs.StringVar(&since, "since", "", "export only aggregates with events created at or after this time (RFC 3339)")
+	fs.StringVar(&until, "until", "", "export only aggregates with events created before this time (RFC 3339)")
+	fs.StringVar(&out, "out", "", "file to write events to, stdout if empty")
+	_ = fs.Parse(args)
+
+	filter.EventID = cqrs.EventID(eventID)
+	var err error
+	if filter.Since, err = parseTime(since); err != nil {
+		return fmt.Errorf("invalid -since: %w", err)
+	}
+	if filter.Until, err = parseTime(until); err != nil {
+		return fmt.Errorf("invalid -until: %w", err)
+	}
+
+	ctx := context.Background()
+	store, closeStore, err := sf.open(ctx, false)
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	var w io.Writer = os.Stdout
+	if out != "" {
+		f, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	count, err := exportEvents(ctx, store, users.EventSerializer, filter, w)
+	if err != nil {
+		return err
+	}
+	log.Printf("exported %d events\n", count)
+	return nil
+}
+
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	var sf storeFlags
+	sf.register(fs)
+	_ = fs.Parse(args)
+
+	var r io.Reader = os.Stdin
+	if fs.NArg() > 0 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	ctx := context.Background()
+	store, closeStore, err := sf.open(ctx, true)
+	if err != nil {
+		return err
+	}
+
+	count, err := importEvents(ctx, store, users.EventSerializer, r)
+	if closeErr := closeStore(); err == nil {
+		err = closeErr
+	}
+	log.Printf("imported %d events\n", count)
+	return err
+}
+
+// parseTime parses time in RFC 3339 format, empty string is zero time.
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportDoesNotCreateMissingStore(t *testing.T) {
+	ctx := context.Background()
+	for _, kind := range []string{"sqlite", "file"} {
+		t.Run(kind, func(t *testing.T) {
+			location := filepath.Join(t.TempDir(), "missing")
+			f := storeFlags{kind: kind, location: location}
+			_, _, err := f.open(ctx, false)
+			assert.Error(t, err)
+			assert.NoFileExists(t, location)
+			assert.NoDirExists(t, location)
+		})
+	}
+}
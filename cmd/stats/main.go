@@ -1,17 +1,22 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
-	"strings"
 	"sync/atomic"
 
 	"github.com/nats-io/nats.go"
+
+	"github.com/delicb/toy-cqrs/cqrs"
+	"github.com/delicb/toy-cqrs/cqrs/natsbus"
+	"github.com/delicb/toy-cqrs/users"
 )
 
 func main() {
+	ctx := context.Background()
 	natsConn, err := nats.Connect(os.Getenv("NATS_URL"))
 	if err != nil {
 		panic(err)
@@ -19,11 +24,22 @@ func main() {
 
 	monitor := &statsMonitor{}
 
-	_, err = natsConn.Subscribe("command.>", monitor.onMessage)
+	_, err = natsConn.Subscribe("command.>", monitor.onCommand)
+	if err != nil {
+		panic(err)
+	}
+	// failures of commands are published next to events, see natsbus
+	_, err = natsConn.Subscribe("event.*.error", monitor.onCommandError)
+	if err != nil {
+		panic(err)
+	}
+
+	events := natsbus.NewEventBus(natsConn, users.EventSerializer)
+	_, err = events.Subscribe(ctx, cqrs.AllEvents(), monitor.onEvent)
 	if err != nil {
 		panic(err)
 	}
-	_, err = natsConn.Subscribe("event.>", monitor.onMessage)
+	_, err = cqrs.SubscribeTyped(ctx, events, users.UserCreatedID, monitor.onUserCreated)
 	if err != nil {
 		panic(err)
 	}
@@ -36,27 +52,36 @@ type statsMonitor struct {
 	cmdCount         uint32
 	eventsCount      uint32
 	errorEventsCount uint32
+	usersCreated     uint32
 }
 
-func (p *statsMonitor) onMessage(msg *nats.Msg) {
-	sub := msg.Subject
-	if strings.HasPrefix(sub, "command") {
-		atomic.AddUint32(&p.cmdCount, 1)
-	} else if strings.HasPrefix(sub, "event") {
-		atomic.AddUint32(&p.eventsCount, 1)
-	}
+func (p *statsMonitor) onCommand(_ *nats.Msg) {
+	atomic.AddUint32(&p.cmdCount, 1)
+}
 
-	if strings.HasSuffix(sub, "error") {
-		atomic.AddUint32(&p.errorEventsCount, 1)
-	}
+func (p *statsMonitor) onCommandError(_ *nats.Msg) {
+	atomic.AddUint32(&p.errorEventsCount, 1)
+}
+
+func (p *statsMonitor) onEvent(_ context.Context, _ *cqrs.Event) error {
+	atomic.AddUint32(&p.eventsCount, 1)
+	return nil
+}
+
+func (p *statsMonitor) onUserCreated(_ context.Context, _ *cqrs.Event, _ *users.UserCreated) error {
+	atomic.AddUint32(&p.usersCreated, 1)
+	return nil
 }
 
 func (p *statsMonitor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cmdCount := atomic.LoadUint32(&p.cmdCount)
+	errorCount := atomic.LoadUint32(&p.errorEventsCount)
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "total commands: %d\n", p.cmdCount)
-	fmt.Fprintf(w, "total events: %d\n", p.eventsCount)
-	fmt.Fprintf(w, "total error events: %d\n", p.errorEventsCount)
-	if p.eventsCount > 0 {
-		fmt.Fprintf(w, "total errors percentage: %d\n", p.errorEventsCount/p.eventsCount*100)
+	fmt.Fprintf(w, "total commands: %d\n", cmdCount)
+	fmt.Fprintf(w, "total events: %d\n", atomic.LoadUint32(&p.eventsCount))
+	fmt.Fprintf(w, "total users created: %d\n", atomic.LoadUint32(&p.usersCreated))
+	fmt.Fprintf(w, "total failed commands: %d\n", errorCount)
+	if cmdCount > 0 {
+		fmt.Fprintf(w, "failed commands percentage: %d\n", errorCount*100/cmdCount)
 	}
 }
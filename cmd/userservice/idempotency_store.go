@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+
+	"github.com/delicb/toy-cqrs/cqrs"
+)
+
+type psqlIdempotencyStorage struct {
+	db *pgxpool.Pool
+}
+
+// NewPsqlIdempotencyStore implements cqrs.IdempotencyStore interface on top of Postgres database.
+func NewPsqlIdempotencyStore(db *pgxpool.Pool) *psqlIdempotencyStorage {
+	return &psqlIdempotencyStorage{db: db}
+}
+
+// reserveAttempts is how many times Reserve tries to either reserve a key or read its
+// outcome, outcome can be released between the two.
+const reserveAttempts = 3
+
+func (p *psqlIdempotencyStorage) Reserve(ctx context.Context, pending *cqrs.CommandOutcome, since, pendingSince time.Time) (*cqrs.CommandOutcome, error) {
+	for i := 0; i < reserveAttempts; i++ {
+		// expired outcomes and abandoned reservations are taken over, everything else is kept
+		tag, err := p.db.Exec(ctx, `
+			INSERT INTO processed_commands (key, command_id, error, pending, processed_at)
+			VALUES ($1, $2, '', true, $3)
+			ON CONFLICT (key) DO UPDATE
+				SET command_id = excluded.command_id, error = '', pending = true, processed_at = excluded.processed_at
+				WHERE processed_commands.processed_at < $4
+					OR (processed_commands.pending AND processed_commands.processed_at < $5)`,
+			pending.Key, pending.CommandID, pending.ProcessedAt, since, pendingSince,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if tag.RowsAffected() == 1 {
+			return nil, nil
+		}
+
+		o := &cqrs.CommandOutcome{}
+		err = p.db.QueryRow(ctx,
+			`SELECT key, command_id, error, pending, processed_at
+				FROM processed_commands
+				WHERE key = $1`, pending.Key,
+		).Scan(&o.Key, &o.CommandID, &o.Error, &o.Pending, &o.ProcessedAt)
+		if err == pgx.ErrNoRows {
+			// released in the meantime, try to reserve again
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return o, nil
+	}
+	return nil, fmt.Errorf("failed to reserve idempotency key %v", pending.Key)
+}
+
+func (p *psqlIdempotencyStorage) Complete(ctx context.Context, o *cqrs.CommandOutcome) error {
+	_, err := p.db.Exec(ctx, `
+		INSERT INTO processed_commands (key, command_id, error, pending, processed_at)
+		VALUES ($1, $2, $3, false, $4)
+		ON CONFLICT (key) DO UPDATE
+			SET command_id = excluded.command_id, error = excluded.error, pending = false, processed_at = excluded.processed_at`,
+		o.Key, o.CommandID, o.Error, o.ProcessedAt,
+	)
+	return err
+}
+
+func (p *psqlIdempotencyStorage) Release(ctx context.Context, key string) error {
+	_, err := p.db.Exec(ctx, `DELETE FROM processed_commands WHERE key = $1 AND pending`, key)
+	return err
+}
+
+func (p *psqlIdempotencyStorage) Purge(ctx context.Context, before time.Time) error {
+	_, err := p.db.Exec(ctx, `DELETE FROM processed_commands WHERE processed_at < $1`, before)
+	return err
+}
+
+// completeOutcome marks command being handled (see cqrs.CommandFromContext) as successfully
+// handled in the same transaction its events are stored in, so that command is not handled
+// again if userservice stops before idempotent handler records outcome. It has to be called
+// in the same transaction event is stored in.
+func completeOutcome(ctx context.Context, tx pgx.Tx, _ *cqrs.Event) error {
+	cmd, ok := cqrs.CommandFromContext(ctx)
+	if !ok || cmd.GetIdempotencyKey() == "" {
+		return nil
+	}
+	_, err := tx.Exec(ctx, `
+		UPDATE processed_commands
+		SET error = '', pending = false, processed_at = $2
+		WHERE key = $1 AND pending`,
+		cmd.GetIdempotencyKey(), time.Now().UTC(),
+	)
+	return err
+}
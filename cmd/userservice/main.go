@@ -2,18 +2,30 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"encoding/json"
 	"log"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/nats-io/nats.go"
 
 	"github.com/delicb/toy-cqrs/cqrs"
+	"github.com/delicb/toy-cqrs/cqrs/natsbus"
 	"github.com/delicb/toy-cqrs/users"
 )
 
+// snapshotEvery is number of events after which new snapshot of a user is stored.
+const snapshotEvery = 50
+
+// commandTimeout is how long handling of a single command, including all database queries, can take.
+const commandTimeout = 10 * time.Second
+
+// commandRetention is how long handled commands are remembered, repeated commands within it are not handled again.
+const commandRetention = 24 * time.Hour
+
 func main() {
 	// root context
 	rootCtx, cancel := context.WithCancel(context.Background())
@@ -25,54 +37,129 @@ func main() {
 		panic(err)
 	}
 
-	// initialize storage
-	store, err := NewPsqlEventStore(rootCtx, os.Getenv("DATABASE_URL"))
+	// initialize storage, postgres or file, depending on configuration
+	store, err := newStorage(rootCtx, natsConn)
 	if err != nil {
 		panic(err)
 	}
+	defer func() {
+		if err := store.close(); err != nil {
+			log.Printf("ERROR: closing storage failed: %v\n", err)
+		}
+	}()
 
 	// create validator to register with command handler
-	validator, err := NewValidator(store)
+	validator, err := NewValidator(rootCtx, store.events)
 	if err != nil {
 		panic(err)
 	}
 
 	// register hook to update validator state when events are saved
-	store.AddAfterSaveHook(validator.UpdateEmailState)
+	store.events.AddAfterSaveHook(validator.UpdateEmailState)
 
-	// initialize aggregate root repository
-	repo := cqrs.NewSimpleRepository(store)
+	// initialize aggregate root repository, snapshotting users every so often
+	// so that long-lived users do not have to be rebuilt from all events
+	repo := cqrs.NewSnapshotRepository(store.events, store.snapshots, snapshotEvery)
 
 	// register constructor for our main (and only) aggregate root (user)
-	repo.RegisterCtor("user", func() cqrs.AggregateRoot { return &User{} })
+	repo.RegisterCtor("user", func() cqrs.AggregateRoot { return NewUser() })
 
-	// create simple command handler
-	handler := cqrs.NewSimpleHandler(repo)
-	// hook validator into command handler
-	handler.AddValidator(validator)
+	// fail fast if some user event can not be applied, rather than when it is loaded
+	registry, ok := users.EventSerializer.(cqrs.EventDataRegistry)
+	if !ok {
+		panic("users.EventSerializer can not list registered events")
+	}
+	if err := NewUser().CheckAppliers(registry); err != nil {
+		panic(err)
+	}
 
-	log.Println("subscribing to commands")
-	sub, err := natsConn.Subscribe("command.user.>", func(msg *nats.Msg) {
-		// get command name from subject
-		cmd, err := users.CommandSerializer.Unmarshal(msg.Data)
+	// command handler is composed from simple handler and middlewares adding
+	// cross-cutting behaviour, first middleware is the outermost one
+	handler := cqrs.Chain(cqrs.NewSimpleHandler(repo),
+		cqrs.RecoveryMiddleware(),
+		cqrs.LoggingMiddleware(log.Default()),
+		cqrs.TimingMiddleware(func(cmd cqrs.Command, took time.Duration, _ error) {
+			log.Printf("command %v (correlation ID: %v) took %v\n", cmd.GetCommandID(), cmd.GetCorrelationID(), took)
+		}),
+		// handle each command only once, even if it is redelivered or sent again by client
+		cqrs.IdempotencyMiddleware(store.idempotency, commandRetention),
+		// retry commands that conflict with concurrent changes of the same user,
+		// validation is repeated on retry, since state might have changed
+		cqrs.RetryMiddleware(cqrs.RetryPolicy{
+			MaxAttempts: 5,
+			Backoff:     cqrs.ExponentialBackoff(10*time.Millisecond, 500*time.Millisecond),
+		}),
+		cqrs.ValidationMiddleware(validator),
+	)
+
+	// commands are received from nats, outcome of failed ones is published there as well
+	bus := natsbus.NewCommandBus(natsConn, users.CommandSerializer)
+
+	// scheduler sends commands scheduled for later to command.user.* once they are due
+	scheduler := cqrs.NewScheduler(store.schedule, users.CommandSerializer, bus)
+	go scheduler.Run(rootCtx)
+
+	log.Println("subscribing to scheduled commands")
+	scheduleSub, err := natsConn.Subscribe(users.ScheduleSubject, func(msg *nats.Msg) {
+		req := &users.ScheduleRequest{}
+		if err := json.Unmarshal(msg.Data, req); err != nil {
+			natsbus.Respond(msg, err)
+			return
+		}
+		// unmarshal command to make sure it will be understood once it is due
+		cmd, err := users.CommandSerializer.Unmarshal(req.Command)
 		if err != nil {
-			respondError(msg, err)
+			natsbus.Respond(msg, err)
 			return
 		}
-
-		log.Printf("Have command: %+v", cmd)
-		// respond that command is accepted
-		respondOk(msg)
-
-		if err := handler.HandleCommand(cmd); err != nil {
-			log.Println("handing command failed with error: ", err)
-			publishError(natsConn, cmd.GetCorrelationID(), err)
+		sc, err := scheduler.Schedule(rootCtx, cmd, req.DueAt)
+		if err == nil {
+			log.Printf("Scheduled command %v (correlation ID: %v) at %v", sc.CommandID, sc.CorrelationID, sc.DueAt)
+		}
+		natsbus.Respond(msg, err)
+	})
+	if err != nil {
+		panic(err)
+	}
+	cancelSub, err := natsConn.Subscribe(users.CancelScheduleSubject, func(msg *nats.Msg) {
+		req := &users.CancelScheduleRequest{}
+		if err := json.Unmarshal(msg.Data, req); err != nil {
+			natsbus.Respond(msg, err)
+			return
+		}
+		cancelled, err := scheduler.Cancel(rootCtx, req.CorrelationID)
+		if err == nil {
+			log.Printf("Cancelled %d scheduled commands (correlation ID: %v)", cancelled, req.CorrelationID)
 		}
+		natsbus.Respond(msg, err)
 	})
 	if err != nil {
 		panic(err)
 	}
 
+	// each command is subscribed to separately, but they are handled one at the time, since
+	// validator (e.g. taken emails) must not change between validating command and saving events
+	var mu sync.Mutex
+	serialHandler := cqrs.CommandHandlerFunc(func(ctx context.Context, cmd cqrs.Command) error {
+		mu.Lock()
+		defer mu.Unlock()
+		log.Printf("Have command: %+v", cmd)
+		// deadline and cancellation (on shutdown) apply to all queries made while handling command
+		ctx, cancel := context.WithTimeout(ctx, commandTimeout)
+		defer cancel()
+		return handler.HandleCommand(ctx, cmd)
+	})
+
+	log.Println("subscribing to commands")
+	var subscriptions []cqrs.Subscription
+	for _, ID := range users.CommandIDs {
+		sub, err := bus.Subscribe(rootCtx, ID, serialHandler)
+		if err != nil {
+			panic(err)
+		}
+		subscriptions = append(subscriptions, sub)
+	}
+
 	log.Println("waiting for the stop signal")
 	// wait for the stop signal
 	signalCh := make(chan os.Signal, 1)
@@ -80,27 +167,16 @@ func main() {
 
 	sig := <-signalCh
 	log.Printf("got signal: %v, stopping", sig)
-	if err := sub.Drain(); err != nil {
-		log.Printf("ERROR: nats drain failed: %v\n", err)
-	}
-	natsConn.Close()
-}
-
-func respondError(msg *nats.Msg, err error) {
-	if nerr := msg.Respond([]byte(fmt.Sprintf("error:%v", err))); nerr != nil {
-		log.Printf("ERROR: failed to respond to nats message: %v\n", err)
-	}
-}
-
-func respondOk(msg *nats.Msg) {
-	if err := msg.Respond([]byte("ok:ack")); err != nil {
-		log.Printf("ERROR: failed to respond to nats message: %v\n", err)
+	for _, sub := range subscriptions {
+		if err := sub.Unsubscribe(); err != nil {
+			log.Printf("ERROR: nats drain failed: %v\n", err)
+		}
 	}
-}
-
-func publishError(natsConn *nats.Conn, correlationID string, err error) {
-	sub := fmt.Sprintf("event.%v.error", correlationID)
-	if nerr := natsConn.Publish(sub, []byte(err.Error())); nerr != nil {
-		log.Printf("ERROR: failed to publish nats error message with subject %v and error message: %v\n", sub, err)
+	for _, sub := range []*nats.Subscription{scheduleSub, cancelSub} {
+		if err := sub.Drain(); err != nil {
+			log.Printf("ERROR: nats drain failed: %v\n", err)
+		}
 	}
+	cancel()
+	natsConn.Close()
 }
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/nats-io/nats.go"
+
+	"github.com/delicb/toy-cqrs/cqrs"
+	"github.com/delicb/toy-cqrs/cqrs/natsbus"
+	"github.com/delicb/toy-cqrs/users"
+)
+
+const (
+	// outboxBatchSize is maximal number of events relay publishes in single transaction.
+	outboxBatchSize = 100
+	// outboxPollInterval is how often relay checks for unsent events when there is nothing to send.
+	outboxPollInterval = 1 * time.Second
+	// outboxLockID is key of postgres advisory lock held by relay while publishing,
+	// so that only one relay publishes at the time and events are published in order.
+	outboxLockID = 7_340_002
+	// outboxRetention is how long sent events are kept in outbox (e.g. to investigate
+	// what has been published) before relay deletes them.
+	outboxRetention = 24 * time.Hour
+	// outboxPruneInterval is how often relay deletes sent events older than outboxRetention.
+	outboxPruneInterval = 1 * time.Minute
+)
+
+// addToOutbox stores event to be published by outbox relay. It has to be called in
+// the same transaction event is stored in.
+func addToOutbox(ctx context.Context, tx pgx.Tx, ev *cqrs.Event) error {
+	payload, err := users.EventSerializer.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO outbox (position, subject, payload, created_at)
+		VALUES ($1, $2, $3, $4)`,
+		ev.Position, natsbus.EventSubject(ev), payload, time.Now().UTC(),
+	)
+	return err
+}
+
+// outboxRelay publishes events from outbox to nats. Event is marked as sent only after
+// nats server confirms it has received it, so every event is published at least once,
+// but it can be published more than once if relay stops before marking it.
+type outboxRelay struct {
+	db   *pgx.Conn
+	nats *nats.Conn
+}
+
+// NewOutboxRelay returns relay reading outbox using provided connection, which should
+// not be used by anything else, and publishing to provided nats connection.
+func NewOutboxRelay(db *pgx.Conn, natsConn *nats.Conn) *outboxRelay {
+	return &outboxRelay{
+		db:   db,
+		nats: natsConn,
+	}
+}
+
+// Run publishes unsent events until context is done. Sent events are deleted once
+// they are older than outboxRetention.
+func (r *outboxRelay) Run(ctx context.Context) {
+	var lastPrune time.Time
+	for {
+		if time.Since(lastPrune) >= outboxPruneInterval {
+			if err := r.prune(ctx, time.Now().UTC().Add(-outboxRetention)); err != nil && ctx.Err() == nil {
+				log.Printf("ERROR: failed to prune outbox: %v\n", err)
+			}
+			lastPrune = time.Now()
+		}
+
+		sent, err := r.relayBatch(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("ERROR: failed to relay events from outbox: %v\n", err)
+		}
+		// full batch means there are probably more events waiting
+		if err == nil && sent == outboxBatchSize {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(outboxPollInterval):
+		}
+	}
+}
+
+// prune deletes events sent before provided time.
+func (r *outboxRelay) prune(ctx context.Context, before time.Time) error {
+	_, err := r.db.Exec(ctx, `DELETE FROM outbox WHERE sent_at < $1`, before)
+	return err
+}
+
+// relayBatch publishes single batch of unsent events and returns number of published events.
+func (r *outboxRelay) relayBatch(ctx context.Context) (int, error) {
+	sent := 0
+	err := r.db.BeginFunc(ctx, func(tx pgx.Tx) error {
+		var locked bool
+		if err := tx.QueryRow(ctx, `SELECT pg_try_advisory_xact_lock($1)`, outboxLockID).Scan(&locked); err != nil {
+			return err
+		}
+		if !locked {
+			// some other relay is publishing
+			return nil
+		}
+
+		rows, err := tx.Query(ctx, `
+			SELECT position, subject, payload
+			FROM outbox
+			WHERE sent_at IS NULL
+			ORDER BY position
+			LIMIT $1`, outboxBatchSize)
+		if err != nil {
+			return err
+		}
+		var positions []int64
+		for rows.Next() {
+			var position int64
+			var subject string
+			var payload []byte
+			if err := rows.Scan(&position, &subject, &payload); err != nil {
+				rows.Close()
+				return err
+			}
+			if err := r.nats.Publish(subject, payload); err != nil {
+				rows.Close()
+				return err
+			}
+			positions = append(positions, position)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(positions) == 0 {
+			return nil
+		}
+
+		// make sure nats server got everything before marking events as sent
+		if err := r.nats.FlushTimeout(5 * time.Second); err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `UPDATE outbox SET sent_at = $1 WHERE position = ANY($2)`, time.Now().UTC(), positions)
+		if err != nil {
+			return err
+		}
+		sent = len(positions)
+		return nil
+	})
+	return sent, err
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+
+	"github.com/delicb/toy-cqrs/cqrs"
+)
+
+type psqlScheduleStore struct {
+	db *pgxpool.Pool
+}
+
+// NewPsqlScheduleStore implements cqrs.ScheduleStore interface on top of Postgres database.
+// It uses pool, since commands are scheduled and dispatched concurrently.
+func NewPsqlScheduleStore(db *pgxpool.Pool) *psqlScheduleStore {
+	return &psqlScheduleStore{db: db}
+}
+
+func (p *psqlScheduleStore) Add(ctx context.Context, sc *cqrs.ScheduledCommand) error {
+	return p.db.QueryRow(ctx, `
+		INSERT INTO scheduled_commands (command_id, correlation_id, due_at, data, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id`,
+		sc.CommandID, sc.CorrelationID, sc.DueAt, sc.Data, sc.CreatedAt,
+	).Scan(&sc.ID)
+}
+
+// Dispatch locks due commands for the duration of sending them, commands locked by scheduler
+// in another instance are skipped. Sent commands are deleted in the same transaction.
+func (p *psqlScheduleStore) Dispatch(ctx context.Context, now time.Time, limit int, send func(sc *cqrs.ScheduledCommand) error) (int, error) {
+	taken := 0
+	var sendErr error
+	err := p.db.BeginFunc(ctx, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx,
+			`SELECT id, command_id, correlation_id, due_at, data, created_at
+				FROM scheduled_commands
+				WHERE due_at <= $1
+				ORDER BY due_at, id
+				LIMIT $2
+				FOR UPDATE SKIP LOCKED`, now, limit)
+		if err != nil {
+			return err
+		}
+		due := make([]*cqrs.ScheduledCommand, 0)
+		for rows.Next() {
+			sc := &cqrs.ScheduledCommand{}
+			if err := rows.Scan(&sc.ID, &sc.CommandID, &sc.CorrelationID, &sc.DueAt, &sc.Data, &sc.CreatedAt); err != nil {
+				rows.Close()
+				return err
+			}
+			due = append(due, sc)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		taken = len(due)
+
+		var sent []int64
+		for _, sc := range due {
+			if sendErr = send(sc); sendErr != nil {
+				break
+			}
+			sent = append(sent, sc.ID)
+		}
+		if len(sent) == 0 {
+			return nil
+		}
+		// commands sent before failure are deleted anyway, so they are not sent again
+		_, err = tx.Exec(ctx, `DELETE FROM scheduled_commands WHERE id = ANY($1)`, sent)
+		return err
+	})
+	if err != nil {
+		return taken, err
+	}
+	return taken, sendErr
+}
+
+func (p *psqlScheduleStore) Cancel(ctx context.Context, correlationID string) (int, error) {
+	tag, err := p.db.Exec(ctx, `DELETE FROM scheduled_commands WHERE correlation_id = $1`, correlationID)
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
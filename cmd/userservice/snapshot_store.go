@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+
+	"github.com/delicb/toy-cqrs/cqrs"
+)
+
+type psqlSnapshotStorage struct {
+	db *pgxpool.Pool
+}
+
+// NewPsqlSnapshotStore implements cqrs.SnapshotStore interface on top of Postgres database.
+func NewPsqlSnapshotStore(db *pgxpool.Pool) *psqlSnapshotStorage {
+	return &psqlSnapshotStorage{db: db}
+}
+
+func (p *psqlSnapshotStorage) Load(ctx context.Context, aggregateID string) (*cqrs.Snapshot, error) {
+	s := &cqrs.Snapshot{}
+	err := p.db.QueryRow(ctx,
+		`SELECT aggregate_id, aggregate_type, version, schema_version, created_at, data
+			FROM snapshots
+			WHERE aggregate_id = $1`, aggregateID,
+	).Scan(&s.AggregateID, &s.AggregateType, &s.Version, &s.SchemaVersion, &s.CreatedAt, &s.Data)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (p *psqlSnapshotStorage) Save(ctx context.Context, s *cqrs.Snapshot) error {
+	// only the latest snapshot is kept, never replace newer one with older one
+	_, err := p.db.Exec(ctx, `
+		INSERT INTO snapshots
+			(aggregate_id, aggregate_type, version, schema_version, created_at, data)
+		VALUES
+			($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (aggregate_id) DO UPDATE SET
+			aggregate_type = excluded.aggregate_type,
+			version = excluded.version,
+			schema_version = excluded.schema_version,
+			created_at = excluded.created_at,
+			data = excluded.data
+		WHERE snapshots.version <= excluded.version`,
+		s.AggregateID, s.AggregateType, s.Version, s.SchemaVersion, s.CreatedAt, s.Data,
+	)
+	return err
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/nats-io/nats.go"
+
+	"github.com/delicb/toy-cqrs/cqrs"
+	"github.com/delicb/toy-cqrs/cqrs/filestore"
+	"github.com/delicb/toy-cqrs/cqrs/natsbus"
+	"github.com/delicb/toy-cqrs/cqrs/pgstore"
+	"github.com/delicb/toy-cqrs/cqrs/sqlitestore"
+	"github.com/delicb/toy-cqrs/users"
+)
+
+// eventStore is event store that lets userservice observe saved events.
+type eventStore interface {
+	cqrs.EventStore
+	AddAfterSaveHook(h cqrs.EventHook)
+}
+
+// storage groups all stores used by userservice.
+type storage struct {
+	events      eventStore
+	snapshots   cqrs.SnapshotStore
+	idempotency cqrs.IdempotencyStore
+	schedule    cqrs.ScheduleStore
+	close       func() error
+}
+
+// newStorage returns stores selected by EVENT_STORE environment variable:
+//   - postgres (default) keeps everything in database at DATABASE_URL, events are
+//     published to nats by outbox relay
+//   - file keeps events in append-only log in EVENT_STORE_DIR, flushed to disk according
+//     to EVENT_STORE_SYNC (always, interval or never), and everything else in memory.
+//     Events are published to nats once they are saved, so they are not published if nats
+//     is unavailable at the time.
+//   - sqlite keeps events in SQLite database in file SQLITE_PATH, which denormalizer and api
+//     can use as well, everything else is kept in memory and events are published like with file.
+func newStorage(ctx context.Context, natsConn *nats.Conn) (*storage, error) {
+	switch kind := os.Getenv("EVENT_STORE"); kind {
+	case "", "postgres":
+		return newPsqlStorage(ctx, natsConn)
+	case "file":
+		return newFileStorage(natsConn)
+	case "sqlite":
+		return newSqliteStorage(natsConn)
+	default:
+		return nil, fmt.Errorf("unknown EVENT_STORE: %v", kind)
+	}
+}
+
+func newPsqlStorage(ctx context.Context, natsConn *nats.Conn) (*storage, error) {
+	// all stores share a pool, since commands are handled, scheduled and sent concurrently
+	pool, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return nil, err
+	}
+	store := pgstore.NewEventStore(pool, users.EventSerializer, pgstore.Options{})
+	if err := store.Migrate(ctx); err != nil {
+		return nil, err
+	}
+	// event is published by outbox relay only if it is actually stored
+	store.AddBeforeCommitHook(addToOutbox)
+	// command is remembered as handled only if its events are actually stored
+	store.AddBeforeCommitHook(completeOutcome)
+
+	// outbox relay publishes stored events to nats, it needs its own connection,
+	// since it holds a lock for the duration of publishing
+	relayConn, err := pgx.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return nil, err
+	}
+	go NewOutboxRelay(relayConn, natsConn).Run(ctx)
+
+	return &storage{
+		events:      store,
+		snapshots:   NewPsqlSnapshotStore(pool),
+		idempotency: NewPsqlIdempotencyStore(pool),
+		schedule:    NewPsqlScheduleStore(pool),
+		close: func() error {
+			pool.Close()
+			return nil
+		},
+	}, nil
+}
+
+func newFileStorage(natsConn *nats.Conn) (*storage, error) {
+	dir := os.Getenv("EVENT_STORE_DIR")
+	if dir == "" {
+		return nil, fmt.Errorf("EVENT_STORE_DIR is required for file event store")
+	}
+	opts := filestore.Options{Sync: filestore.SyncAlways}
+	if policy := os.Getenv("EVENT_STORE_SYNC"); policy != "" {
+		var err error
+		if opts.Sync, err = filestore.ParseSyncPolicy(policy); err != nil {
+			return nil, err
+		}
+	}
+	store, err := filestore.Open(dir, users.EventSerializer, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	store.AddAfterSaveHook(publishHook(natsConn))
+
+	return &storage{
+		events:      store,
+		snapshots:   cqrs.NewInMemorySnapshotStore(),
+		idempotency: cqrs.NewInMemoryIdempotencyStore(),
+		schedule:    cqrs.NewInMemoryScheduleStore(),
+		close:       store.Close,
+	}, nil
+}
+
+func newSqliteStorage(natsConn *nats.Conn) (*storage, error) {
+	path := os.Getenv("SQLITE_PATH")
+	if path == "" {
+		return nil, fmt.Errorf("SQLITE_PATH is required for sqlite event store")
+	}
+	db, err := sqlitestore.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	store := sqlitestore.NewEventStore(db, users.EventSerializer)
+	store.AddAfterSaveHook(publishHook(natsConn))
+
+	return &storage{
+		events:      store,
+		snapshots:   cqrs.NewInMemorySnapshotStore(),
+		idempotency: cqrs.NewInMemoryIdempotencyStore(),
+		schedule:    cqrs.NewInMemoryScheduleStore(),
+		close:       db.Close,
+	}, nil
+}
+
+// publishHook returns hook that publishes saved events to nats, for stores without outbox.
+func publishHook(natsConn *nats.Conn) cqrs.EventHook {
+	events := natsbus.NewEventBus(natsConn, users.EventSerializer)
+	return func(ev *cqrs.Event) {
+		if err := events.Publish(context.Background(), ev); err != nil {
+			log.Printf("ERROR: failed to publish event %v (%v): %v\n", ev.EventID, ev.Position, err)
+		}
+	}
+}
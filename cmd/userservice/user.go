@@ -1,7 +1,7 @@
 package main
 
 import (
-	"log"
+	"encoding/json"
 
 	"github.com/google/uuid"
 
@@ -11,68 +11,93 @@ import (
 
 // User is main domain entity for this service.
 type User struct {
-	cqrs.Root
+	cqrs.TypedRoot
 
 	Email     string
 	Password  string
 	IsEnabled bool
 }
 
-func (u *User) Apply(new bool, ev *cqrs.Event) error {
-	switch d := ev.Data.(type) {
-	case *users.UserCreated:
-		log.Println("applying user created command")
-		u.ID = ev.AggregateID
-		u.Email = d.Email
-		u.Password = d.Password
-		u.IsEnabled = d.IsEnabled
-	case *users.UserEmailChanged:
-		u.Email = d.NewEmail
-	case *users.UserPasswordChanged:
-		u.Password = d.NewPassword
-	case *users.UserEnabled:
-		u.IsEnabled = true
-	case *users.UserDisabled:
-		u.IsEnabled = false
-	default:
-		return ErrUnknownEvent(ev.Data)
-	}
+// NewUser returns empty user, with appliers for all user events and handlers for all user commands.
+func NewUser() *User {
+	u := &User{}
 
-	// do this at the end, in order not to save unknown event
-	if new {
-		u.Changes = append(u.Changes, ev)
-	}
-	return nil
-}
+	cqrs.On(&u.TypedRoot, u.applyCreated)
+	cqrs.On(&u.TypedRoot, func(_ *cqrs.Event, d *users.UserEmailChanged) { u.Email = d.NewEmail })
+	cqrs.On(&u.TypedRoot, func(_ *cqrs.Event, d *users.UserPasswordChanged) { u.Password = d.NewPassword })
+	cqrs.On(&u.TypedRoot, func(_ *cqrs.Event, _ *users.UserEnabled) { u.IsEnabled = true })
+	cqrs.On(&u.TypedRoot, func(_ *cqrs.Event, _ *users.UserDisabled) { u.IsEnabled = false })
 
-func (u *User) HandleCommand(cmd cqrs.Command) error {
-	log.Printf("handling command: %T\n", cmd)
-	switch c := cmd.(type) {
-	case *users.CreateUser:
-		newUserID := uuid.NewString()
-		ev := cqrs.NewEvent(users.UserCreatedID, cmd, &users.UserCreated{
-			ID:        newUserID,
-			Email:     c.Email,
-			Password:  c.Password,
-			IsEnabled: false,
-		})
-		ev.AggregateID = newUserID
-		return u.Apply(true, ev)
-	case *users.ChangeUserEmail:
-		return u.Apply(true, cqrs.NewEvent(users.EmailChangedID, cmd, &users.UserEmailChanged{
+	cqrs.Handle(&u.TypedRoot, u.create)
+	cqrs.Handle(&u.TypedRoot, func(c *users.ChangeUserEmail) error {
+		return u.Apply(true, cqrs.NewEvent(users.EmailChangedID, c, &users.UserEmailChanged{
 			NewEmail: c.Email,
 			OldEmail: u.Email,
 		}))
-	case *users.ChangeUserPassword:
-		return u.Apply(true, cqrs.NewEvent(users.PasswordChangedID, cmd, &users.UserPasswordChanged{
+	})
+	cqrs.Handle(&u.TypedRoot, func(c *users.ChangeUserPassword) error {
+		return u.Apply(true, cqrs.NewEvent(users.PasswordChangedID, c, &users.UserPasswordChanged{
 			NewPassword: c.Password,
 			OldPassword: u.Password,
 		}))
-	case *users.EnableUser:
-		return u.Apply(true, cqrs.NewEvent(users.EnabledID, cmd, &users.UserEnabled{}))
-	case *users.DisableUser:
-		return u.Apply(true, cqrs.NewEvent(users.DisabledID, cmd, &users.UserDisabled{}))
-	default:
-		return ErrUnknownCommand(cmd)
+	})
+	cqrs.Handle(&u.TypedRoot, func(c *users.EnableUser) error {
+		return u.Apply(true, cqrs.NewEvent(users.EnabledID, c, &users.UserEnabled{}))
+	})
+	cqrs.Handle(&u.TypedRoot, func(c *users.DisableUser) error {
+		return u.Apply(true, cqrs.NewEvent(users.DisabledID, c, &users.UserDisabled{}))
+	})
+
+	return u
+}
+
+func (u *User) applyCreated(ev *cqrs.Event, d *users.UserCreated) {
+	u.ID = ev.AggregateID
+	u.Email = d.Email
+	u.Password = d.Password
+	u.IsEnabled = d.IsEnabled
+}
+
+func (u *User) create(c *users.CreateUser) error {
+	newUserID := uuid.NewString()
+	ev := cqrs.NewEvent(users.UserCreatedID, c, &users.UserCreated{
+		ID:        newUserID,
+		Email:     c.Email,
+		Password:  c.Password,
+		IsEnabled: false,
+	})
+	ev.AggregateID = newUserID
+	return u.Apply(true, ev)
+}
+
+// userSnapshot is serialized state of a user, see User.MarshalSnapshot.
+type userSnapshot struct {
+	ID        string `json:"id"`
+	Email     string `json:"email"`
+	Password  string `json:"password"`
+	IsEnabled bool   `json:"is_enabled"`
+}
+
+// SnapshotSchemaVersion should be incremented on every change of userSnapshot.
+func (u *User) SnapshotSchemaVersion() int { return 1 }
+
+func (u *User) MarshalSnapshot() ([]byte, error) {
+	return json.Marshal(&userSnapshot{
+		ID:        u.ID,
+		Email:     u.Email,
+		Password:  u.Password,
+		IsEnabled: u.IsEnabled,
+	})
+}
+
+func (u *User) UnmarshalSnapshot(data []byte) error {
+	s := &userSnapshot{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return err
 	}
+	u.ID = s.ID
+	u.Email = s.Email
+	u.Password = s.Password
+	u.IsEnabled = s.IsEnabled
+	return nil
 }
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/delicb/toy-cqrs/cqrs"
+	"github.com/delicb/toy-cqrs/cqrs/cqrstest"
+	"github.com/delicb/toy-cqrs/users"
+)
+
+const testUserID = "7d0f5c39-2c36-4a8e-9d8a-1f7a6f0b7a51"
+
+func newUserFixture(t *testing.T) *cqrstest.Fixture {
+	return cqrstest.NewFixture(t, "user", func() cqrs.AggregateRoot { return NewUser() })
+}
+
+func userCreated() *cqrs.Event {
+	return cqrstest.NewEvent(users.UserCreatedID, testUserID, &users.UserCreated{
+		ID:       testUserID,
+		Email:    "old@example.com",
+		Password: "bcrypt-old",
+	})
+}
+
+func TestCreateUser(t *testing.T) {
+	newUserFixture(t).
+		IgnoreDataFields("ID").
+		When(&users.CreateUser{
+			BaseCommand: cqrs.BaseCommand{CorrelationID: "c1"},
+			Email:       "new@example.com",
+			Password:    "bcrypt-new",
+		}).
+		Then(&cqrs.Event{
+			EventID:       users.UserCreatedID,
+			AggregateType: "user",
+			CorrelationID: "c1",
+			Version:       1,
+			Data:          &users.UserCreated{Email: "new@example.com", Password: "bcrypt-new"},
+		})
+}
+
+func TestCreateUserPasswordNotHashed(t *testing.T) {
+	newUserFixture(t).
+		When(&users.CreateUser{Email: "new@example.com", Password: "plain"}).
+		ThenError(errors.New("password not hashed"))
+}
+
+func TestCreateExistingUser(t *testing.T) {
+	newUserFixture(t).
+		Given(userCreated()).
+		When(&users.CreateUser{Email: "new@example.com", Password: "bcrypt-new"}).
+		ThenError(errors.New("user ID should not be set for create user command"))
+}
+
+func TestChangeUserEmail(t *testing.T) {
+	newUserFixture(t).
+		Given(userCreated()).
+		When(&users.ChangeUserEmail{Email: "new@example.com"}).
+		Then(cqrstest.NewEvent(users.EmailChangedID, testUserID, &users.UserEmailChanged{
+			NewEmail: "new@example.com",
+			OldEmail: "old@example.com",
+		}))
+}
+
+func TestChangeUserEmailTwice(t *testing.T) {
+	newUserFixture(t).
+		Given(
+			userCreated(),
+			cqrstest.NewEvent(users.EmailChangedID, testUserID, &users.UserEmailChanged{
+				NewEmail: "middle@example.com",
+				OldEmail: "old@example.com",
+			}),
+		).
+		When(&users.ChangeUserEmail{Email: "new@example.com"}).
+		Then(&cqrs.Event{
+			EventID:     users.EmailChangedID,
+			AggregateID: testUserID,
+			Version:     3,
+			Data:        &users.UserEmailChanged{NewEmail: "new@example.com", OldEmail: "middle@example.com"},
+		})
+}
+
+func TestChangeUserPassword(t *testing.T) {
+	newUserFixture(t).
+		Given(userCreated()).
+		When(&users.ChangeUserPassword{Password: "bcrypt-new"}).
+		Then(cqrstest.NewEvent(users.PasswordChangedID, testUserID, &users.UserPasswordChanged{
+			NewPassword: "bcrypt-new",
+			OldPassword: "bcrypt-old",
+		}))
+}
+
+func TestChangeUserPasswordNotHashed(t *testing.T) {
+	newUserFixture(t).
+		Given(userCreated()).
+		When(&users.ChangeUserPassword{Password: "plain"}).
+		ThenError(errors.New("password not hashed"))
+}
+
+func TestEnableUser(t *testing.T) {
+	newUserFixture(t).
+		Given(userCreated()).
+		When(&users.EnableUser{}).
+		Then(cqrstest.NewEvent(users.EnabledID, testUserID, &users.UserEnabled{}))
+}
+
+func TestDisableUser(t *testing.T) {
+	newUserFixture(t).
+		Given(userCreated(), cqrstest.NewEvent(users.EnabledID, testUserID, &users.UserEnabled{})).
+		When(&users.DisableUser{}).
+		Then(cqrstest.NewEvent(users.DisabledID, testUserID, &users.UserDisabled{}))
+}
+
+func TestUnknownCommand(t *testing.T) {
+	newUserFixture(t).
+		Given(userCreated()).
+		When(&cqrs.BaseCommand{}).
+		ThenError(cqrs.ErrUnknownCommand)
+}
+
+func TestUserAppliesAllEvents(t *testing.T) {
+	registry, ok := users.EventSerializer.(cqrs.EventDataRegistry)
+	if !ok {
+		t.Fatal("users.EventSerializer can not list registered events")
+	}
+	if err := NewUser().CheckAppliers(registry); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientOverInProcessBus(t *testing.T) {
+	store := cqrs.NewInMemoryEventStore()
+	repo := cqrs.NewSimpleRepository(store)
+	repo.RegisterCtor("user", func() cqrs.AggregateRoot { return NewUser() })
+	bus := cqrs.NewInProcessCommandBus()
+	// without denormalizer, commands are processed once their events are stored
+	store.AddAfterSaveHook(func(ev *cqrs.Event) {
+		_ = bus.ReportSuccess(ev.CorrelationID, []byte(ev.AggregateID))
+	})
+	for _, ID := range users.CommandIDs {
+		_, err := bus.Subscribe(context.Background(), ID, cqrs.NewSimpleHandler(repo))
+		require.NoError(t, err)
+	}
+	client := users.NewBusClient(bus)
+
+	userID, err := client.Create("new@example.com", "bcrypt-new")
+	require.NoError(t, err)
+	require.NotEmpty(t, userID)
+	require.NoError(t, client.Enable(userID))
+
+	root, err := repo.Load(context.Background(), "user", userID)
+	require.NoError(t, err)
+	assert.True(t, root.(*User).IsEnabled)
+
+	_, err = client.DisableAt(userID, time.Now())
+	assert.ErrorIs(t, err, users.ErrSchedulingUnavailable)
+}
@@ -1,26 +1,33 @@
 package main
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/delicb/toy-cqrs/cqrs"
 	"github.com/delicb/toy-cqrs/users"
 )
 
+// eventsByIDLoader is implemented by event stores that can load only events with given IDs,
+// validator uses it to load only events affecting emails.
+type eventsByIDLoader interface {
+	LoadByEventID(ctx context.Context, eventIDs ...cqrs.EventID) ([]*cqrs.Event, error)
+}
+
 type validator struct {
-	db         *psqlEventStorage
+	db         cqrs.EventReader
 	emailState map[string]struct{}
 }
 
-func NewValidator(db *psqlEventStorage) (*validator, error) {
+func NewValidator(ctx context.Context, db cqrs.EventReader) (*validator, error) {
 	v := &validator{
 		db:         db,
 		emailState: make(map[string]struct{}),
 	}
-	return v, v.init()
+	return v, v.init(ctx)
 }
 
-func (v *validator) Validate(cmd cqrs.Command) error {
+func (v *validator) Validate(_ context.Context, cmd cqrs.Command) error {
 	switch c := cmd.(type) {
 	case *users.CreateUser:
 		if _, ok := v.emailState[c.Email]; ok {
@@ -34,8 +41,18 @@ func (v *validator) Validate(cmd cqrs.Command) error {
 	return nil
 }
 
-func (v *validator) init() error {
-	emailEvents, err := v.db.LoadEmailEvents()
+func (v *validator) init(ctx context.Context) error {
+	loader, ok := v.db.(eventsByIDLoader)
+	if !ok {
+		// go through all events, UpdateEmailState ignores ones not affecting emails
+		it := cqrs.NewEventIterator(ctx, v.db, 0, 1000)
+		for it.Next() {
+			v.UpdateEmailState(it.Event())
+		}
+		return it.Err()
+	}
+
+	emailEvents, err := loader.LoadByEventID(ctx, users.UserCreatedID, users.EmailChangedID)
 	if err != nil {
 		return err
 	}
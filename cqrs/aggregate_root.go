@@ -21,15 +21,26 @@ type AggregateRoot interface {
 	// HandleCommand), and it will be false if aggregate root is being reconstructed by past,
 	// already stored events.
 	Apply(new bool, ev *Event) error
+
+	// GetVersion returns version of the last event stored for this aggregate root,
+	// or zero if aggregate root has not been stored yet.
+	GetVersion() int
+
+	// SetVersion updates version of the last stored event. Repository calls it
+	// after loading aggregate root from past events and after saving new ones.
+	SetVersion(version int)
 }
 
 // Root is partial implementation of AggregateRoot, made to make implementation of
 // concrete aggregate roots easier by embedding.
 type Root struct {
 	ID      string
+	Version int
 	Changes []*Event
 }
 
-func (r *Root) GetID() string        { return r.ID }
-func (r *Root) GetChanges() []*Event { return r.Changes }
-func (r *Root) ClearChanges()        { r.Changes = []*Event{} }
+func (r *Root) GetID() string          { return r.ID }
+func (r *Root) GetChanges() []*Event   { return r.Changes }
+func (r *Root) ClearChanges()          { r.Changes = []*Event{} }
+func (r *Root) GetVersion() int        { return r.Version }
+func (r *Root) SetVersion(version int) { r.Version = version }
@@ -35,6 +35,21 @@ type Command interface {
 	// It is used to tie all events that were created from the same command, but also to identify
 	// messages passed between systems that apply to the same command.
 	GetCorrelationID() string
+
+	// GetIdempotencyKey returns key identifying this command among repeated deliveries of it.
+	// Commands with the same key are handled only once. Empty key disables this check.
+	GetIdempotencyKey() string
+
+	// GetCausationID returns identifier of a message (e.g. an event) that caused this command,
+	// or empty string if command was not caused by another message.
+	GetCausationID() string
+
+	// GetActor returns identifier of whoever issued this command (e.g. user or service).
+	GetActor() string
+
+	// GetMetadata returns custom headers (e.g. trace context) to be attached to events
+	// generated by this command.
+	GetMetadata() map[string]string
 }
 
 // BaseCommand is utility, implementing common parts for each command.
@@ -48,6 +63,12 @@ type BaseCommand struct {
 	AggregateID   string    `json:"aggregate_id" mapstructure:"aggregate_id"`
 	AggregateType string    `json:"aggregate_type" mapstructure:"aggregate_type"`
 	CorrelationID string    `json:"correlation_id" mapstructure:"correlation_id"`
+	// IdempotencyKey is optional, if not set, CorrelationID is used instead.
+	IdempotencyKey string `json:"idempotency_key,omitempty" mapstructure:"idempotency_key"`
+
+	CausationID string            `json:"causation_id,omitempty" mapstructure:"causation_id"`
+	Actor       string            `json:"actor,omitempty" mapstructure:"actor"`
+	Metadata    map[string]string `json:"metadata,omitempty" mapstructure:"metadata"`
 }
 
 func (c *BaseCommand) GetCommandID() CommandID        { return c.CommandID }
@@ -55,6 +76,19 @@ func (c *BaseCommand) Validate(_ AggregateRoot) error { return nil }
 func (c *BaseCommand) GetAggregateID() string         { return c.AggregateID }
 func (c *BaseCommand) GetAggregateType() string       { return c.AggregateType }
 func (c *BaseCommand) GetCorrelationID() string       { return c.CorrelationID }
+func (c *BaseCommand) GetCausationID() string         { return c.CausationID }
+func (c *BaseCommand) GetActor() string               { return c.Actor }
+func (c *BaseCommand) GetMetadata() map[string]string { return c.Metadata }
+
+// GetBaseCommand returns embedded BaseCommand, allowing serializers to populate it.
+func (c *BaseCommand) GetBaseCommand() *BaseCommand { return c }
+
+func (c *BaseCommand) GetIdempotencyKey() string {
+	if c.IdempotencyKey != "" {
+		return c.IdempotencyKey
+	}
+	return c.CorrelationID
+}
 
 // CommandSerializer defines operations needed for command instance marshal and unmarshal operations.
 type CommandSerializer interface {
@@ -77,6 +111,8 @@ func (s *commandJSONSerializer) RegisterCommandCtor(ID CommandID, ctor func() Co
 	s.ctors[ID] = ctor
 }
 
+func (s *commandJSONSerializer) ContentType() string { return ContentTypeJSON }
+
 func (s *commandJSONSerializer) Marshal(cmd Command) ([]byte, error) {
 	return json.Marshal(cmd)
 }
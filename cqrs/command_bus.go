@@ -0,0 +1,178 @@
+package cqrs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// CommandBus delivers commands to whoever handles them, possibly in another service.
+type CommandBus interface {
+	// Send delivers command to its handler and returns once command is accepted for handling,
+	// without waiting for it to be handled.
+	Send(ctx context.Context, cmd Command) error
+
+	// SendAndWait sends command and waits until outcome of its processing is reported by
+	// CommandReporter, returning payload of successful outcome (e.g. ID of created aggregate).
+	// Waiting is limited by provided context.
+	SendAndWait(ctx context.Context, cmd Command) ([]byte, error)
+
+	// Subscribe routes commands with provided ID to handler. Commands are handled with context
+	// derived from provided one, carrying command (see ContextWithCommand). Errors returned by
+	// handler are reported as outcome of the command.
+	Subscribe(ctx context.Context, ID CommandID, h CommandHandler) (Subscription, error)
+}
+
+// CommandReporter reports outcome of processing a command to whoever waits for it in
+// CommandBus.SendAndWait. Commands are identified by their correlation ID.
+// Command is not necessarily processed once handler returns, e.g. clients usually wait
+// for read models to be updated, so success is reported by whoever updates them.
+type CommandReporter interface {
+	ReportSuccess(correlationID string, payload []byte) error
+	ReportFailure(correlationID string, err error) error
+}
+
+// Subscription is handle for stopping delivery of commands to handler registered with CommandBus.Subscribe.
+type Subscription interface {
+	Unsubscribe() error
+}
+
+// ErrNoCorrelationID is returned by CommandBus.SendAndWait for commands without correlation ID,
+// since outcome of such commands can not be recognized.
+var ErrNoCorrelationID = errors.New("command has no correlation ID")
+
+type commandOutcome struct {
+	payload []byte
+	err     error
+}
+
+type inProcessSubscription struct {
+	bus     *inProcessCommandBus
+	ID      CommandID
+	ctx     context.Context
+	handler CommandHandler
+}
+
+func (s *inProcessSubscription) Unsubscribe() error {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	if s.bus.subscriptions[s.ID] == s {
+		delete(s.bus.subscriptions, s.ID)
+	}
+	return nil
+}
+
+// inProcessCommandBus delivers commands to handlers in the same process, without a broker.
+type inProcessCommandBus struct {
+	mu            sync.Mutex
+	subscriptions map[CommandID]*inProcessSubscription
+	waiters       map[string]chan commandOutcome
+	wg            sync.WaitGroup
+}
+
+// Send starts handling of command in background and returns immediately. If there is no
+// handler subscribed to command, error matching ErrUnknownCommand is returned.
+func (b *inProcessCommandBus) Send(_ context.Context, cmd Command) error {
+	b.mu.Lock()
+	sub, ok := b.subscriptions[cmd.GetCommandID()]
+	b.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: no handler for %v", ErrUnknownCommand, cmd.GetCommandID())
+	}
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		if err := sub.handler.HandleCommand(ContextWithCommand(sub.ctx, cmd), cmd); err != nil {
+			_ = b.ReportFailure(cmd.GetCorrelationID(), err)
+		}
+	}()
+	return nil
+}
+
+func (b *inProcessCommandBus) SendAndWait(ctx context.Context, cmd Command) ([]byte, error) {
+	correlationID := cmd.GetCorrelationID()
+	if correlationID == "" {
+		return nil, ErrNoCorrelationID
+	}
+	ch := make(chan commandOutcome, 1)
+	b.mu.Lock()
+	b.waiters[correlationID] = ch
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.waiters, correlationID)
+		b.mu.Unlock()
+	}()
+
+	if err := b.Send(ctx, cmd); err != nil {
+		return nil, err
+	}
+	select {
+	case outcome := <-ch:
+		return outcome.payload, outcome.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Subscribe registers handler for command with provided ID, replacing previous one, if any.
+func (b *inProcessCommandBus) Subscribe(ctx context.Context, ID CommandID, h CommandHandler) (Subscription, error) {
+	sub := &inProcessSubscription{
+		bus:     b,
+		ID:      ID,
+		ctx:     ctx,
+		handler: h,
+	}
+	b.mu.Lock()
+	b.subscriptions[ID] = sub
+	b.mu.Unlock()
+	return sub, nil
+}
+
+func (b *inProcessCommandBus) ReportSuccess(correlationID string, payload []byte) error {
+	b.report(correlationID, commandOutcome{payload: payload})
+	return nil
+}
+
+func (b *inProcessCommandBus) ReportFailure(correlationID string, err error) error {
+	b.report(correlationID, commandOutcome{err: err})
+	return nil
+}
+
+// report passes outcome to whoever waits for command with provided correlation ID, if anyone.
+// Only the first outcome of a command is delivered.
+func (b *inProcessCommandBus) report(correlationID string, outcome commandOutcome) {
+	b.mu.Lock()
+	ch, ok := b.waiters[correlationID]
+	b.mu.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case ch <- outcome:
+	default:
+	}
+}
+
+// Wait blocks until all commands sent so far are handled.
+func (b *inProcessCommandBus) Wait() {
+	b.wg.Wait()
+}
+
+// NewInProcessCommandBus returns CommandBus implementation that handles commands in the same
+// process, e.g. in tests or single-binary deployments. Success of commands is not reported
+// automatically, usually it is reported once events are stored, e.g. from event store hook:
+//   store.AddAfterSaveHook(func(ev *cqrs.Event) {
+//     bus.ReportSuccess(ev.CorrelationID, []byte(ev.AggregateID))
+//   })
+func NewInProcessCommandBus() *inProcessCommandBus {
+	return &inProcessCommandBus{
+		subscriptions: make(map[CommandID]*inProcessSubscription),
+		waiters:       make(map[string]chan commandOutcome),
+	}
+}
+
+var _ CommandBus = &inProcessCommandBus{}
+var _ CommandReporter = &inProcessCommandBus{}
@@ -0,0 +1,56 @@
+package cqrs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInProcessCommandBusSendAndWait(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	bus := NewInProcessCommandBus()
+	_, err := bus.Subscribe(ctx, sendReminderID, CommandHandlerFunc(func(ctx context.Context, cmd Command) error {
+		fromCtx, ok := CommandFromContext(ctx)
+		require.True(t, ok)
+		assert.Equal(t, cmd, fromCtx)
+		return bus.ReportSuccess(cmd.GetCorrelationID(), []byte(cmd.GetAggregateID()))
+	}))
+	require.NoError(t, err)
+
+	payload, err := bus.SendAndWait(ctx, newReminderCommand("corr-1"))
+	require.NoError(t, err)
+	assert.Equal(t, "account-1", string(payload))
+}
+
+func TestInProcessCommandBusReportsHandlerFailure(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	bus := NewInProcessCommandBus()
+	failure := errors.New("reminder failed")
+	_, err := bus.Subscribe(ctx, sendReminderID, CommandHandlerFunc(func(context.Context, Command) error {
+		return failure
+	}))
+	require.NoError(t, err)
+
+	_, err = bus.SendAndWait(ctx, newReminderCommand("corr-1"))
+	assert.Equal(t, failure, err)
+}
+
+func TestInProcessCommandBusUnknownCommand(t *testing.T) {
+	bus := NewInProcessCommandBus()
+	sub, err := bus.Subscribe(context.Background(), sendReminderID, CommandHandlerFunc(func(context.Context, Command) error {
+		return nil
+	}))
+	require.NoError(t, err)
+	require.NoError(t, sub.Unsubscribe())
+
+	err = bus.Send(context.Background(), newReminderCommand("corr-1"))
+	assert.ErrorIs(t, err, ErrUnknownCommand)
+	_, err = bus.SendAndWait(context.Background(), newReminderCommand(""))
+	assert.ErrorIs(t, err, ErrNoCorrelationID)
+}
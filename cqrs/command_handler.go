@@ -1,8 +1,10 @@
 package cqrs
 
 import (
+	"context"
 	"errors"
-	"log"
+	"math/rand"
+	"time"
 
 	"go.uber.org/multierr"
 )
@@ -10,19 +12,84 @@ import (
 // CommandHandler can process and execute a command.
 type CommandHandler interface {
 	// HandleCommand processes provided command or dies (returns error) trying.
-	HandleCommand(cmd Command) error
+	// Context carries deadline, cancellation and request scoped values down to the stores.
+	HandleCommand(ctx context.Context, cmd Command) error
 }
 
 type CommandValidator interface {
-	Validate(Command) error
+	Validate(ctx context.Context, cmd Command) error
+}
+
+// BackoffFunc returns duration to wait before provided retry attempt (1 for the first retry).
+type BackoffFunc func(retry int) time.Duration
+
+// ConstantBackoff returns BackoffFunc that always waits for the same duration.
+func ConstantBackoff(d time.Duration) BackoffFunc {
+	return func(_ int) time.Duration { return d }
+}
+
+// ExponentialBackoff returns BackoffFunc that doubles waiting time with each retry,
+// starting with base and never exceeding max. Random jitter of up to half of the
+// duration is added, so that competing handlers do not retry in lockstep.
+func ExponentialBackoff(base, max time.Duration) BackoffFunc {
+	return func(retry int) time.Duration {
+		d := base
+		for i := 1; i < retry && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			d = max
+		}
+		if d <= 0 {
+			return 0
+		}
+		return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	}
+}
+
+// RetryPolicy describes how command handler behaves when saving changes fails
+// because aggregate root has been modified concurrently.
+type RetryPolicy struct {
+	// MaxAttempts is total number of attempts to handle a command, including the first one.
+	// Values lower than 2 disable retries.
+	MaxAttempts int
+
+	// Backoff determines how long to wait before each retry. If nil, retry is immediate.
+	Backoff BackoffFunc
 }
 
 type simpleCommandHandler struct {
 	repo       Repository
 	validators []CommandValidator
+	retry      RetryPolicy
+}
+
+func (h *simpleCommandHandler) HandleCommand(ctx context.Context, cmd Command) error {
+	return retryOnConflict(ctx, h.retry, func() error { return h.handle(ctx, cmd) })
 }
 
-func (h *simpleCommandHandler) HandleCommand(cmd Command) error {
+// retryOnConflict calls handle until it succeeds, fails with error other than concurrency
+// conflict, or policy runs out of attempts.
+func retryOnConflict(ctx context.Context, p RetryPolicy, handle func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := handle()
+		if err == nil || !errors.Is(err, ErrConcurrencyConflict) || attempt >= p.MaxAttempts {
+			return err
+		}
+
+		// someone else changed aggregate root in the meantime, whole command is executed
+		// again on fresh state, since it might not be valid anymore
+		if p.Backoff != nil {
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(p.Backoff(attempt)):
+			}
+		}
+	}
+}
+
+func (h *simpleCommandHandler) handle(ctx context.Context, cmd Command) error {
 	// overview of an algorithm
 	// - recreate user from previous events
 	// - validate command
@@ -31,45 +98,47 @@ func (h *simpleCommandHandler) HandleCommand(cmd Command) error {
 	// - publish new events
 
 	// recreate user from past events
-	root, err := h.repo.Load(cmd.GetAggregateType(), cmd.GetAggregateID())
+	root, err := h.repo.Load(ctx, cmd.GetAggregateType(), cmd.GetAggregateID())
 	if err != nil {
 		return err
 	}
-	log.Printf("have root: %+v\n", root)
 
 	// validate command
 	if err := cmd.Validate(root); err != nil {
-		return err
+		return NewCommandRejectedError(err)
 	}
 
 	// call 3rd party validators to allow them to report errors
 	var validationError error
 	for _, validator := range h.validators {
-		validationError = multierr.Combine(validationError, validator.Validate(cmd))
+		validationError = multierr.Combine(validationError, validator.Validate(ctx, cmd))
 	}
 	if validationError != nil {
-		return validationError
+		return NewCommandRejectedError(validationError)
 	}
 
 	// generate and apply new events
 	if err := root.HandleCommand(cmd); err != nil {
-		return err
+		return NewCommandRejectedError(err)
 	}
 
-	log.Println("handled command")
-
 	// just a sanity check
 	if root.GetID() == "" {
 		return errors.New("aggregate root ID not populated and it should have been by this point")
 	}
 
-	log.Println("have root id:", root.GetID())
-
 	// save, publish happens automatically with our postgres implementation
-	return h.repo.Save(root)
+	return h.repo.Save(ctx, root)
+}
+
+// SetRetryPolicy configures retries of commands that failed due to concurrency conflict.
+// By default, commands are not retried. See also RetryMiddleware.
+func (h *simpleCommandHandler) SetRetryPolicy(p RetryPolicy) {
+	h.retry = p
 }
 
 // AddValidator add new implementation of CommandValidator to be called during command handling.
+// See also ValidationMiddleware, which validates commands before they reach handler.
 func (h *simpleCommandHandler) AddValidator(v CommandValidator) {
 	h.validators = append(h.validators, v)
 }
@@ -0,0 +1,20 @@
+package cqrs
+
+import (
+	"context"
+)
+
+type commandContextKey struct{}
+
+// ContextWithCommand returns copy of provided context carrying command being handled, so that
+// code further down the call chain (e.g. stores, loggers) can access its correlation ID,
+// actor and metadata (e.g. trace context) without it being passed explicitly.
+func ContextWithCommand(ctx context.Context, cmd Command) context.Context {
+	return context.WithValue(ctx, commandContextKey{}, cmd)
+}
+
+// CommandFromContext returns command stored in context by ContextWithCommand, if any.
+func CommandFromContext(ctx context.Context) (Command, bool) {
+	cmd, ok := ctx.Value(commandContextKey{}).(Command)
+	return cmd, ok
+}
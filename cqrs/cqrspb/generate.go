@@ -0,0 +1,4 @@
+// Package cqrspb contains protobuf messages used by protobuf serializers in cqrs package.
+package cqrspb
+
+//go:generate protoc -I ../.. --go_out=../.. --go_opt=paths=source_relative cqrs/cqrspb/cqrs.proto
@@ -0,0 +1,213 @@
+// Package cqrstest provides Given/When/Then fixture for testing aggregate roots and command handlers, e.g.
+//
+//	cqrstest.NewFixture(t, "user", func() cqrs.AggregateRoot { return NewUser() }).
+//		Given(cqrstest.NewEvent(users.UserCreatedID, userID, &users.UserCreated{...})).
+//		When(&users.EnableUser{}).
+//		Then(cqrstest.NewEvent(users.EnabledID, userID, &users.UserEnabled{}))
+package cqrstest
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/delicb/toy-cqrs/cqrs"
+)
+
+// Fixture runs command against aggregate root rebuilt from given past events, using in-memory
+// event store and simple command handler, and compares events it produced with expected ones.
+type Fixture struct {
+	t           testing.TB
+	typ         string
+	ctor        cqrs.AggregateRootCtor
+	middlewares []cqrs.Middleware
+	ignored     map[string]struct{}
+
+	given []*cqrs.Event
+	cmd   cqrs.Command
+}
+
+// NewFixture returns fixture for aggregate roots of provided type, created with provided constructor.
+func NewFixture(t testing.TB, typ string, ctor cqrs.AggregateRootCtor) *Fixture {
+	return &Fixture{
+		t:       t,
+		typ:     typ,
+		ctor:    ctor,
+		ignored: make(map[string]struct{}),
+	}
+}
+
+// NewEvent returns event with provided ID and data, for provided aggregate root.
+// Remaining fields are populated by fixture where needed.
+func NewEvent(ID cqrs.EventID, aggregateID string, data interface{}) *cqrs.Event {
+	return &cqrs.Event{
+		EventID:     ID,
+		AggregateID: aggregateID,
+		Data:        data,
+	}
+}
+
+// Use wraps command handler with provided middlewares, e.g. to test validation.
+func (f *Fixture) Use(middlewares ...cqrs.Middleware) *Fixture {
+	f.middlewares = append(f.middlewares, middlewares...)
+	return f
+}
+
+// IgnoreDataFields excludes fields of event data with provided names from comparison,
+// e.g. IDs generated by aggregate root.
+func (f *Fixture) IgnoreDataFields(names ...string) *Fixture {
+	for _, name := range names {
+		f.ignored[name] = struct{}{}
+	}
+	return f
+}
+
+// Given sets events that happened before command is handled. Versions and aggregate
+// type are populated, if not set.
+func (f *Fixture) Given(events ...*cqrs.Event) *Fixture {
+	f.given = append(f.given, events...)
+	return f
+}
+
+// When sets command to handle. If command embeds cqrs.BaseCommand, its aggregate type
+// and ID are populated from fixture and the last given event, if not set.
+func (f *Fixture) When(cmd cqrs.Command) *Fixture {
+	f.cmd = cmd
+	return f
+}
+
+// Then handles command and checks that it succeeded and produced expected events, in order.
+// Only EventID and Data are always compared, other fields only if they are set in expected
+// event, except CreatedAt, Position and SchemaVersion, which are never compared.
+func (f *Fixture) Then(expected ...*cqrs.Event) {
+	f.t.Helper()
+	actual, err := f.run()
+	require.NoError(f.t, err, "handling command %T", f.cmd)
+	require.Len(f.t, actual, len(expected), "number of produced events")
+	for i := range expected {
+		assert.Equal(f.t, f.normalize(expected[i], expected[i]), f.normalize(actual[i], expected[i]), "event %d", i)
+	}
+}
+
+// ThenError handles command and checks that it failed with expected error, either matching
+// it with errors.Is or having the same message, and that no events were stored.
+func (f *Fixture) ThenError(expected error) {
+	f.t.Helper()
+	actual, err := f.run()
+	require.Error(f.t, err, "handling command %T", f.cmd)
+	if !errors.Is(err, expected) {
+		assert.EqualError(f.t, err, expected.Error())
+	}
+	assert.Empty(f.t, actual, "events stored by failed command")
+}
+
+// run stores given events, handles command and returns newly stored events.
+func (f *Fixture) run() ([]*cqrs.Event, error) {
+	f.t.Helper()
+	require.NotNil(f.t, f.cmd, "no command, When has not been called")
+	ctx := context.Background()
+
+	store := cqrs.NewInMemoryEventStore()
+	versions := make(map[string]int)
+	for _, ev := range f.given {
+		versions[ev.AggregateID]++
+		if ev.Version == 0 {
+			ev.Version = versions[ev.AggregateID]
+		}
+		if ev.AggregateType == "" {
+			ev.AggregateType = f.typ
+		}
+		if ev.CreatedAt.IsZero() {
+			ev.CreatedAt = time.Now().UTC()
+		}
+	}
+	require.NoError(f.t, store.Save(ctx, f.given), "storing given events")
+
+	var produced []*cqrs.Event
+	store.AddAfterSaveHook(func(ev *cqrs.Event) {
+		produced = append(produced, ev)
+	})
+
+	if base, ok := f.cmd.(interface{ GetBaseCommand() *cqrs.BaseCommand }); ok {
+		b := base.GetBaseCommand()
+		if b.AggregateType == "" {
+			b.AggregateType = f.typ
+		}
+		if b.AggregateID == "" && len(f.given) > 0 {
+			b.AggregateID = f.given[len(f.given)-1].AggregateID
+		}
+	}
+
+	repo := cqrs.NewSimpleRepository(store)
+	repo.RegisterCtor(f.typ, f.ctor)
+	handler := cqrs.Chain(cqrs.NewSimpleHandler(repo), f.middlewares...)
+	err := handler.HandleCommand(ctx, f.cmd)
+	return produced, err
+}
+
+// normalize returns copy of event with fields that should not be compared to expected event zeroed.
+func (f *Fixture) normalize(ev, expected *cqrs.Event) *cqrs.Event {
+	n := &cqrs.Event{
+		EventID: ev.EventID,
+		Data:    f.normalizeData(ev.Data),
+	}
+	if expected.AggregateID != "" {
+		n.AggregateID = ev.AggregateID
+	}
+	if expected.AggregateType != "" {
+		n.AggregateType = ev.AggregateType
+	}
+	if expected.CorrelationID != "" {
+		n.CorrelationID = ev.CorrelationID
+	}
+	if expected.Version != 0 {
+		n.Version = ev.Version
+	}
+	if expected.CommandID != "" {
+		n.CommandID = ev.CommandID
+	}
+	if expected.CausationID != "" {
+		n.CausationID = ev.CausationID
+	}
+	if expected.Actor != "" {
+		n.Actor = ev.Actor
+	}
+	if expected.Metadata != nil {
+		n.Metadata = ev.Metadata
+	}
+	return n
+}
+
+// normalizeData returns copy of event data with ignored fields zeroed.
+func (f *Fixture) normalizeData(data interface{}) interface{} {
+	if len(f.ignored) == 0 || data == nil {
+		return data
+	}
+	v := reflect.ValueOf(data)
+	isPtr := v.Kind() == reflect.Ptr
+	if isPtr {
+		if v.IsNil() {
+			return data
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return data
+	}
+	c := reflect.New(v.Type()).Elem()
+	c.Set(v)
+	for name := range f.ignored {
+		if field := c.FieldByName(name); field.IsValid() && field.CanSet() {
+			field.Set(reflect.Zero(field.Type()))
+		}
+	}
+	if isPtr {
+		return c.Addr().Interface()
+	}
+	return c.Interface()
+}
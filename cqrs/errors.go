@@ -0,0 +1,77 @@
+package cqrs
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrConcurrencyConflict is returned (wrapped in ConcurrencyConflictError) by event
+// stores when events being saved do not continue from the last stored version of
+// an aggregate, meaning someone else has modified it in the meantime.
+// Check for it with errors.Is.
+var ErrConcurrencyConflict = errors.New("concurrency conflict")
+
+// ConcurrencyConflictError describes which aggregate has been modified concurrently.
+type ConcurrencyConflictError struct {
+	AggregateID     string
+	ExpectedVersion int
+	ActualVersion   int
+}
+
+func (e *ConcurrencyConflictError) Error() string {
+	return fmt.Sprintf("%v: aggregate %v expected at version %d, but it is at version %d",
+		ErrConcurrencyConflict, e.AggregateID, e.ExpectedVersion, e.ActualVersion)
+}
+
+func (e *ConcurrencyConflictError) Is(target error) bool {
+	return target == ErrConcurrencyConflict
+}
+
+// NewConcurrencyConflictError returns error indicating that aggregate with provided ID
+// was expected to be at one version, but it is at another.
+func NewConcurrencyConflictError(aggregateID string, expected, actual int) error {
+	return &ConcurrencyConflictError{
+		AggregateID:     aggregateID,
+		ExpectedVersion: expected,
+		ActualVersion:   actual,
+	}
+}
+
+var (
+	// ErrUnknownEvent is returned when aggregate root does not know how to apply an event.
+	ErrUnknownEvent = errors.New("unknown event")
+
+	// ErrUnknownCommand is returned when aggregate root does not know how to handle a command.
+	ErrUnknownCommand = errors.New("unknown command")
+)
+
+// ErrCommandRejected is returned (wrapped in CommandRejectedError) by command handlers when
+// command is not valid or aggregate root refuses it, meaning that sending the same command
+// again would end the same way. Check for it with errors.Is.
+var ErrCommandRejected = errors.New("command rejected")
+
+// CommandRejectedError wraps validation or domain error command has been rejected with.
+type CommandRejectedError struct {
+	Err error
+}
+
+func (e *CommandRejectedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *CommandRejectedError) Unwrap() error {
+	return e.Err
+}
+
+func (e *CommandRejectedError) Is(target error) bool {
+	return target == ErrCommandRejected
+}
+
+// NewCommandRejectedError marks provided error as reason command has been rejected for.
+// It returns nil if provided error is nil.
+func NewCommandRejectedError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &CommandRejectedError{Err: err}
+}
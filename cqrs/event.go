@@ -16,18 +16,41 @@ type EventID string
 
 // Event is base event, containing all the needed information for something
 // that had happened in the past.
+// Version is sequence number of an event within its aggregate, starting from 1.
+// It is assigned by repository when aggregate root is saved and is used by event
+// stores to detect concurrent modifications of the same aggregate.
+// Position is global, monotonically increasing, sequence number of an event across
+// all aggregates in an event store, assigned by event store when event is saved.
+// CommandID, CausationID, Actor and Metadata are copied from command that caused the event
+// and describe where event came from (see NewEvent).
+// SchemaVersion is version of the structure of Data, see eventJSONSerializer.RegisterUpcaster.
 type Event struct {
 	EventID       EventID     `json:"event_id" mapstructure:"event_id"`
 	AggregateID   string      `json:"aggregate_id" mapstructure:"aggregate_id"`
 	AggregateType string      `json:"aggregate_type" mapstructure:"aggregate_type"`
 	CreatedAt     time.Time   `json:"created_at" mapstructure:"created_at"`
 	CorrelationID string      `json:"correlation_id" mapstructure:"correlation_id"`
+	Version       int         `json:"version" mapstructure:"version"`
+	Position      int64       `json:"position" mapstructure:"position"`
+	SchemaVersion int         `json:"schema_version" mapstructure:"schema_version"`
 	Data          interface{} `json:"data" mapstructure:"data"`
+
+	CommandID   CommandID         `json:"command_id,omitempty" mapstructure:"command_id"`
+	CausationID string            `json:"causation_id,omitempty" mapstructure:"causation_id"`
+	Actor       string            `json:"actor,omitempty" mapstructure:"actor"`
+	Metadata    map[string]string `json:"metadata,omitempty" mapstructure:"metadata"`
 }
 
 // NewEvent returns instance of an event with provided ID and data, and populates
 // relevant fields from provided command.
 func NewEvent(ID EventID, cmd Command, data interface{}) *Event {
+	var metadata map[string]string
+	if cmdMetadata := cmd.GetMetadata(); len(cmdMetadata) > 0 {
+		metadata = make(map[string]string, len(cmdMetadata))
+		for k, v := range cmdMetadata {
+			metadata[k] = v
+		}
+	}
 	return &Event{
 		EventID:       ID,
 		AggregateID:   cmd.GetAggregateID(),
@@ -35,25 +58,59 @@ func NewEvent(ID EventID, cmd Command, data interface{}) *Event {
 		CreatedAt:     time.Now().UTC(),
 		CorrelationID: cmd.GetCorrelationID(),
 		Data:          data,
+		CommandID:     cmd.GetCommandID(),
+		CausationID:   cmd.GetCausationID(),
+		Actor:         cmd.GetActor(),
+		Metadata:      metadata,
 	}
 }
 
+// eventMetadata is part of an event describing where it came from, serialized separately
+// from event data, see EventSerializer.MarshalMetadata.
+type eventMetadata struct {
+	CommandID   CommandID         `json:"command_id,omitempty"`
+	CausationID string            `json:"causation_id,omitempty"`
+	Actor       string            `json:"actor,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+}
+
 // EventSerializer defines operations needed for event instance marshal and unmarshal operations.
 type EventSerializer interface {
 	Marshal(*Event) ([]byte, error)
 	Unmarshal([]byte) (*Event, error)
+
+	// MarshalData serializes data of provided event, in the structure of current schema version.
 	MarshalData(*Event) ([]byte, error)
-	UnmarshalData(EventID, []byte) (interface{}, error)
+
+	// UnmarshalData deserializes event data stored with provided schema version, upgrading
+	// it to current schema version first, if needed.
+	UnmarshalData(ID EventID, schemaVersion int, data []byte) (interface{}, error)
+
+	// SchemaVersion returns current schema version of data of provided event.
+	SchemaVersion(EventID) int
+
+	// MarshalMetadata serializes CommandID, CausationID, Actor and Metadata of provided event,
+	// for event stores that keep them separately from event data.
+	MarshalMetadata(*Event) ([]byte, error)
+
+	// UnmarshalMetadata populates CommandID, CausationID, Actor and Metadata of provided
+	// event from data produced by MarshalMetadata.
+	UnmarshalMetadata([]byte, *Event) error
 }
 
+// Upcaster transforms raw event data from one schema version to the next one.
+type Upcaster func(data map[string]interface{}) (map[string]interface{}, error)
+
 type eventJSONSerializer struct {
-	ctors map[EventID]func() interface{}
+	ctors     map[EventID]func() interface{}
+	upcasters map[EventID]map[int]Upcaster
 }
 
 // NewEventJSONSerializer returns instance of EventSerializer that is using JSON as underlying format.
 func NewEventJSONSerializer() *eventJSONSerializer {
 	return &eventJSONSerializer{
-		ctors: make(map[EventID]func() interface{}),
+		ctors:     make(map[EventID]func() interface{}),
+		upcasters: make(map[EventID]map[int]Upcaster),
 	}
 }
 
@@ -61,8 +118,71 @@ func (e *eventJSONSerializer) RegisterDataCtor(ID EventID, ctor func() interface
 	e.ctors[ID] = ctor
 }
 
+func (e *eventJSONSerializer) RegisteredData() map[EventID]interface{} {
+	return registeredData(e.ctors)
+}
+
+// registeredData returns data created by each of provided constructors.
+func registeredData(ctors map[EventID]func() interface{}) map[EventID]interface{} {
+	data := make(map[EventID]interface{}, len(ctors))
+	for ID, ctor := range ctors {
+		data[ID] = ctor()
+	}
+	return data
+}
+
+// RegisterUpcaster registers function transforming data of provided event from schema version
+// fromVersion to fromVersion+1. Every event starts at schema version 1, and its current schema
+// version is one above the highest registered upcaster. Upcasters have to form a chain without
+// gaps, e.g. to move structure to version 3, upcasters from versions 1 and 2 are needed.
+// Struct registered with RegisterDataCtor always describes current schema version.
+func (e *eventJSONSerializer) RegisterUpcaster(ID EventID, fromVersion int, u Upcaster) {
+	if e.upcasters[ID] == nil {
+		e.upcasters[ID] = make(map[int]Upcaster)
+	}
+	e.upcasters[ID][fromVersion] = u
+}
+
+func (e *eventJSONSerializer) ContentType() string { return ContentTypeJSON }
+
+func (e *eventJSONSerializer) SchemaVersion(ID EventID) int {
+	version := 1
+	for from := range e.upcasters[ID] {
+		if from+1 > version {
+			version = from + 1
+		}
+	}
+	return version
+}
+
+// upcast transforms raw data of provided event from provided schema version to current one.
+func (e *eventJSONSerializer) upcast(ID EventID, schemaVersion int, data map[string]interface{}) (map[string]interface{}, error) {
+	if schemaVersion < 1 {
+		// stored before events had schema versions
+		schemaVersion = 1
+	}
+	current := e.SchemaVersion(ID)
+	if schemaVersion > current {
+		return nil, fmt.Errorf("event %v has schema version %d, newer than known version %d", ID, schemaVersion, current)
+	}
+	for v := schemaVersion; v < current; v++ {
+		u, ok := e.upcasters[ID][v]
+		if !ok {
+			return nil, fmt.Errorf("missing upcaster for event %v from schema version %d", ID, v)
+		}
+		var err error
+		if data, err = u(data); err != nil {
+			return nil, fmt.Errorf("upcasting event %v from schema version %d: %w", ID, v, err)
+		}
+	}
+	return data, nil
+}
+
 func (e *eventJSONSerializer) Marshal(ev *Event) ([]byte, error) {
-	return json.Marshal(ev)
+	// data is serialized from current structure, so it is always in current schema version
+	versioned := *ev
+	versioned.SchemaVersion = e.SchemaVersion(ev.EventID)
+	return json.Marshal(&versioned)
 }
 
 func (e *eventJSONSerializer) Unmarshal(rawData []byte) (*Event, error) {
@@ -88,6 +208,19 @@ func (e *eventJSONSerializer) Unmarshal(rawData []byte) (*Event, error) {
 		Data: ctor(),
 	}
 
+	var schemaVersion int
+	if v, ok := raw["schema_version"].(float64); ok {
+		schemaVersion = int(v)
+	}
+	if data, ok := raw["data"].(map[string]interface{}); ok {
+		upcasted, err := e.upcast(eventID, schemaVersion, data)
+		if err != nil {
+			return nil, err
+		}
+		raw["data"] = upcasted
+	}
+	raw["schema_version"] = e.SchemaVersion(eventID)
+
 	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
 		Metadata:   nil,
 		DecodeHook: toTimeHookFunc(),
@@ -103,15 +236,57 @@ func (e *eventJSONSerializer) MarshalData(ev *Event) ([]byte, error) {
 	return json.Marshal(ev.Data)
 }
 
-func (e *eventJSONSerializer) UnmarshalData(eventID EventID, data []byte) (interface{}, error) {
+func (e *eventJSONSerializer) UnmarshalData(eventID EventID, schemaVersion int, data []byte) (interface{}, error) {
 	ctor, ok := e.ctors[eventID]
 	if !ok {
 		return nil, fmt.Errorf("unknown event ID: %v", eventID)
 	}
+
+	if schemaVersion < 1 {
+		schemaVersion = 1
+	}
+	if schemaVersion != e.SchemaVersion(eventID) {
+		raw := make(map[string]interface{})
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return nil, err
+		}
+		upcasted, err := e.upcast(eventID, schemaVersion, raw)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = json.Marshal(upcasted); err != nil {
+			return nil, err
+		}
+	}
+
 	eventData := ctor()
 	return eventData, json.Unmarshal(data, &eventData)
 }
 
+func (e *eventJSONSerializer) MarshalMetadata(ev *Event) ([]byte, error) {
+	return json.Marshal(&eventMetadata{
+		CommandID:   ev.CommandID,
+		CausationID: ev.CausationID,
+		Actor:       ev.Actor,
+		Headers:     ev.Metadata,
+	})
+}
+
+func (e *eventJSONSerializer) UnmarshalMetadata(data []byte, ev *Event) error {
+	if len(data) == 0 {
+		return nil
+	}
+	metadata := &eventMetadata{}
+	if err := json.Unmarshal(data, metadata); err != nil {
+		return err
+	}
+	ev.CommandID = metadata.CommandID
+	ev.CausationID = metadata.CausationID
+	ev.Actor = metadata.Actor
+	ev.Metadata = metadata.Headers
+	return nil
+}
+
 func toTimeHookFunc() mapstructure.DecodeHookFunc {
 	return func(f reflect.Type, t reflect.Type, data interface{}) (interface{}, error) {
 		if t != reflect.TypeOf(time.Time{}) {
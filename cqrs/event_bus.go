@@ -0,0 +1,139 @@
+package cqrs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// EventFilter selects events delivered to subscriber of EventBus. Empty fields match any
+// value, so zero filter (see AllEvents) matches every event.
+type EventFilter struct {
+	EventID       EventID
+	AggregateType string
+}
+
+// Matches returns true if provided event is selected by filter.
+func (f EventFilter) Matches(ev *Event) bool {
+	return (f.EventID == "" || f.EventID == ev.EventID) &&
+		(f.AggregateType == "" || f.AggregateType == ev.AggregateType)
+}
+
+// ByEventID returns filter selecting events with provided ID.
+func ByEventID(ID EventID) EventFilter { return EventFilter{EventID: ID} }
+
+// ByAggregateType returns filter selecting events of all aggregates of provided type.
+func ByAggregateType(aggregateType string) EventFilter {
+	return EventFilter{AggregateType: aggregateType}
+}
+
+// AllEvents returns filter selecting every event.
+func AllEvents() EventFilter { return EventFilter{} }
+
+// EventBus delivers published events to subscribers, decoded with EventSerializer.
+// Unlike catch-up subscriptions (see NewCatchUpSubscription), delivery starts when subscriber
+// subscribes and events published while subscriber is not running are not delivered, so it is
+// suitable for notifications and statistics, but not for maintaining read models.
+type EventBus interface {
+	// Publish delivers event to all subscribers whose filter matches it.
+	Publish(ctx context.Context, ev *Event) error
+
+	// Subscribe delivers events matching filter to handler, until subscription is unsubscribed
+	// or provided context is done. Context is also passed to handler. Errors returned by handler
+	// are logged, they do not stop delivery.
+	Subscribe(ctx context.Context, filter EventFilter, h EventHandler) (Subscription, error)
+}
+
+// SubscribeTyped subscribes to events with provided ID, passing their data to handler as type D
+// (e.g. *users.UserCreated). Events with data of another type are reported as error.
+func SubscribeTyped[D any](ctx context.Context, bus EventBus, ID EventID, h func(ctx context.Context, ev *Event, data D) error) (Subscription, error) {
+	return bus.Subscribe(ctx, ByEventID(ID), func(ctx context.Context, ev *Event) error {
+		data, ok := ev.Data.(D)
+		if !ok {
+			return fmt.Errorf("event %v has data of type %T, expected %v", ev.EventID, ev.Data, typeOf[D]())
+		}
+		return h(ctx, ev, data)
+	})
+}
+
+// HandleEvent passes event to handler if filter matches it, logging error handler returns.
+// It is intended for EventBus implementations.
+func HandleEvent(ctx context.Context, filter EventFilter, h EventHandler, ev *Event) {
+	if !filter.Matches(ev) {
+		return
+	}
+	if err := h(ctx, ev); err != nil {
+		log.Printf("ERROR: event subscriber failed to handle event %v (%v): %v\n", ev.EventID, ev.AggregateID, err)
+	}
+}
+
+type inMemorySubscription struct {
+	bus     *inMemoryEventBus
+	ctx     context.Context
+	filter  EventFilter
+	handler EventHandler
+}
+
+func (s *inMemorySubscription) Unsubscribe() error {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	delete(s.bus.subscriptions, s)
+	return nil
+}
+
+// inMemoryEventBus delivers events to subscribers in the same process.
+type inMemoryEventBus struct {
+	mu            sync.Mutex
+	subscriptions map[*inMemorySubscription]struct{}
+}
+
+// Publish delivers event to matching subscribers synchronously, before it returns.
+func (b *inMemoryEventBus) Publish(_ context.Context, ev *Event) error {
+	b.mu.Lock()
+	subs := make([]*inMemorySubscription, 0, len(b.subscriptions))
+	for sub := range b.subscriptions {
+		subs = append(subs, sub)
+	}
+	b.mu.Unlock()
+
+	for _, sub := range subs {
+		if sub.ctx.Err() != nil {
+			_ = sub.Unsubscribe()
+			continue
+		}
+		HandleEvent(sub.ctx, sub.filter, sub.handler, ev)
+	}
+	return nil
+}
+
+func (b *inMemoryEventBus) Subscribe(ctx context.Context, filter EventFilter, h EventHandler) (Subscription, error) {
+	sub := &inMemorySubscription{
+		bus:     b,
+		ctx:     ctx,
+		filter:  filter,
+		handler: h,
+	}
+	b.mu.Lock()
+	b.subscriptions[sub] = struct{}{}
+	b.mu.Unlock()
+	return sub, nil
+}
+
+// PublishHook returns EventHook publishing every event to the bus, e.g. to be registered
+// with AddAfterSaveHook of event store, so that saved events are published.
+func (b *inMemoryEventBus) PublishHook() EventHook {
+	return func(ev *Event) {
+		_ = b.Publish(context.Background(), ev)
+	}
+}
+
+// NewInMemoryEventBus returns EventBus implementation delivering events to subscribers in the
+// same process. Since events are not serialized, subscribers get the same instance that was published.
+func NewInMemoryEventBus() *inMemoryEventBus {
+	return &inMemoryEventBus{
+		subscriptions: make(map[*inMemorySubscription]struct{}),
+	}
+}
+
+var _ EventBus = &inMemoryEventBus{}
@@ -0,0 +1,54 @@
+package cqrs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInMemoryEventBusFilters(t *testing.T) {
+	ctx := context.Background()
+	bus := NewInMemoryEventBus()
+	received := make(map[string][]EventID)
+	subscribe := func(name string, filter EventFilter) Subscription {
+		sub, err := bus.Subscribe(ctx, filter, func(_ context.Context, ev *Event) error {
+			received[name] = append(received[name], ev.EventID)
+			return nil
+		})
+		require.NoError(t, err)
+		return sub
+	}
+	subscribe("all", AllEvents())
+	subscribe("opened", ByEventID(accountOpenedID))
+	subscribe("accounts", ByAggregateType("account"))
+	unsubscribed := subscribe("unsubscribed", AllEvents())
+	require.NoError(t, unsubscribed.Unsubscribe())
+
+	require.NoError(t, bus.Publish(ctx, &Event{EventID: accountOpenedID, AggregateType: "account"}))
+	require.NoError(t, bus.Publish(ctx, &Event{EventID: accountClosedID, AggregateType: "account"}))
+	require.NoError(t, bus.Publish(ctx, &Event{EventID: "user.created", AggregateType: "user"}))
+
+	assert.Equal(t, []EventID{accountOpenedID, accountClosedID, "user.created"}, received["all"])
+	assert.Equal(t, []EventID{accountOpenedID}, received["opened"])
+	assert.Equal(t, []EventID{accountOpenedID, accountClosedID}, received["accounts"])
+	assert.Empty(t, received["unsubscribed"])
+}
+
+func TestSubscribeTyped(t *testing.T) {
+	ctx := context.Background()
+	bus := NewInMemoryEventBus()
+	var addresses []string
+	_, err := SubscribeTyped(ctx, bus, accountEmailChangedID, func(_ context.Context, _ *Event, data *accountEmailChanged) error {
+		addresses = append(addresses, data.Address)
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, bus.Publish(ctx, &Event{EventID: accountEmailChangedID, Data: &accountEmailChanged{Address: "new@example.com"}}))
+	// data of unexpected type is reported, not passed to handler
+	require.NoError(t, bus.Publish(ctx, &Event{EventID: accountEmailChangedID, Data: "new@example.com"}))
+
+	assert.Equal(t, []string{"new@example.com"}, addresses)
+}
@@ -1,47 +1,316 @@
 package cqrs
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
 // EventStore is description of persistence for events.
 type EventStore interface {
-	// Load returns all events for provided aggregate root id.
-	Load(aggregateID string) ([]*Event, error)
+	// Load returns all events for provided aggregate root id, ordered by version.
+	Load(ctx context.Context, aggregateID string) ([]*Event, error)
+
+	// LoadAfter returns events for provided aggregate root id with version greater
+	// than provided one, ordered by version.
+	LoadAfter(ctx context.Context, aggregateID string, version int) ([]*Event, error)
 
-	// Save persist all provided events.
-	Save([]*Event) error
+	// ReadAll returns up to limit events of all aggregates with position greater than
+	// provided one, ordered by position. Limit lower than 1 means no limit.
+	// Positions start from 1, so reading from position 0 returns events from the beginning.
+	ReadAll(ctx context.Context, fromPosition int64, limit int) ([]*Event, error)
+
+	// Save persist all provided events and assigns them positions.
+	// Versions of provided events have to continue from the last stored version
+	// of their aggregate without gaps, otherwise nothing is saved and error
+	// matching ErrConcurrencyConflict is returned.
+	Save(ctx context.Context, events []*Event) error
 }
 
 // EventHook is a function to be called during event lifecycle
 type EventHook func(*Event)
 
+// ErrEventsDropped is returned (wrapped) by in-memory event store when requested events
+// have been dropped from memory, because store is over capacity (see SetCapacity).
+var ErrEventsDropped = errors.New("events dropped from memory")
+
+// defaultStoreSubscriptionBatchSize is number of events store subscription passes to handler
+// between reading them from the store.
+const defaultStoreSubscriptionBatchSize = 100
+
 // inMemoryStore is simple implementation of storage that does not persist
-// events, but keeps them in memory instead.
+// events, but keeps them in memory instead. It is safe for concurrent use.
 type inMemoryStore struct {
-	state          map[string][]*Event
+	mu sync.RWMutex
+	// state holds retained events of each aggregate, ordered by version
+	state map[string][]*Event
+	// versions holds version of the last event of each aggregate, including dropped events
+	versions map[string]int
+	// all holds retained events of all aggregates, ordered by position
+	all []*Event
+	// dropped is number of events dropped from the beginning of all
+	dropped int64
+	// capacity is maximal number of retained events, 0 means no limit
+	capacity int
+	// saved is closed and replaced every time events are saved, waking up subscriptions
+	saved          chan struct{}
 	afterSaveHooks []EventHook
 }
 
-func (s *inMemoryStore) Load(aggregateID string) ([]*Event, error) {
-	return s.state[aggregateID], nil
+func (s *inMemoryStore) Load(ctx context.Context, aggregateID string) ([]*Event, error) {
+	return s.LoadAfter(ctx, aggregateID, 0)
+}
+
+func (s *inMemoryStore) LoadAfter(_ context.Context, aggregateID string, version int) ([]*Event, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	events := s.state[aggregateID]
+	if version < 0 {
+		version = 0
+	}
+	// versions have no gaps, so index of an event is its distance from the first retained version
+	first := s.versions[aggregateID] - len(events) + 1
+	if version+1 < first {
+		return nil, fmt.Errorf("%w: aggregate %v has events from version %d", ErrEventsDropped, aggregateID, first)
+	}
+	if version >= s.versions[aggregateID] {
+		return nil, nil
+	}
+	return copyEvents(events[version+1-first:]), nil
+}
+
+func (s *inMemoryStore) ReadAll(_ context.Context, fromPosition int64, limit int) ([]*Event, error) {
+	events, _, err := s.readAll(fromPosition, limit)
+	return events, err
 }
 
-func (s *inMemoryStore) Save(events []*Event) error {
+// readAll reads events like ReadAll and also returns channel closed when events are saved next time.
+func (s *inMemoryStore) readAll(fromPosition int64, limit int) ([]*Event, <-chan struct{}, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if fromPosition < 0 {
+		fromPosition = 0
+	}
+	if fromPosition < s.dropped {
+		return nil, nil, fmt.Errorf("%w: events are retained from position %d", ErrEventsDropped, s.dropped+1)
+	}
+	if fromPosition >= s.dropped+int64(len(s.all)) {
+		return nil, s.saved, nil
+	}
+	// positions have no gaps, so index of an event is its distance from the first retained position
+	events := s.all[fromPosition-s.dropped:]
+	if limit > 0 && len(events) > limit {
+		events = events[:limit]
+	}
+	return copyEvents(events), s.saved, nil
+}
+
+func (s *inMemoryStore) Save(_ context.Context, events []*Event) error {
+	s.mu.Lock()
+
+	// check versions of all events before storing any of them, so save is all or nothing
+	versions := make(map[string]int)
 	for _, ev := range events {
+		current, ok := versions[ev.AggregateID]
+		if !ok {
+			current = s.versions[ev.AggregateID]
+		}
+		if ev.Version != current+1 {
+			s.mu.Unlock()
+			return NewConcurrencyConflictError(ev.AggregateID, ev.Version-1, current)
+		}
+		versions[ev.AggregateID] = ev.Version
+	}
+
+	for _, ev := range events {
+		ev.Position = s.dropped + int64(len(s.all)) + 1
+		s.all = append(s.all, ev)
 		s.state[ev.AggregateID] = append(s.state[ev.AggregateID], ev)
-		for _, h := range s.afterSaveHooks {
+		s.versions[ev.AggregateID] = ev.Version
+	}
+	s.evict()
+	close(s.saved)
+	s.saved = make(chan struct{})
+	hooks := s.afterSaveHooks
+	s.mu.Unlock()
+
+	// hooks are called without holding the lock, so they can use the store
+	for _, ev := range events {
+		for _, h := range hooks {
 			h(ev)
 		}
 	}
-
 	return nil
 }
 
+// evict drops the oldest events while there are more than capacity of them. Caller holds the lock.
+func (s *inMemoryStore) evict() {
+	if s.capacity <= 0 || len(s.all) <= s.capacity {
+		return
+	}
+	n := len(s.all) - s.capacity
+	for _, ev := range s.all[:n] {
+		// events are dropped in order of positions, so the oldest event of an aggregate is dropped first
+		s.state[ev.AggregateID] = s.state[ev.AggregateID][1:]
+		if len(s.state[ev.AggregateID]) == 0 {
+			delete(s.state, ev.AggregateID)
+		}
+	}
+	// copy retained events, so that dropped ones can be garbage collected
+	s.all = append(make([]*Event, 0, s.capacity), s.all[n:]...)
+	s.dropped += int64(n)
+}
+
+// SetCapacity sets maximal number of events kept in memory, 0 (default) means no limit.
+// When there are more events, the oldest ones are dropped. Reading dropped events returns
+// error matching ErrEventsDropped, but versions of aggregates are remembered, so concurrency
+// conflicts are still detected for them.
+func (s *inMemoryStore) SetCapacity(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.capacity = n
+	s.evict()
+}
+
 func (s *inMemoryStore) AddAfterSaveHook(h EventHook) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.afterSaveHooks = append(s.afterSaveHooks, h)
 }
 
+type storeSubscription struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
+
+// Unsubscribe stops delivering events, waits for handler to return and returns error
+// that stopped subscription earlier (returned by handler, or ErrEventsDropped), if any.
+func (s *storeSubscription) Unsubscribe() error {
+	s.cancel()
+	<-s.done
+	return s.err
+}
+
+// Subscribe passes events with position greater than provided one to handler, in order of
+// their positions, first ones already stored and then new ones as they are saved, until
+// subscription is unsubscribed, context is done or handler returns an error. Handler is called
+// from a separate goroutine, one event at the time.
+func (s *inMemoryStore) Subscribe(ctx context.Context, fromPosition int64, h EventHandler) (Subscription, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	sub := &storeSubscription{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(sub.done)
+		position := fromPosition
+		for {
+			events, saved, err := s.readAll(position, defaultStoreSubscriptionBatchSize)
+			if err != nil {
+				sub.err = err
+				return
+			}
+			for _, ev := range events {
+				if ctx.Err() != nil {
+					return
+				}
+				if err := h(ctx, ev); err != nil {
+					sub.err = err
+					return
+				}
+				position = ev.Position
+			}
+			if len(events) > 0 {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-saved:
+			}
+		}
+	}()
+	return sub, nil
+}
+
+// copyEvents returns copy of provided slice, so that callers do not share it with the store.
+func copyEvents(events []*Event) []*Event {
+	return append(make([]*Event, 0, len(events)), events...)
+}
+
 // NewInMemoryEventStore returns EventStore implementation that stores events only in memory.
 func NewInMemoryEventStore() *inMemoryStore {
 	return &inMemoryStore{
 		state:          make(map[string][]*Event),
+		versions:       make(map[string]int),
+		all:            make([]*Event, 0),
+		saved:          make(chan struct{}),
 		afterSaveHooks: make([]EventHook, 0),
 	}
 }
+
+// EventIterator reads events of all aggregates from an event store (or any EventReader) in order of their
+// positions, fetching them in batches. Iteration stops once there are no more stored events.
+// Typical usage:
+//
+//	it := NewEventIterator(ctx, store, 0, 100)
+//	for it.Next() {
+//	  ev := it.Event()
+//	}
+//	if err := it.Err(); err != nil {
+//	}
+type EventIterator struct {
+	ctx       context.Context
+	reader    EventReader
+	position  int64
+	batchSize int
+	batch     []*Event
+	current   *Event
+	err       error
+}
+
+// NewEventIterator returns iterator over events with position greater than provided one.
+// Provided context is used for all reads.
+func NewEventIterator(ctx context.Context, reader EventReader, fromPosition int64, batchSize int) *EventIterator {
+	if batchSize < 1 {
+		batchSize = 100
+	}
+	return &EventIterator{
+		ctx:       ctx,
+		reader:    reader,
+		position:  fromPosition,
+		batchSize: batchSize,
+	}
+}
+
+// Next advances iterator to the next event and returns false when there are
+// no more events or reading them failed.
+func (it *EventIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if len(it.batch) == 0 {
+		it.batch, it.err = it.reader.ReadAll(it.ctx, it.position, it.batchSize)
+		if it.err != nil || len(it.batch) == 0 {
+			it.current = nil
+			return false
+		}
+	}
+	it.current, it.batch = it.batch[0], it.batch[1:]
+	it.position = it.current.Position
+	return true
+}
+
+// Event returns current event.
+func (it *EventIterator) Event() *Event { return it.current }
+
+// Position returns position of the current event, or position iteration started from
+// if Next has not been called yet.
+func (it *EventIterator) Position() int64 { return it.position }
+
+// Err returns error that stopped iteration, if any.
+func (it *EventIterator) Err() error { return it.err }
@@ -0,0 +1,100 @@
+package cqrs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func storeEvent(aggregateID string, version int) *Event {
+	return &Event{EventID: accountOpenedID, AggregateID: aggregateID, AggregateType: "account", Version: version}
+}
+
+func TestInMemoryEventStoreConcurrentSaves(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryEventStore()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(aggregateID string) {
+			defer wg.Done()
+			for version := 1; version <= 20; version++ {
+				assert.NoError(t, store.Save(ctx, []*Event{storeEvent(aggregateID, version)}))
+				_, err := store.ReadAll(ctx, 0, 0)
+				assert.NoError(t, err)
+			}
+		}(fmt.Sprintf("account-%d", i))
+	}
+	wg.Wait()
+
+	all, err := store.ReadAll(ctx, 0, 0)
+	require.NoError(t, err)
+	require.Len(t, all, 200)
+	for i, ev := range all {
+		assert.Equal(t, int64(i+1), ev.Position)
+	}
+	events, err := store.Load(ctx, "account-3")
+	require.NoError(t, err)
+	assert.Len(t, events, 20)
+}
+
+func TestInMemoryEventStoreSubscribeFromPosition(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryEventStore()
+	require.NoError(t, store.Save(ctx, []*Event{storeEvent("a", 1), storeEvent("b", 1), storeEvent("a", 2)}))
+
+	received := make(chan int64, 10)
+	sub, err := store.Subscribe(ctx, 1, func(_ context.Context, ev *Event) error {
+		received <- ev.Position
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, store.Save(ctx, []*Event{storeEvent("b", 2)}))
+
+	// already stored events after position 1 are delivered first, then new ones
+	for _, expected := range []int64{2, 3, 4} {
+		select {
+		case position := <-received:
+			assert.Equal(t, expected, position)
+		case <-time.After(time.Second):
+			t.Fatalf("event at position %d not delivered", expected)
+		}
+	}
+	assert.NoError(t, sub.Unsubscribe())
+}
+
+func TestInMemoryEventStoreCapacity(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryEventStore()
+	store.SetCapacity(3)
+	require.NoError(t, store.Save(ctx, []*Event{storeEvent("a", 1), storeEvent("b", 1)}))
+	require.NoError(t, store.Save(ctx, []*Event{storeEvent("a", 2), storeEvent("a", 3)}))
+
+	all, err := store.ReadAll(ctx, 1, 0)
+	require.NoError(t, err)
+	assert.Len(t, all, 3)
+	assert.Equal(t, int64(2), all[0].Position)
+	_, err = store.ReadAll(ctx, 0, 0)
+	assert.ErrorIs(t, err, ErrEventsDropped)
+
+	_, err = store.Load(ctx, "a")
+	assert.ErrorIs(t, err, ErrEventsDropped)
+	events, err := store.LoadAfter(ctx, "a", 1)
+	require.NoError(t, err)
+	assert.Len(t, events, 2)
+
+	// versions of dropped events are still checked
+	err = store.Save(ctx, []*Event{storeEvent("a", 1)})
+	assert.ErrorIs(t, err, ErrConcurrencyConflict)
+
+	// subscription that can not get all events it asked for stops
+	sub, err := store.Subscribe(ctx, 0, func(context.Context, *Event) error { return nil })
+	require.NoError(t, err)
+	assert.ErrorIs(t, sub.Unsubscribe(), ErrEventsDropped)
+}
@@ -0,0 +1,118 @@
+package cqrs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const accountEmailChangedID EventID = "account.email.changed"
+
+// accountEmailChanged is current (v3) structure of an event used to test upcasting.
+type accountEmailChanged struct {
+	Address  string `json:"address"`
+	Verified bool   `json:"verified"`
+}
+
+func newVersionedSerializer() *eventJSONSerializer {
+	s := NewEventJSONSerializer()
+	s.RegisterDataCtor(accountEmailChangedID, func() interface{} { return &accountEmailChanged{} })
+	// v1 -> v2: email renamed to new_email
+	s.RegisterUpcaster(accountEmailChangedID, 1, func(data map[string]interface{}) (map[string]interface{}, error) {
+		data["new_email"] = data["email"]
+		delete(data, "email")
+		return data, nil
+	})
+	// v2 -> v3: new_email renamed to address, verified flag added
+	s.RegisterUpcaster(accountEmailChangedID, 2, func(data map[string]interface{}) (map[string]interface{}, error) {
+		data["address"] = data["new_email"]
+		delete(data, "new_email")
+		data["verified"] = false
+		return data, nil
+	})
+	return s
+}
+
+func TestSchemaVersion(t *testing.T) {
+	s := newVersionedSerializer()
+	assert.Equal(t, 3, s.SchemaVersion(accountEmailChangedID))
+	assert.Equal(t, 1, s.SchemaVersion("unknown"))
+}
+
+func TestUnmarshalDataReplaysHistoricalFixtures(t *testing.T) {
+	raw, err := ioutil.ReadFile("testdata/email_changed_history.json")
+	require.NoError(t, err)
+	var fixtures []struct {
+		Description   string          `json:"description"`
+		SchemaVersion int             `json:"schema_version"`
+		Data          json.RawMessage `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(raw, &fixtures))
+	require.NotEmpty(t, fixtures)
+
+	s := newVersionedSerializer()
+	for _, f := range fixtures {
+		t.Run(f.Description, func(t *testing.T) {
+			data, err := s.UnmarshalData(accountEmailChangedID, f.SchemaVersion, f.Data)
+			require.NoError(t, err)
+			assert.Equal(t, &accountEmailChanged{Address: "john@example.com"}, data)
+		})
+	}
+}
+
+func TestUnmarshalDataTreatsMissingSchemaVersionAsFirst(t *testing.T) {
+	s := newVersionedSerializer()
+	data, err := s.UnmarshalData(accountEmailChangedID, 0, []byte(`{"email": "john@example.com"}`))
+	require.NoError(t, err)
+	assert.Equal(t, &accountEmailChanged{Address: "john@example.com"}, data)
+}
+
+func TestUnmarshalDataRejectsNewerSchemaVersion(t *testing.T) {
+	s := newVersionedSerializer()
+	_, err := s.UnmarshalData(accountEmailChangedID, 4, []byte(`{"address": "john@example.com"}`))
+	assert.Error(t, err)
+}
+
+func TestUnmarshalDataFailsOnMissingUpcaster(t *testing.T) {
+	s := NewEventJSONSerializer()
+	s.RegisterDataCtor(accountEmailChangedID, func() interface{} { return &accountEmailChanged{} })
+	s.RegisterUpcaster(accountEmailChangedID, 2, func(data map[string]interface{}) (map[string]interface{}, error) {
+		return data, nil
+	})
+	_, err := s.UnmarshalData(accountEmailChangedID, 1, []byte(`{"email": "john@example.com"}`))
+	assert.Error(t, err)
+}
+
+func TestUnmarshalUpcastsHistoricalEvent(t *testing.T) {
+	raw, err := ioutil.ReadFile("testdata/email_changed_v1_event.json")
+	require.NoError(t, err)
+
+	s := newVersionedSerializer()
+	ev, err := s.Unmarshal(raw)
+	require.NoError(t, err)
+	assert.Equal(t, accountEmailChangedID, ev.EventID)
+	assert.Equal(t, 2, ev.Version)
+	assert.Equal(t, 3, ev.SchemaVersion)
+	assert.Equal(t, &accountEmailChanged{Address: "john@example.com"}, ev.Data)
+}
+
+func TestMarshalWritesCurrentSchemaVersion(t *testing.T) {
+	s := newVersionedSerializer()
+	ev := &Event{
+		EventID:       accountEmailChangedID,
+		AggregateID:   "8d0a2b8c-8d2e-4f6b-9d36-3f1b8a6e1c11",
+		AggregateType: "account",
+		Data:          &accountEmailChanged{Address: "john@example.com", Verified: true},
+	}
+	raw, err := s.Marshal(ev)
+	require.NoError(t, err)
+
+	decoded, err := s.Unmarshal(raw)
+	require.NoError(t, err)
+	assert.Equal(t, 3, decoded.SchemaVersion)
+	assert.Equal(t, ev.Data, decoded.Data)
+	assert.Equal(t, 0, ev.SchemaVersion, "marshaling should not modify event")
+}
@@ -0,0 +1,603 @@
+// Package filestore implements cqrs.EventStore as append-only log of events on disk,
+// for local development and deployments without a database.
+//
+// Log is split into segments, files named by position of their first event (e.g.
+// 00000000000000000001.log). Each event is stored as a record:
+//
+//	length (4 bytes) | CRC-32C of body (4 bytes) | body
+//	body: flags (1 byte) | length of aggregate ID (2 bytes) | aggregate ID | payload
+//
+// where payload is event serialized by EventSerializer. Events saved together are written at
+// once, and the last of them is marked with commit flag. When store is opened, records after
+// the last committed one (left by a crash in the middle of a write) are truncated, so saving
+// is all or nothing. Damaged record followed by a committed one is not a result of a crash,
+// so it is reported as ErrCorrupted instead. Index of events by aggregate and by position is kept in memory and rebuilt
+// when store is opened.
+package filestore
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/delicb/toy-cqrs/cqrs"
+)
+
+// SyncPolicy determines when written events are flushed to disk (fsync).
+type SyncPolicy int
+
+const (
+	// SyncAlways flushes events before Save returns, so saved events survive power loss.
+	SyncAlways SyncPolicy = iota
+
+	// SyncInterval flushes events in background every Options.SyncInterval, so events
+	// saved within the last interval can be lost on power loss (but not on crash of the process).
+	SyncInterval
+
+	// SyncNever leaves flushing to operating system.
+	SyncNever
+)
+
+// ParseSyncPolicy returns policy with provided name: always, interval or never.
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	switch name {
+	case "always":
+		return SyncAlways, nil
+	case "interval":
+		return SyncInterval, nil
+	case "never":
+		return SyncNever, nil
+	default:
+		return 0, fmt.Errorf("unknown sync policy: %v", name)
+	}
+}
+
+const (
+	// DefaultSegmentSize is size after which new segment is started.
+	DefaultSegmentSize = 64 << 20
+	// DefaultSyncInterval is how often events are flushed with SyncInterval policy.
+	DefaultSyncInterval = 1 * time.Second
+)
+
+// Options configure file store, zero values are replaced with defaults.
+type Options struct {
+	// SegmentSize is size after which new segment is started. Events saved together
+	// are always written to the same segment, so segment can grow above this size.
+	SegmentSize int64
+	Sync        SyncPolicy
+	// SyncInterval is how often events are flushed with SyncInterval policy.
+	SyncInterval time.Duration
+}
+
+// ErrCorrupted is returned when opening store with damaged records that are not
+// the result of interrupted write, i.e. records that are followed by committed ones.
+var ErrCorrupted = errors.New("event log corrupted")
+
+// ErrReadOnly is returned when saving events to store opened with OpenReadOnly.
+var ErrReadOnly = errors.New("event store is read-only")
+
+const (
+	headerSize    = 8
+	flagCommit    = 1
+	segmentSuffix = ".log"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type segment struct {
+	// first is position of the first event in segment.
+	first int64
+	file  *os.File
+	size  int64
+}
+
+// location is where event is stored, offset is offset of its record in segment.
+type location struct {
+	segment *segment
+	offset  int64
+	size    int64
+}
+
+type store struct {
+	dir        string
+	serializer cqrs.EventSerializer
+	opts       Options
+	readOnly   bool
+
+	mu             sync.RWMutex
+	segments       []*segment
+	positions      []location
+	aggregates     map[string][]int64
+	afterSaveHooks []cqrs.EventHook
+	dirty          bool
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Open opens event store in provided directory, creating it if it does not exist, and
+// recovers from interrupted writes. Events are serialized with provided serializer.
+// Store has to be closed with Close.
+func Open(dir string, serializer cqrs.EventSerializer, opts Options) (*store, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = DefaultSegmentSize
+	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = DefaultSyncInterval
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &store{
+		dir:            dir,
+		serializer:     serializer,
+		opts:           opts,
+		aggregates:     make(map[string][]int64),
+		afterSaveHooks: make([]cqrs.EventHook, 0),
+		stop:           make(chan struct{}),
+	}
+	if err := s.recover(); err != nil {
+		s.closeSegments()
+		return nil, err
+	}
+	if opts.Sync == SyncInterval {
+		s.wg.Add(1)
+		go s.syncPeriodically()
+	}
+	return s, nil
+}
+
+// OpenReadOnly opens existing event store in provided directory for reading. Nothing in the
+// directory is created or changed, uncommitted records at the end of the log are skipped
+// instead of being truncated. Saving events fails with ErrReadOnly. Store has to be closed with Close.
+func OpenReadOnly(dir string, serializer cqrs.EventSerializer) (*store, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%v is not a directory", dir)
+	}
+	s := &store{
+		dir:            dir,
+		serializer:     serializer,
+		opts:           Options{Sync: SyncNever},
+		readOnly:       true,
+		aggregates:     make(map[string][]int64),
+		afterSaveHooks: make([]cqrs.EventHook, 0),
+		stop:           make(chan struct{}),
+	}
+	if err := s.recover(); err != nil {
+		s.closeSegments()
+		return nil, err
+	}
+	return s, nil
+}
+
+// recover opens all segments and rebuilds index, truncating uncommitted records at the end of the log.
+func (s *store) recover() error {
+	names, err := filepath.Glob(filepath.Join(s.dir, "*"+segmentSuffix))
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	for i, name := range names {
+		first, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(name), segmentSuffix), 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: unexpected segment name %v", ErrCorrupted, name)
+		}
+		if expected := int64(len(s.positions) + 1); first != expected {
+			return fmt.Errorf("%w: segment %v should start at position %d", ErrCorrupted, name, expected)
+		}
+		flag := os.O_RDWR
+		if s.readOnly {
+			flag = os.O_RDONLY
+		}
+		file, err := os.OpenFile(name, flag, 0)
+		if err != nil {
+			return err
+		}
+		seg := &segment{first: first, file: file}
+		s.segments = append(s.segments, seg)
+
+		last := i == len(names)-1
+		if err := s.scan(seg, last); err != nil {
+			return fmt.Errorf("recovering segment %v: %w", name, err)
+		}
+	}
+
+	if len(s.segments) == 0 && !s.readOnly {
+		return s.newSegment(1)
+	}
+	return nil
+}
+
+// scan indexes committed records of segment. Uncommitted or damaged records at the end
+// of the last segment are truncated (skipped in read-only store), anywhere else they are reported as corruption.
+func (s *store) scan(seg *segment, last bool) error {
+	info, err := seg.file.Stat()
+	if err != nil {
+		return err
+	}
+	fileSize := info.Size()
+
+	var offset, committed int64
+	var pending []location
+	var pendingIDs []string
+	for offset < fileSize {
+		loc, aggregateID, flags, err := readRecord(seg, offset, fileSize)
+		if errors.Is(err, ErrCorrupted) || errors.Is(err, io.ErrUnexpectedEOF) {
+			// damaged record (or record with damaged length, which is not covered by checksum
+			// and looks cut off) is result of interrupted write only if no committed record follows
+			found, scanErr := committedAfter(seg, offset, fileSize)
+			if scanErr != nil {
+				return scanErr
+			}
+			if found {
+				return fmt.Errorf("%w: damaged record at offset %d is followed by committed records", ErrCorrupted, offset)
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		pending = append(pending, loc)
+		pendingIDs = append(pendingIDs, aggregateID)
+		offset += headerSize + loc.size
+		if flags&flagCommit != 0 {
+			for i, loc := range pending {
+				s.index(loc, pendingIDs[i])
+			}
+			pending, pendingIDs = nil, nil
+			committed = offset
+		}
+	}
+
+	if committed < fileSize {
+		if !last {
+			return fmt.Errorf("%w: invalid records after offset %d", ErrCorrupted, committed)
+		}
+		if s.readOnly {
+			seg.size = committed
+			return nil
+		}
+		if err := seg.file.Truncate(committed); err != nil {
+			return err
+		}
+		if err := seg.file.Sync(); err != nil {
+			return err
+		}
+	}
+	seg.size = committed
+	return nil
+}
+
+// readRecord reads and verifies record at provided offset.
+func readRecord(seg *segment, offset, fileSize int64) (loc location, aggregateID string, flags byte, err error) {
+	if offset+headerSize > fileSize {
+		return loc, "", 0, io.ErrUnexpectedEOF
+	}
+	header := make([]byte, headerSize)
+	if _, err := seg.file.ReadAt(header, offset); err != nil {
+		return loc, "", 0, err
+	}
+	size := int64(binary.BigEndian.Uint32(header[0:4]))
+	if size < 3 || offset+headerSize+size > fileSize {
+		return loc, "", 0, io.ErrUnexpectedEOF
+	}
+	body := make([]byte, size)
+	if _, err := seg.file.ReadAt(body, offset+headerSize); err != nil {
+		return loc, "", 0, err
+	}
+	loc = location{segment: seg, offset: offset, size: size}
+	if crc32.Checksum(body, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return loc, "", 0, fmt.Errorf("%w: checksum mismatch at offset %d", ErrCorrupted, offset)
+	}
+	idLen := int(binary.BigEndian.Uint16(body[1:3]))
+	if 3+idLen > len(body) {
+		return loc, "", 0, fmt.Errorf("%w: invalid record at offset %d", ErrCorrupted, offset)
+	}
+	return loc, string(body[3 : 3+idLen]), body[0], nil
+}
+
+// committedAfter reports whether there is a valid committed record anywhere after provided
+// offset. Boundaries of records after damaged one are not known, so every offset is tried.
+func committedAfter(seg *segment, from, fileSize int64) (bool, error) {
+	tail := make([]byte, fileSize-from)
+	if _, err := seg.file.ReadAt(tail, from); err != nil {
+		return false, err
+	}
+	for i := int64(1); i+headerSize+3 <= int64(len(tail)); i++ {
+		size := int64(binary.BigEndian.Uint32(tail[i : i+4]))
+		if size < 3 || i+headerSize+size > int64(len(tail)) {
+			continue
+		}
+		body := tail[i+headerSize : i+headerSize+size]
+		if body[0]&flagCommit == 0 {
+			continue
+		}
+		if crc32.Checksum(body, crcTable) == binary.BigEndian.Uint32(tail[i+4:i+8]) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// encodeRecord appends record with provided event to buf.
+func encodeRecord(buf []byte, aggregateID string, payload []byte, commit bool) []byte {
+	body := make([]byte, 3, 3+len(aggregateID)+len(payload))
+	if commit {
+		body[0] = flagCommit
+	}
+	binary.BigEndian.PutUint16(body[1:3], uint16(len(aggregateID)))
+	body = append(body, aggregateID...)
+	body = append(body, payload...)
+
+	header := make([]byte, headerSize)
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(header[4:8], crc32.Checksum(body, crcTable))
+	return append(append(buf, header...), body...)
+}
+
+func (s *store) index(loc location, aggregateID string) {
+	s.positions = append(s.positions, loc)
+	s.aggregates[aggregateID] = append(s.aggregates[aggregateID], int64(len(s.positions)))
+}
+
+// newSegment starts new segment with provided first position.
+func (s *store) newSegment(first int64) error {
+	name := filepath.Join(s.dir, fmt.Sprintf("%020d%s", first, segmentSuffix))
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	s.segments = append(s.segments, &segment{first: first, file: file})
+	if s.opts.Sync == SyncNever {
+		return nil
+	}
+	// make sure new file survives power loss
+	dir, err := os.Open(s.dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (s *store) active() *segment {
+	return s.segments[len(s.segments)-1]
+}
+
+func (s *store) Load(ctx context.Context, aggregateID string) ([]*cqrs.Event, error) {
+	return s.LoadAfter(ctx, aggregateID, 0)
+}
+
+func (s *store) LoadAfter(_ context.Context, aggregateID string, version int) ([]*cqrs.Event, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	positions := s.aggregates[aggregateID]
+	if version >= len(positions) {
+		return nil, nil
+	}
+	if version < 0 {
+		version = 0
+	}
+	// versions start from 1 and have no gaps, so version is also an index of the next event
+	return s.read(positions[version:])
+}
+
+func (s *store) ReadAll(_ context.Context, fromPosition int64, limit int) ([]*cqrs.Event, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if fromPosition >= int64(len(s.positions)) {
+		return nil, nil
+	}
+	if fromPosition < 0 {
+		fromPosition = 0
+	}
+	to := int64(len(s.positions))
+	if limit > 0 && fromPosition+int64(limit) < to {
+		to = fromPosition + int64(limit)
+	}
+	positions := make([]int64, 0, to-fromPosition)
+	for p := fromPosition + 1; p <= to; p++ {
+		positions = append(positions, p)
+	}
+	return s.read(positions)
+}
+
+// read returns events at provided positions. Caller has to hold the lock.
+func (s *store) read(positions []int64) ([]*cqrs.Event, error) {
+	events := make([]*cqrs.Event, 0, len(positions))
+	for _, p := range positions {
+		loc := s.positions[p-1]
+		body := make([]byte, loc.size)
+		if _, err := loc.segment.file.ReadAt(body, loc.offset+headerSize); err != nil {
+			return nil, err
+		}
+		idLen := int(binary.BigEndian.Uint16(body[1:3]))
+		ev, err := s.serializer.Unmarshal(body[3+idLen:])
+		if err != nil {
+			return nil, fmt.Errorf("reading event at position %d: %w", p, err)
+		}
+		events = append(events, ev)
+	}
+	return events, nil
+}
+
+func (s *store) Save(_ context.Context, events []*cqrs.Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	err := s.save(events)
+	afterSave := s.afterSaveHooks
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, ev := range events {
+		for _, h := range afterSave {
+			h(ev)
+		}
+	}
+	return nil
+}
+
+func (s *store) save(events []*cqrs.Event) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	// check versions of all events before storing any of them, so save is all or nothing
+	versions := make(map[string]int)
+	for _, ev := range events {
+		current, ok := versions[ev.AggregateID]
+		if !ok {
+			current = len(s.aggregates[ev.AggregateID])
+		}
+		if ev.Version != current+1 {
+			return cqrs.NewConcurrencyConflictError(ev.AggregateID, ev.Version-1, current)
+		}
+		if len(ev.AggregateID) > 1<<16-1 {
+			return fmt.Errorf("aggregate ID %.32v... is too long", ev.AggregateID)
+		}
+		versions[ev.AggregateID] = ev.Version
+	}
+
+	next := int64(len(s.positions) + 1)
+	var buf []byte
+	for i, ev := range events {
+		ev.Position = next + int64(i)
+		ev.SchemaVersion = s.serializer.SchemaVersion(ev.EventID)
+		payload, err := s.serializer.Marshal(ev)
+		if err != nil {
+			resetPositions(events)
+			return err
+		}
+		buf = encodeRecord(buf, ev.AggregateID, payload, i == len(events)-1)
+	}
+
+	seg := s.active()
+	if seg.size > 0 && seg.size+int64(len(buf)) > s.opts.SegmentSize {
+		if s.opts.Sync != SyncNever {
+			if err := seg.file.Sync(); err != nil {
+				resetPositions(events)
+				return err
+			}
+		}
+		if err := s.newSegment(next); err != nil {
+			resetPositions(events)
+			return err
+		}
+		seg = s.active()
+	}
+
+	if _, err := seg.file.WriteAt(buf, seg.size); err != nil {
+		// get rid of partial write, if truncate fails as well, it is done when store is opened next time
+		_ = seg.file.Truncate(seg.size)
+		resetPositions(events)
+		return err
+	}
+	if s.opts.Sync == SyncAlways {
+		if err := seg.file.Sync(); err != nil {
+			_ = seg.file.Truncate(seg.size)
+			resetPositions(events)
+			return err
+		}
+	} else {
+		s.dirty = true
+	}
+
+	offset := seg.size
+	for _, ev := range events {
+		size := int64(binary.BigEndian.Uint32(buf[offset-seg.size:]))
+		s.index(location{segment: seg, offset: offset, size: size}, ev.AggregateID)
+		offset += headerSize + size
+	}
+	seg.size = offset
+	return nil
+}
+
+// resetPositions clears positions assigned to events that have not been saved.
+func resetPositions(events []*cqrs.Event) {
+	for _, ev := range events {
+		ev.Position = 0
+	}
+}
+
+// AddAfterSaveHook add a function to be called when event is saved.
+func (s *store) AddAfterSaveHook(h cqrs.EventHook) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.afterSaveHooks = append(s.afterSaveHooks, h)
+}
+
+// Sync flushes all saved events to disk.
+func (s *store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sync()
+}
+
+func (s *store) sync() error {
+	if !s.dirty {
+		return nil
+	}
+	if err := s.active().file.Sync(); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+func (s *store) syncPeriodically() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.opts.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			_ = s.Sync()
+		}
+	}
+}
+
+// Close flushes saved events to disk and closes all segments.
+func (s *store) Close() error {
+	close(s.stop)
+	s.wg.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.sync()
+	if closeErr := s.closeSegments(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (s *store) closeSegments() error {
+	var err error
+	for _, seg := range s.segments {
+		if closeErr := seg.file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	s.segments = nil
+	return err
+}
+
+var _ cqrs.EventStore = &store{}
@@ -0,0 +1,246 @@
+package filestore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/delicb/toy-cqrs/cqrs"
+)
+
+const accountOpenedID cqrs.EventID = "account.opened"
+
+type accountOpened struct {
+	Owner string `json:"owner"`
+}
+
+func newSerializer() cqrs.EventSerializer {
+	s := cqrs.NewEventJSONSerializer()
+	s.RegisterDataCtor(accountOpenedID, func() interface{} { return &accountOpened{} })
+	return s
+}
+
+func newEvent(aggregateID string, version int, owner string) *cqrs.Event {
+	return &cqrs.Event{
+		EventID:       accountOpenedID,
+		AggregateID:   aggregateID,
+		AggregateType: "account",
+		CreatedAt:     time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC),
+		CorrelationID: "corr",
+		Version:       version,
+		Data:          &accountOpened{Owner: owner},
+	}
+}
+
+func open(t *testing.T, dir string, opts Options) *store {
+	s, err := Open(dir, newSerializer(), opts)
+	require.NoError(t, err)
+	return s
+}
+
+func owners(events []*cqrs.Event) []string {
+	var result []string
+	for _, ev := range events {
+		result = append(result, ev.Data.(*accountOpened).Owner)
+	}
+	return result
+}
+
+func TestSaveAndReopen(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	// small segments, so that events are spread over several of them
+	opts := Options{SegmentSize: 300}
+
+	s := open(t, dir, opts)
+	var hooked []int64
+	s.AddAfterSaveHook(func(ev *cqrs.Event) { hooked = append(hooked, ev.Position) })
+	require.NoError(t, s.Save(ctx, []*cqrs.Event{newEvent("a", 1, "a1"), newEvent("b", 1, "b1")}))
+	require.NoError(t, s.Save(ctx, []*cqrs.Event{newEvent("a", 2, "a2")}))
+	require.NoError(t, s.Save(ctx, []*cqrs.Event{newEvent("b", 2, "b2"), newEvent("a", 3, "a3")}))
+	assert.Equal(t, []int64{1, 2, 3, 4, 5}, hooked)
+
+	err := s.Save(ctx, []*cqrs.Event{newEvent("a", 3, "conflict")})
+	assert.ErrorIs(t, err, cqrs.ErrConcurrencyConflict)
+	require.NoError(t, s.Close())
+
+	segments, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	require.NoError(t, err)
+	assert.Greater(t, len(segments), 1)
+
+	s = open(t, dir, opts)
+	defer s.Close()
+	events, err := s.Load(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a1", "a2", "a3"}, owners(events))
+	assert.Equal(t, 3, events[2].Version)
+	assert.Equal(t, int64(5), events[2].Position)
+
+	events, err = s.LoadAfter(ctx, "b", 1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b2"}, owners(events))
+
+	events, err = s.ReadAll(ctx, 1, 3)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b1", "a2", "b2"}, owners(events))
+
+	// store continues from recovered state
+	require.NoError(t, s.Save(ctx, []*cqrs.Event{newEvent("b", 3, "b3")}))
+	events, err = s.ReadAll(ctx, 5, 0)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, int64(6), events[0].Position)
+}
+
+func TestRecoveryTruncatesTornWrite(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	s := open(t, dir, Options{})
+	require.NoError(t, s.Save(ctx, []*cqrs.Event{newEvent("a", 1, "a1")}))
+	committed := s.active().size
+	require.NoError(t, s.Save(ctx, []*cqrs.Event{newEvent("a", 2, "a2"), newEvent("a", 3, "a3")}))
+	size := s.active().size
+	name := s.active().file.Name()
+	require.NoError(t, s.Close())
+
+	// simulate crash in the middle of writing the second batch, first of its records is complete,
+	// but batch is not committed, so it has to be dropped as a whole
+	require.NoError(t, os.Truncate(name, size-5))
+
+	s = open(t, dir, Options{})
+	events, err := s.Load(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a1"}, owners(events))
+	assert.Equal(t, committed, s.active().size)
+
+	require.NoError(t, s.Save(ctx, []*cqrs.Event{newEvent("a", 2, "a2 again")}))
+	require.NoError(t, s.Close())
+
+	s = open(t, dir, Options{})
+	defer s.Close()
+	events, err = s.Load(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a1", "a2 again"}, owners(events))
+}
+
+func TestRecoveryTruncatesTornBatchWithDamagedRecord(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	s := open(t, dir, Options{})
+	require.NoError(t, s.Save(ctx, []*cqrs.Event{newEvent("a", 1, "a1")}))
+	committed := s.active().size
+	require.NoError(t, s.Save(ctx, []*cqrs.Event{newEvent("a", 2, "a2"), newEvent("a", 3, "a3")}))
+	size := s.active().size
+	name := s.active().file.Name()
+	require.NoError(t, s.Close())
+
+	// crash in the middle of writing the second batch left its first record damaged
+	// and the last one cut off, nothing committed follows, so batch is dropped
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("X"), committed+headerSize+10)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, os.Truncate(name, size-5))
+
+	s = open(t, dir, Options{})
+	defer s.Close()
+	events, err := s.Load(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a1"}, owners(events))
+	assert.Equal(t, committed, s.active().size)
+}
+
+func TestOpenReadOnlyDoesNotChangeLog(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	_, err := OpenReadOnly(filepath.Join(dir, "missing"), newSerializer())
+	require.Error(t, err)
+	assert.NoDirExists(t, filepath.Join(dir, "missing"))
+
+	s, err := OpenReadOnly(dir, newSerializer())
+	require.NoError(t, err)
+	events, err := s.ReadAll(ctx, 0, 0)
+	require.NoError(t, err)
+	assert.Empty(t, events)
+	require.NoError(t, s.Close())
+	names, err := filepath.Glob(filepath.Join(dir, "*"))
+	require.NoError(t, err)
+	assert.Empty(t, names)
+
+	s = open(t, dir, Options{})
+	require.NoError(t, s.Save(ctx, []*cqrs.Event{newEvent("a", 1, "a1")}))
+	require.NoError(t, s.Save(ctx, []*cqrs.Event{newEvent("a", 2, "a2"), newEvent("a", 3, "a3")}))
+	size := s.active().size
+	name := s.active().file.Name()
+	require.NoError(t, s.Close())
+	require.NoError(t, os.Truncate(name, size-5))
+
+	// torn write is skipped, but stays in the file
+	s, err = OpenReadOnly(dir, newSerializer())
+	require.NoError(t, err)
+	defer s.Close()
+	events, err = s.Load(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a1"}, owners(events))
+	assert.ErrorIs(t, s.Save(ctx, []*cqrs.Event{newEvent("a", 2, "a2")}), ErrReadOnly)
+	info, err := os.Stat(name)
+	require.NoError(t, err)
+	assert.Equal(t, size-5, info.Size())
+}
+
+func TestCorruptionBeforeCommittedRecordsIsReported(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	s := open(t, dir, Options{})
+	require.NoError(t, s.Save(ctx, []*cqrs.Event{newEvent("a", 1, "a1")}))
+	require.NoError(t, s.Save(ctx, []*cqrs.Event{newEvent("a", 2, "a2")}))
+	name := s.active().file.Name()
+	require.NoError(t, s.Close())
+
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("X"), headerSize+10)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, err = Open(dir, newSerializer(), Options{})
+	assert.ErrorIs(t, err, ErrCorrupted)
+}
+
+func TestDamagedLengthBeforeCommittedRecordsIsReported(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	s := open(t, dir, Options{})
+	require.NoError(t, s.Save(ctx, []*cqrs.Event{newEvent("a", 1, "a1")}))
+	damaged := s.active().size
+	require.NoError(t, s.Save(ctx, []*cqrs.Event{newEvent("a", 2, "a2")}))
+	require.NoError(t, s.Save(ctx, []*cqrs.Event{newEvent("a", 3, "a3"), newEvent("a", 4, "a4")}))
+	name := s.active().file.Name()
+	require.NoError(t, s.Close())
+
+	// length of the second record points past the end of the segment, as if it was cut off
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0x7f}, damaged)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, err = Open(dir, newSerializer(), Options{})
+	assert.ErrorIs(t, err, ErrCorrupted)
+
+	// committed batches are kept
+	info, err := os.Stat(name)
+	require.NoError(t, err)
+	assert.Greater(t, info.Size(), damaged)
+}
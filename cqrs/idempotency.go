@@ -0,0 +1,221 @@
+package cqrs
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// CommandOutcome is recorded result of handling a command.
+type CommandOutcome struct {
+	// Key is idempotency key of handled command.
+	Key       string
+	CommandID CommandID
+	// Error is message of error returned by command handler, empty if command succeeded.
+	Error string
+	// Pending is set while command is being handled, i.e. key has been reserved, but
+	// outcome is not known yet.
+	Pending     bool
+	ProcessedAt time.Time
+}
+
+// ErrCommandInProgress is returned when command with the same idempotency key is being
+// handled at the moment, so it is not known yet whether it will succeed.
+var ErrCommandInProgress = errors.New("command with the same idempotency key is being handled")
+
+// Err returns error command handling ended with, or nil if it was successful.
+func (o *CommandOutcome) Err() error {
+	if o.Pending {
+		return ErrCommandInProgress
+	}
+	if o.Error == "" {
+		return nil
+	}
+	return NewCommandRejectedError(errors.New(o.Error))
+}
+
+// IdempotencyStore keeps outcomes of handled commands, so that repeated commands
+// can be recognized.
+type IdempotencyStore interface {
+	// Reserve atomically records provided pending outcome, unless there already is an
+	// outcome for the same key, in which case existing outcome is returned instead. Outcomes
+	// recorded before since, and pending ones reserved before pendingSince, do not count and
+	// are replaced. Nil outcome means key has been reserved and it is up to caller to either
+	// Complete or Release it.
+	Reserve(ctx context.Context, pending *CommandOutcome, since, pendingSince time.Time) (*CommandOutcome, error)
+
+	// Complete records final outcome of a command whose key has been reserved.
+	Complete(ctx context.Context, outcome *CommandOutcome) error
+
+	// Release deletes pending outcome for provided key, so that command can be handled again.
+	// Completed outcomes are kept.
+	Release(ctx context.Context, key string) error
+
+	// Purge deletes all outcomes recorded before provided time.
+	Purge(ctx context.Context, before time.Time) error
+}
+
+const (
+	// purgeInterval is how often idempotent handler deletes outcomes older than retention window.
+	purgeInterval = 1 * time.Minute
+
+	// defaultPendingTimeout is how long key stays reserved if its outcome is never recorded
+	// (e.g. service crashed while handling command), see SetPendingTimeout.
+	defaultPendingTimeout = 1 * time.Minute
+)
+
+type idempotentCommandHandler struct {
+	next           CommandHandler
+	store          IdempotencyStore
+	retention      time.Duration
+	pendingTimeout time.Duration
+
+	mu        sync.Mutex
+	lastPurge time.Time
+}
+
+// HandleCommand handles command only if command with the same idempotency key has not been
+// handled within retention window. Otherwise, outcome of the original command is returned.
+// Only successes and rejections (see ErrCommandRejected) are remembered, command that failed
+// for any other reason (e.g. database not being available) can be sent again.
+func (h *idempotentCommandHandler) HandleCommand(ctx context.Context, cmd Command) error {
+	key := cmd.GetIdempotencyKey()
+	if key == "" {
+		return h.next.HandleCommand(ctx, cmd)
+	}
+
+	now := time.Now().UTC()
+	h.purge(ctx, now)
+
+	// reserve key before handling command, so that the same command delivered to another
+	// instance at the same time is not handled twice
+	pending := &CommandOutcome{
+		Key:         key,
+		CommandID:   cmd.GetCommandID(),
+		Pending:     true,
+		ProcessedAt: now,
+	}
+	outcome, err := h.store.Reserve(ctx, pending, now.Add(-h.retention), now.Add(-h.pendingTimeout))
+	if err != nil {
+		return err
+	}
+	if outcome != nil {
+		log.Printf("command %v with key %v already handled at %v, skipping\n", cmd.GetCommandID(), key, outcome.ProcessedAt)
+		return outcome.Err()
+	}
+
+	handleErr := h.next.HandleCommand(ctx, cmd)
+	if handleErr != nil && !errors.Is(handleErr, ErrCommandRejected) {
+		// command could not be handled at the moment (e.g. conflict or database error),
+		// not because it is invalid, so it should be possible to send it again
+		if err := h.store.Release(ctx, key); err != nil {
+			log.Printf("ERROR: failed to release key %v of command %v: %v\n", key, cmd.GetCommandID(), err)
+		}
+		return handleErr
+	}
+
+	outcome = &CommandOutcome{
+		Key:         key,
+		CommandID:   cmd.GetCommandID(),
+		ProcessedAt: time.Now().UTC(),
+	}
+	if handleErr != nil {
+		outcome.Error = handleErr.Error()
+	}
+	if err := h.store.Complete(ctx, outcome); err != nil {
+		log.Printf("ERROR: failed to record outcome of command %v with key %v: %v\n", cmd.GetCommandID(), key, err)
+	}
+	return handleErr
+}
+
+// purge deletes expired outcomes, at most once per purge interval.
+func (h *idempotentCommandHandler) purge(ctx context.Context, now time.Time) {
+	h.mu.Lock()
+	if now.Sub(h.lastPurge) < purgeInterval {
+		h.mu.Unlock()
+		return
+	}
+	h.lastPurge = now
+	h.mu.Unlock()
+
+	if err := h.store.Purge(ctx, now.Add(-h.retention)); err != nil {
+		log.Printf("ERROR: failed to purge expired command outcomes: %v\n", err)
+	}
+}
+
+// SetPendingTimeout sets how long key of a command stays reserved if outcome of handling
+// it is never recorded (e.g. service crashed while handling it). Until then, the same command
+// fails with ErrCommandInProgress, afterwards it is handled again. It should be longer than
+// handling of any command can take. Default is one minute.
+func (h *idempotentCommandHandler) SetPendingTimeout(d time.Duration) {
+	h.pendingTimeout = d
+}
+
+// NewIdempotentHandler returns CommandHandler that passes commands to provided handler,
+// unless command with the same idempotency key (see BaseCommand.GetIdempotencyKey) has already
+// been handled within retention window, in which case original outcome is returned.
+func NewIdempotentHandler(next CommandHandler, store IdempotencyStore, retention time.Duration) *idempotentCommandHandler {
+	return &idempotentCommandHandler{
+		next:           next,
+		store:          store,
+		retention:      retention,
+		pendingTimeout: defaultPendingTimeout,
+	}
+}
+
+// inMemoryIdempotencyStore is simple implementation of IdempotencyStore that keeps outcomes in memory.
+type inMemoryIdempotencyStore struct {
+	mu       sync.Mutex
+	outcomes map[string]*CommandOutcome
+}
+
+func (s *inMemoryIdempotencyStore) Reserve(_ context.Context, pending *CommandOutcome, since, pendingSince time.Time) (*CommandOutcome, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	outcome, ok := s.outcomes[pending.Key]
+	if ok && !outcome.ProcessedAt.Before(since) && !(outcome.Pending && outcome.ProcessedAt.Before(pendingSince)) {
+		return outcome, nil
+	}
+	reserved := *pending
+	reserved.Pending = true
+	s.outcomes[pending.Key] = &reserved
+	return nil, nil
+}
+
+func (s *inMemoryIdempotencyStore) Complete(_ context.Context, outcome *CommandOutcome) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	completed := *outcome
+	completed.Pending = false
+	s.outcomes[outcome.Key] = &completed
+	return nil
+}
+
+func (s *inMemoryIdempotencyStore) Release(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if outcome, ok := s.outcomes[key]; ok && outcome.Pending {
+		delete(s.outcomes, key)
+	}
+	return nil
+}
+
+func (s *inMemoryIdempotencyStore) Purge(_ context.Context, before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, outcome := range s.outcomes {
+		if outcome.ProcessedAt.Before(before) {
+			delete(s.outcomes, key)
+		}
+	}
+	return nil
+}
+
+// NewInMemoryIdempotencyStore returns IdempotencyStore implementation that stores outcomes only in memory.
+func NewInMemoryIdempotencyStore() *inMemoryIdempotencyStore {
+	return &inMemoryIdempotencyStore{
+		outcomes: make(map[string]*CommandOutcome),
+	}
+}
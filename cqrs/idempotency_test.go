@@ -0,0 +1,102 @@
+package cqrs
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdempotentHandlerHandlesConcurrentDeliveriesOnce(t *testing.T) {
+	ctx := context.Background()
+	var handled int32
+	release := make(chan struct{})
+	next := CommandHandlerFunc(func(_ context.Context, _ Command) error {
+		atomic.AddInt32(&handled, 1)
+		<-release
+		return nil
+	})
+	h := NewIdempotentHandler(next, NewInMemoryIdempotencyStore(), time.Hour)
+	cmd := &BaseCommand{CommandID: "account.open", CorrelationID: "corr-1"}
+
+	first := make(chan error)
+	go func() { first <- h.HandleCommand(ctx, cmd) }()
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&handled) == 1 }, time.Second, time.Millisecond)
+
+	// the same command delivered while the first one is still being handled
+	assert.ErrorIs(t, h.HandleCommand(ctx, cmd), ErrCommandInProgress)
+
+	close(release)
+	require.NoError(t, <-first)
+	assert.NoError(t, h.HandleCommand(ctx, cmd))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&handled))
+}
+
+func TestIdempotentHandlerRemembersOnlyRejections(t *testing.T) {
+	ctx := context.Background()
+	errs := []error{
+		errors.New("connection refused"),
+		NewConcurrencyConflictError("account-1", 1, 2),
+		NewCommandRejectedError(errors.New("account closed")),
+		nil,
+	}
+	var handled int
+	next := CommandHandlerFunc(func(_ context.Context, _ Command) error {
+		err := errs[handled]
+		handled++
+		return err
+	})
+	h := NewIdempotentHandler(next, NewInMemoryIdempotencyStore(), time.Hour)
+	cmd := &BaseCommand{CommandID: "account.deposit", CorrelationID: "corr-1"}
+
+	// transient errors are not remembered, command is handled again
+	assert.EqualError(t, h.HandleCommand(ctx, cmd), "connection refused")
+	assert.ErrorIs(t, h.HandleCommand(ctx, cmd), ErrConcurrencyConflict)
+
+	err := h.HandleCommand(ctx, cmd)
+	assert.ErrorIs(t, err, ErrCommandRejected)
+
+	// rejection is remembered and returned without handling command again
+	err = h.HandleCommand(ctx, cmd)
+	assert.ErrorIs(t, err, ErrCommandRejected)
+	assert.EqualError(t, err, "account closed")
+	assert.Equal(t, 3, handled)
+}
+
+func TestInMemoryIdempotencyStoreTakesOverAbandonedReservation(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryIdempotencyStore()
+	now := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	pending := &CommandOutcome{Key: "corr-1", CommandID: "account.open", ProcessedAt: now}
+
+	outcome, err := store.Reserve(ctx, pending, now.Add(-time.Hour), now.Add(-time.Minute))
+	require.NoError(t, err)
+	assert.Nil(t, outcome)
+
+	later := *pending
+	later.ProcessedAt = now.Add(30 * time.Second)
+	outcome, err = store.Reserve(ctx, &later, later.ProcessedAt.Add(-time.Hour), later.ProcessedAt.Add(-time.Minute))
+	require.NoError(t, err)
+	require.NotNil(t, outcome)
+	assert.True(t, outcome.Pending)
+
+	// reservation is abandoned once pending timeout passes
+	later.ProcessedAt = now.Add(2 * time.Minute)
+	outcome, err = store.Reserve(ctx, &later, later.ProcessedAt.Add(-time.Hour), later.ProcessedAt.Add(-time.Minute))
+	require.NoError(t, err)
+	assert.Nil(t, outcome)
+
+	// completed outcomes are kept until retention expires
+	require.NoError(t, store.Complete(ctx, &CommandOutcome{Key: "corr-1", CommandID: "account.open", ProcessedAt: later.ProcessedAt}))
+	require.NoError(t, store.Release(ctx, "corr-1"))
+	later.ProcessedAt = now.Add(30 * time.Minute)
+	outcome, err = store.Reserve(ctx, &later, later.ProcessedAt.Add(-time.Hour), later.ProcessedAt.Add(-time.Minute))
+	require.NoError(t, err)
+	require.NotNil(t, outcome)
+	assert.False(t, outcome.Pending)
+	assert.NoError(t, outcome.Err())
+}
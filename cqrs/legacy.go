@@ -0,0 +1,153 @@
+package cqrs
+
+import (
+	"context"
+)
+
+// Interfaces and adapters below bridge implementations written before cqrs interfaces
+// accepted context. Adapters from legacy implementations ignore provided context, adapters
+// to legacy interfaces use context.Background.
+
+// LegacyCommandHandler is CommandHandler without context.
+type LegacyCommandHandler interface {
+	HandleCommand(cmd Command) error
+}
+
+// LegacyCommandValidator is CommandValidator without context.
+type LegacyCommandValidator interface {
+	Validate(cmd Command) error
+}
+
+// LegacyRepository is Repository without context.
+type LegacyRepository interface {
+	Load(typ, aggregateID string) (AggregateRoot, error)
+	Save(root AggregateRoot) error
+}
+
+// LegacyEventStore is EventStore without context.
+type LegacyEventStore interface {
+	Load(aggregateID string) ([]*Event, error)
+	LoadAfter(aggregateID string, version int) ([]*Event, error)
+	ReadAll(fromPosition int64, limit int) ([]*Event, error)
+	Save(events []*Event) error
+}
+
+type legacyCommandHandler struct{ h LegacyCommandHandler }
+
+func (a *legacyCommandHandler) HandleCommand(_ context.Context, cmd Command) error {
+	return a.h.HandleCommand(cmd)
+}
+
+// FromLegacyCommandHandler adapts command handler without context to CommandHandler.
+func FromLegacyCommandHandler(h LegacyCommandHandler) CommandHandler {
+	return &legacyCommandHandler{h: h}
+}
+
+type contextlessCommandHandler struct{ h CommandHandler }
+
+func (a *contextlessCommandHandler) HandleCommand(cmd Command) error {
+	return a.h.HandleCommand(context.Background(), cmd)
+}
+
+// ToLegacyCommandHandler adapts CommandHandler for callers that do not have context.
+func ToLegacyCommandHandler(h CommandHandler) LegacyCommandHandler {
+	return &contextlessCommandHandler{h: h}
+}
+
+type legacyCommandValidator struct{ v LegacyCommandValidator }
+
+func (a *legacyCommandValidator) Validate(_ context.Context, cmd Command) error {
+	return a.v.Validate(cmd)
+}
+
+// FromLegacyCommandValidator adapts validator without context to CommandValidator.
+func FromLegacyCommandValidator(v LegacyCommandValidator) CommandValidator {
+	return &legacyCommandValidator{v: v}
+}
+
+type contextlessCommandValidator struct{ v CommandValidator }
+
+func (a *contextlessCommandValidator) Validate(cmd Command) error {
+	return a.v.Validate(context.Background(), cmd)
+}
+
+// ToLegacyCommandValidator adapts CommandValidator for callers that do not have context.
+func ToLegacyCommandValidator(v CommandValidator) LegacyCommandValidator {
+	return &contextlessCommandValidator{v: v}
+}
+
+type legacyRepository struct{ r LegacyRepository }
+
+func (a *legacyRepository) Load(_ context.Context, typ, aggregateID string) (AggregateRoot, error) {
+	return a.r.Load(typ, aggregateID)
+}
+
+func (a *legacyRepository) Save(_ context.Context, root AggregateRoot) error {
+	return a.r.Save(root)
+}
+
+// FromLegacyRepository adapts repository without context to Repository.
+func FromLegacyRepository(r LegacyRepository) Repository {
+	return &legacyRepository{r: r}
+}
+
+type contextlessRepository struct{ r Repository }
+
+func (a *contextlessRepository) Load(typ, aggregateID string) (AggregateRoot, error) {
+	return a.r.Load(context.Background(), typ, aggregateID)
+}
+
+func (a *contextlessRepository) Save(root AggregateRoot) error {
+	return a.r.Save(context.Background(), root)
+}
+
+// ToLegacyRepository adapts Repository for callers that do not have context.
+func ToLegacyRepository(r Repository) LegacyRepository {
+	return &contextlessRepository{r: r}
+}
+
+type legacyEventStore struct{ s LegacyEventStore }
+
+func (a *legacyEventStore) Load(_ context.Context, aggregateID string) ([]*Event, error) {
+	return a.s.Load(aggregateID)
+}
+
+func (a *legacyEventStore) LoadAfter(_ context.Context, aggregateID string, version int) ([]*Event, error) {
+	return a.s.LoadAfter(aggregateID, version)
+}
+
+func (a *legacyEventStore) ReadAll(_ context.Context, fromPosition int64, limit int) ([]*Event, error) {
+	return a.s.ReadAll(fromPosition, limit)
+}
+
+func (a *legacyEventStore) Save(_ context.Context, events []*Event) error {
+	return a.s.Save(events)
+}
+
+// FromLegacyEventStore adapts event store without context to EventStore.
+func FromLegacyEventStore(s LegacyEventStore) EventStore {
+	return &legacyEventStore{s: s}
+}
+
+type contextlessEventStore struct{ s EventStore }
+
+func (a *contextlessEventStore) Load(aggregateID string) ([]*Event, error) {
+	return a.s.Load(context.Background(), aggregateID)
+}
+
+func (a *contextlessEventStore) LoadAfter(aggregateID string, version int) ([]*Event, error) {
+	return a.s.LoadAfter(context.Background(), aggregateID, version)
+}
+
+func (a *contextlessEventStore) ReadAll(fromPosition int64, limit int) ([]*Event, error) {
+	return a.s.ReadAll(context.Background(), fromPosition, limit)
+}
+
+func (a *contextlessEventStore) Save(events []*Event) error {
+	return a.s.Save(context.Background(), events)
+}
+
+// ToLegacyEventStore adapts EventStore for callers that do not have context.
+func ToLegacyEventStore(s EventStore) LegacyEventStore {
+	return &contextlessEventStore{s: s}
+}
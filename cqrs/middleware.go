@@ -0,0 +1,115 @@
+package cqrs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"time"
+
+	"go.uber.org/multierr"
+)
+
+// CommandHandlerFunc is adapter allowing ordinary function to be used as CommandHandler.
+type CommandHandlerFunc func(ctx context.Context, cmd Command) error
+
+func (f CommandHandlerFunc) HandleCommand(ctx context.Context, cmd Command) error {
+	return f(ctx, cmd)
+}
+
+// Middleware wraps command handler, adding behaviour before and/or after command is
+// handled by next handler in the chain.
+type Middleware func(next CommandHandler) CommandHandler
+
+// Chain wraps handler with provided middlewares. First middleware is the outermost one,
+// e.g. in Chain(h, m1, m2) command goes through m1, then m2 and then reaches h.
+func Chain(handler CommandHandler, middlewares ...Middleware) CommandHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// LoggingMiddleware logs every command and its outcome to provided logger.
+// If logger is nil, standard logger is used.
+func LoggingMiddleware(logger *log.Logger) Middleware {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return func(next CommandHandler) CommandHandler {
+		return CommandHandlerFunc(func(ctx context.Context, cmd Command) error {
+			logger.Printf("handling command %v for %v %v (correlation ID: %v)\n",
+				cmd.GetCommandID(), cmd.GetAggregateType(), cmd.GetAggregateID(), cmd.GetCorrelationID())
+			err := next.HandleCommand(ctx, cmd)
+			if err != nil {
+				logger.Printf("command %v (correlation ID: %v) failed: %v\n", cmd.GetCommandID(), cmd.GetCorrelationID(), err)
+			} else {
+				logger.Printf("command %v (correlation ID: %v) handled\n", cmd.GetCommandID(), cmd.GetCorrelationID())
+			}
+			return err
+		})
+	}
+}
+
+// RecoveryMiddleware converts panics in next handlers to errors, so that single bad
+// command does not bring down whole service.
+func RecoveryMiddleware() Middleware {
+	return func(next CommandHandler) CommandHandler {
+		return CommandHandlerFunc(func(ctx context.Context, cmd Command) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("panic while handling command %v: %v\n%s", cmd.GetCommandID(), r, debug.Stack())
+				}
+			}()
+			return next.HandleCommand(ctx, cmd)
+		})
+	}
+}
+
+// TimingMiddleware measures how long handling of each command took and reports it,
+// together with outcome, to provided function (e.g. to log it or record a metric).
+func TimingMiddleware(observe func(cmd Command, took time.Duration, err error)) Middleware {
+	return func(next CommandHandler) CommandHandler {
+		return CommandHandlerFunc(func(ctx context.Context, cmd Command) error {
+			start := time.Now()
+			err := next.HandleCommand(ctx, cmd)
+			observe(cmd, time.Since(start), err)
+			return err
+		})
+	}
+}
+
+// ValidationMiddleware calls provided validators before passing command to next handler.
+// Command is rejected if any of validators reports an error, errors of all validators
+// are combined (and marked with ErrCommandRejected).
+func ValidationMiddleware(validators ...CommandValidator) Middleware {
+	return func(next CommandHandler) CommandHandler {
+		return CommandHandlerFunc(func(ctx context.Context, cmd Command) error {
+			var validationError error
+			for _, validator := range validators {
+				validationError = multierr.Combine(validationError, validator.Validate(ctx, cmd))
+			}
+			if validationError != nil {
+				return NewCommandRejectedError(validationError)
+			}
+			return next.HandleCommand(ctx, cmd)
+		})
+	}
+}
+
+// RetryMiddleware handles command again, according to provided policy, if next handler
+// fails because aggregate root has been modified concurrently.
+func RetryMiddleware(p RetryPolicy) Middleware {
+	return func(next CommandHandler) CommandHandler {
+		return CommandHandlerFunc(func(ctx context.Context, cmd Command) error {
+			return retryOnConflict(ctx, p, func() error { return next.HandleCommand(ctx, cmd) })
+		})
+	}
+}
+
+// IdempotencyMiddleware handles each command only once, see NewIdempotentHandler.
+func IdempotencyMiddleware(store IdempotencyStore, retention time.Duration) Middleware {
+	return func(next CommandHandler) CommandHandler {
+		return NewIdempotentHandler(next, store, retention)
+	}
+}
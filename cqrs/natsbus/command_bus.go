@@ -0,0 +1,153 @@
+// Package natsbus implements cqrs.CommandBus and cqrs.EventBus on top of nats.
+//
+// Commands are sent with request/response pattern on subject command.<command ID>
+// (e.g. command.user.create). Receiver responds with "ok:" once it accepts command, or
+// with "error:<message>" if it can not (e.g. command can not be unmarshaled). Outcome of
+// processing command is published on event.<correlation ID>.success or event.<correlation ID>.error.
+// Events are published on event.<aggregate type>.<event ID> (e.g. event.user.user.created).
+package natsbus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"go.uber.org/multierr"
+
+	"github.com/delicb/toy-cqrs/cqrs"
+)
+
+// acceptTimeout is how long Send waits for receiver to accept command, if context has no deadline.
+const acceptTimeout = 1 * time.Second
+
+// CommandSubject returns subject commands with provided ID are sent on.
+func CommandSubject(ID cqrs.CommandID) string {
+	return fmt.Sprintf("command.%s", ID)
+}
+
+// Request sends data on provided subject and waits for receiver to accept it (see Respond).
+func Request(ctx context.Context, conn *nats.Conn, subject string, data []byte) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, acceptTimeout)
+		defer cancel()
+	}
+	r, err := conn.RequestWithContext(ctx, subject, data)
+	if err != nil {
+		return err
+	}
+	response := string(r.Data)
+	if strings.HasPrefix(response, "error:") {
+		return fmt.Errorf("error from %v receiver: %v", subject, strings.TrimPrefix(response, "error:"))
+	}
+	return nil
+}
+
+// Respond lets sender of request know whether it has been accepted (err is nil) or not.
+func Respond(msg *nats.Msg, err error) {
+	response := "ok:ack"
+	if err != nil {
+		response = fmt.Sprintf("error:%v", err)
+	}
+	if nerr := msg.Respond([]byte(response)); nerr != nil {
+		log.Printf("ERROR: failed to respond to nats message: %v\n", nerr)
+	}
+}
+
+type subscription struct {
+	sub *nats.Subscription
+}
+
+// Unsubscribe stops receiving commands, waiting for ones already received to be handled.
+func (s *subscription) Unsubscribe() error {
+	return s.sub.Drain()
+}
+
+type commandBus struct {
+	conn       *nats.Conn
+	serializer cqrs.CommandSerializer
+}
+
+// NewCommandBus returns cqrs.CommandBus sending commands over provided nats connection,
+// serialized with provided serializer. It also implements cqrs.CommandReporter.
+func NewCommandBus(conn *nats.Conn, serializer cqrs.CommandSerializer) *commandBus {
+	return &commandBus{
+		conn:       conn,
+		serializer: serializer,
+	}
+}
+
+func (b *commandBus) Send(ctx context.Context, cmd cqrs.Command) error {
+	data, err := b.serializer.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	return Request(ctx, b.conn, CommandSubject(cmd.GetCommandID()), data)
+}
+
+func (b *commandBus) SendAndWait(ctx context.Context, cmd cqrs.Command) (payload []byte, err error) {
+	correlationID := cmd.GetCorrelationID()
+	if correlationID == "" {
+		return nil, cqrs.ErrNoCorrelationID
+	}
+
+	// subscribe to feedback before we send a command
+	sub, err := b.conn.SubscribeSync(fmt.Sprintf("event.%v.*", correlationID))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = multierr.Combine(err, sub.Unsubscribe())
+	}()
+
+	if err := b.Send(ctx, cmd); err != nil {
+		return nil, err
+	}
+
+	// block until we get a response
+	msg, err := sub.NextMsgWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(msg.Subject, ".error") {
+		return nil, errors.New(string(msg.Data))
+	}
+	return msg.Data, nil
+}
+
+// Subscribe handles commands with provided ID. Command is accepted as soon as it is
+// unmarshaled, before it is handled. Commands received by one subscription are handled one
+// at the time, in order they arrived.
+func (b *commandBus) Subscribe(ctx context.Context, ID cqrs.CommandID, h cqrs.CommandHandler) (cqrs.Subscription, error) {
+	sub, err := b.conn.Subscribe(CommandSubject(ID), func(msg *nats.Msg) {
+		cmd, err := b.serializer.Unmarshal(msg.Data)
+		Respond(msg, err)
+		if err != nil {
+			return
+		}
+		if err := h.HandleCommand(cqrs.ContextWithCommand(ctx, cmd), cmd); err != nil {
+			if rerr := b.ReportFailure(cmd.GetCorrelationID(), err); rerr != nil {
+				log.Printf("ERROR: failed to report failure of command %v: %v (original error: %v)\n", cmd.GetCommandID(), rerr, err)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &subscription{sub: sub}, nil
+}
+
+func (b *commandBus) ReportSuccess(correlationID string, payload []byte) error {
+	return b.conn.Publish(fmt.Sprintf("event.%v.success", correlationID), payload)
+}
+
+func (b *commandBus) ReportFailure(correlationID string, err error) error {
+	return b.conn.Publish(fmt.Sprintf("event.%v.error", correlationID), []byte(err.Error()))
+}
+
+var _ cqrs.CommandBus = &commandBus{}
+var _ cqrs.CommandReporter = &commandBus{}
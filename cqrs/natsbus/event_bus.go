@@ -0,0 +1,85 @@
+package natsbus
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/delicb/toy-cqrs/cqrs"
+)
+
+// outcomeSubject matches subjects outcome of commands is published on, which share
+// event prefix with events, but do not carry events.
+var outcomeSubject = regexp.MustCompile(`^event\.[^.]+\.(success|error)$`)
+
+// EventSubject returns subject event is published on, e.g. event.user.user.created.
+func EventSubject(ev *cqrs.Event) string {
+	return fmt.Sprintf("event.%s.%s", ev.AggregateType, ev.EventID)
+}
+
+// filterSubject returns the narrowest subject that receives all events matching filter.
+func filterSubject(filter cqrs.EventFilter) string {
+	switch {
+	case filter.AggregateType != "" && filter.EventID != "":
+		return fmt.Sprintf("event.%s.%s", filter.AggregateType, filter.EventID)
+	case filter.EventID != "":
+		return fmt.Sprintf("event.*.%s", filter.EventID)
+	case filter.AggregateType != "":
+		return fmt.Sprintf("event.%s.>", filter.AggregateType)
+	default:
+		return "event.>"
+	}
+}
+
+type eventBus struct {
+	conn       *nats.Conn
+	serializer cqrs.EventSerializer
+}
+
+// NewEventBus returns cqrs.EventBus publishing events over provided nats connection,
+// serialized with provided serializer. Events are published on subjects returned by EventSubject.
+func NewEventBus(conn *nats.Conn, serializer cqrs.EventSerializer) *eventBus {
+	return &eventBus{
+		conn:       conn,
+		serializer: serializer,
+	}
+}
+
+func (b *eventBus) Publish(_ context.Context, ev *cqrs.Event) error {
+	data, err := b.serializer.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	return b.conn.Publish(EventSubject(ev), data)
+}
+
+// Subscribe delivers matching events to handler, one at the time, in order they arrived.
+// Messages that can not be decoded are logged and skipped.
+func (b *eventBus) Subscribe(ctx context.Context, filter cqrs.EventFilter, h cqrs.EventHandler) (cqrs.Subscription, error) {
+	sub, err := b.conn.Subscribe(filterSubject(filter), func(msg *nats.Msg) {
+		if outcomeSubject.MatchString(msg.Subject) {
+			return
+		}
+		ev, err := b.serializer.Unmarshal(msg.Data)
+		if err != nil {
+			log.Printf("ERROR: failed to decode event from %v: %v\n", msg.Subject, err)
+			return
+		}
+		cqrs.HandleEvent(ctx, filter, h, ev)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if done := ctx.Done(); done != nil {
+		go func() {
+			<-done
+			_ = sub.Unsubscribe()
+		}()
+	}
+	return &subscription{sub: sub}, nil
+}
+
+var _ cqrs.EventBus = &eventBus{}
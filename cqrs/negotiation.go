@@ -0,0 +1,203 @@
+package cqrs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/x-protobuf"
+)
+
+// DetectContentType returns content type of serialized command or event.
+// JSON serializers always produce objects, so anything that does not start
+// with '{' (after optional whitespace) is considered to be protobuf. Protobuf
+// data can also start with bytes that look like whitespace, so data with
+// leading whitespace is considered JSON only if it is valid JSON.
+func DetectContentType(data []byte) string {
+	trimmed := bytes.TrimLeft(data, " \t\r\n")
+	if len(trimmed) > 0 && trimmed[0] == '{' && (len(trimmed) == len(data) || json.Valid(data)) {
+		return ContentTypeJSON
+	}
+	return ContentTypeProtobuf
+}
+
+// ContentTyper is implemented by serializers that can be registered to negotiators.
+type ContentTyper interface {
+	// ContentType returns content type of data produced by serializer.
+	ContentType() string
+}
+
+type commandNegotiator struct {
+	serializers map[string]CommandSerializer
+	preferred   string
+}
+
+// NewCommandNegotiator returns CommandSerializer that marshals commands using serializer
+// for preferred content type, and unmarshals them using serializer for the content type
+// detected from data, which allows services using different formats to talk to each other.
+// First registered serializer is preferred, unless changed with SetPreferred.
+func NewCommandNegotiator() *commandNegotiator {
+	return &commandNegotiator{
+		serializers: make(map[string]CommandSerializer),
+	}
+}
+
+func (n *commandNegotiator) Register(contentType string, s CommandSerializer) {
+	if n.preferred == "" {
+		n.preferred = contentType
+	}
+	n.serializers[contentType] = s
+}
+
+// SetPreferred sets content type used when marshaling commands.
+func (n *commandNegotiator) SetPreferred(contentType string) error {
+	if _, ok := n.serializers[contentType]; !ok {
+		return fmt.Errorf("no command serializer for content type %q", contentType)
+	}
+	n.preferred = contentType
+	return nil
+}
+
+func (n *commandNegotiator) ContentType() string { return n.preferred }
+
+func (n *commandNegotiator) Marshal(cmd Command) ([]byte, error) {
+	s, err := n.serializer(n.preferred)
+	if err != nil {
+		return nil, err
+	}
+	return s.Marshal(cmd)
+}
+
+func (n *commandNegotiator) Unmarshal(rawData []byte) (Command, error) {
+	s, err := n.serializer(DetectContentType(rawData))
+	if err != nil {
+		return nil, err
+	}
+	return s.Unmarshal(rawData)
+}
+
+func (n *commandNegotiator) serializer(contentType string) (CommandSerializer, error) {
+	s, ok := n.serializers[contentType]
+	if !ok {
+		return nil, fmt.Errorf("no command serializer for content type %q", contentType)
+	}
+	return s, nil
+}
+
+type eventNegotiator struct {
+	serializers map[string]EventSerializer
+	preferred   string
+}
+
+// NewEventNegotiator returns EventSerializer that marshals events using serializer for
+// preferred content type, and unmarshals them using serializer for the content type
+// detected from data. Schema versions are reported by preferred serializer.
+// First registered serializer is preferred, unless changed with SetPreferred.
+func NewEventNegotiator() *eventNegotiator {
+	return &eventNegotiator{
+		serializers: make(map[string]EventSerializer),
+	}
+}
+
+func (n *eventNegotiator) Register(contentType string, s EventSerializer) {
+	if n.preferred == "" {
+		n.preferred = contentType
+	}
+	n.serializers[contentType] = s
+}
+
+// SetPreferred sets content type used when marshaling events.
+func (n *eventNegotiator) SetPreferred(contentType string) error {
+	if _, ok := n.serializers[contentType]; !ok {
+		return fmt.Errorf("no event serializer for content type %q", contentType)
+	}
+	n.preferred = contentType
+	return nil
+}
+
+func (n *eventNegotiator) ContentType() string { return n.preferred }
+
+// RegisteredData returns data of events registered with any of serializers that can list them.
+func (n *eventNegotiator) RegisteredData() map[EventID]interface{} {
+	data := make(map[EventID]interface{})
+	for _, s := range n.serializers {
+		registry, ok := s.(EventDataRegistry)
+		if !ok {
+			continue
+		}
+		for ID, d := range registry.RegisteredData() {
+			data[ID] = d
+		}
+	}
+	return data
+}
+
+func (n *eventNegotiator) Marshal(ev *Event) ([]byte, error) {
+	s, err := n.serializer(n.preferred)
+	if err != nil {
+		return nil, err
+	}
+	return s.Marshal(ev)
+}
+
+func (n *eventNegotiator) Unmarshal(rawData []byte) (*Event, error) {
+	s, err := n.serializer(DetectContentType(rawData))
+	if err != nil {
+		return nil, err
+	}
+	return s.Unmarshal(rawData)
+}
+
+func (n *eventNegotiator) MarshalData(ev *Event) ([]byte, error) {
+	s, err := n.serializer(n.preferred)
+	if err != nil {
+		return nil, err
+	}
+	return s.MarshalData(ev)
+}
+
+func (n *eventNegotiator) UnmarshalData(ID EventID, schemaVersion int, data []byte) (interface{}, error) {
+	s, err := n.serializer(DetectContentType(data))
+	if err != nil {
+		return nil, err
+	}
+	return s.UnmarshalData(ID, schemaVersion, data)
+}
+
+func (n *eventNegotiator) SchemaVersion(ID EventID) int {
+	s, err := n.serializer(n.preferred)
+	if err != nil {
+		return 1
+	}
+	return s.SchemaVersion(ID)
+}
+
+func (n *eventNegotiator) MarshalMetadata(ev *Event) ([]byte, error) {
+	s, err := n.serializer(n.preferred)
+	if err != nil {
+		return nil, err
+	}
+	return s.MarshalMetadata(ev)
+}
+
+func (n *eventNegotiator) UnmarshalMetadata(data []byte, ev *Event) error {
+	if len(data) == 0 {
+		return nil
+	}
+	s, err := n.serializer(DetectContentType(data))
+	if err != nil {
+		return err
+	}
+	return s.UnmarshalMetadata(data, ev)
+}
+
+func (n *eventNegotiator) serializer(contentType string) (EventSerializer, error) {
+	s, ok := n.serializers[contentType]
+	if !ok {
+		return nil, fmt.Errorf("no event serializer for content type %q", contentType)
+	}
+	return s, nil
+}
@@ -0,0 +1,36 @@
+package cqrs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/delicb/toy-cqrs/cqrs/cqrspb"
+)
+
+func TestDetectContentType(t *testing.T) {
+	// protobuf envelopes start with tag of field 1, which is '\n'
+	envelope, err := proto.Marshal(&cqrspb.CommandEnvelope{CommandId: "account.open", AggregateId: "{account-1}"})
+	require.NoError(t, err)
+	require.Equal(t, byte('\n'), envelope[0])
+	// length of the field (10) is '\n' as well, followed by '{'
+	tricky, err := proto.Marshal(&cqrspb.CommandEnvelope{CommandId: "{account}."})
+	require.NoError(t, err)
+
+	for name, tc := range map[string]struct {
+		data     []byte
+		expected string
+	}{
+		"json":                 {[]byte(`{"command_id":"account.open"}`), ContentTypeJSON},
+		"json with whitespace": {[]byte(" \n\t\r\n{\"command_id\":\"account.open\"}\n"), ContentTypeJSON},
+		"protobuf":             {envelope, ContentTypeProtobuf},
+		"protobuf like json":   {tricky, ContentTypeProtobuf},
+		"empty":                {nil, ContentTypeProtobuf},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, DetectContentType(tc.data))
+		})
+	}
+}
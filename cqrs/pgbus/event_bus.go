@@ -0,0 +1,239 @@
+// Package pgbus implements cqrs.EventBus on top of Postgres LISTEN/NOTIFY.
+//
+// Notifications carry events in the shape of a row of events table serialized to JSON
+// (see notify_new_event trigger in schema.sql), so events stored by Postgres event store
+// are delivered to subscribers without being published explicitly.
+package pgbus
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+
+	"github.com/delicb/toy-cqrs/cqrs"
+)
+
+// DefaultChannel is channel events table trigger notifies about new events.
+const DefaultChannel = "new_event"
+
+// defaultReconnectDelay is time to wait before listening for notifications again after connection failure.
+const defaultReconnectDelay = 2 * time.Second
+
+// eventRow is event in the shape of a row of events table.
+type eventRow struct {
+	Position      int64           `json:"position"`
+	AggregateID   string          `json:"aggregate_id"`
+	AggregateType string          `json:"aggregate_type"`
+	CreatedAt     time.Time       `json:"created_at"`
+	CorrelationID string          `json:"correlation_id"`
+	Version       int             `json:"version"`
+	EventID       cqrs.EventID    `json:"event_id"`
+	SchemaVersion int             `json:"schema_version"`
+	Data          json.RawMessage `json:"data"`
+	Metadata      json.RawMessage `json:"metadata"`
+}
+
+type subscription struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Unsubscribe stops listening and waits for handler to return.
+func (s *subscription) Unsubscribe() error {
+	s.cancel()
+	<-s.done
+	return nil
+}
+
+type eventBus struct {
+	pool           *pgxpool.Pool
+	channel        string
+	serializer     cqrs.EventSerializer
+	reconnectDelay time.Duration
+
+	mu            sync.Mutex
+	reconnectHook func()
+}
+
+// NewEventBus returns cqrs.EventBus delivering events notified on provided channel, decoded
+// with provided serializer. Each subscription holds one connection from provided pool.
+func NewEventBus(pool *pgxpool.Pool, channel string, serializer cqrs.EventSerializer) *eventBus {
+	return &eventBus{
+		pool:           pool,
+		channel:        channel,
+		serializer:     serializer,
+		reconnectDelay: defaultReconnectDelay,
+	}
+}
+
+// SetReconnectHook sets function called every time listening is restored after connection
+// failure. Notifications sent while connection was down are lost, so subscribers that must not
+// miss events can use it to read them from the store.
+func (b *eventBus) SetReconnectHook(f func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.reconnectHook = f
+}
+
+// SetReconnectDelay sets time to wait before listening again after connection failure.
+func (b *eventBus) SetReconnectDelay(d time.Duration) {
+	b.reconnectDelay = d
+}
+
+// Publish sends notification with provided event, as if it was stored to events table.
+func (b *eventBus) Publish(ctx context.Context, ev *cqrs.Event) error {
+	payload, err := b.marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = b.pool.Exec(ctx, `SELECT pg_notify($1, $2)`, b.channel, string(payload))
+	return err
+}
+
+// Subscribe starts listening for notifications in background, reconnecting in case of
+// connection failure. Events are delivered to handler one at the time, in order they were notified.
+// Notifications that can not be decoded are logged and skipped.
+func (b *eventBus) Subscribe(ctx context.Context, filter cqrs.EventFilter, h cqrs.EventHandler) (cqrs.Subscription, error) {
+	return b.start(ctx, func(payload string) {
+		ev, err := b.unmarshal([]byte(payload))
+		if err != nil {
+			log.Printf("ERROR: failed to decode notified event: %v\n", err)
+			return
+		}
+		cqrs.HandleEvent(ctx, filter, h, ev)
+	}, b.callReconnectHook)
+}
+
+// Watch starts listening for notifications in background and calls notify for each of them,
+// without decoding events in them, so it is called even for events this bus can not decode.
+// Notifications sent while connection was down are lost, so notify is also called every time
+// listening is restored after connection failure. It suits subscribers that read events
+// from the store and only need to know when to do it.
+func (b *eventBus) Watch(ctx context.Context, notify func()) (cqrs.Subscription, error) {
+	return b.start(ctx, func(string) { notify() }, notify)
+}
+
+// start calls handle with payload of every notification in background, until returned subscription is cancelled.
+func (b *eventBus) start(ctx context.Context, handle func(payload string), reconnected func()) (cqrs.Subscription, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	sub := &subscription{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(sub.done)
+		b.listen(ctx, handle, reconnected)
+	}()
+	return sub, nil
+}
+
+func (b *eventBus) callReconnectHook() {
+	b.mu.Lock()
+	hook := b.reconnectHook
+	b.mu.Unlock()
+	if hook != nil {
+		hook()
+	}
+}
+
+// listen calls handle for every notification until context is done, and reconnected
+// every time listening is restored after connection failure.
+func (b *eventBus) listen(ctx context.Context, handle func(payload string), reconnected func()) {
+	for {
+		err := b.listenOnce(ctx, handle)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Println("--> error listening for events, reconnecting:", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(b.reconnectDelay):
+		}
+		reconnected()
+	}
+}
+
+func (b *eventBus) listenOnce(ctx context.Context, handle func(payload string)) error {
+	conn, err := b.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, "listen "+b.channel)
+	if err != nil {
+		return err
+	}
+
+	for {
+		// blocks
+		notification, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		if notification.Channel != b.channel {
+			log.Println("got message from unexpected channel:", notification.Channel)
+			continue
+		}
+		handle(notification.Payload)
+	}
+}
+
+func (b *eventBus) marshal(ev *cqrs.Event) ([]byte, error) {
+	data, err := b.serializer.MarshalData(ev)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := b.serializer.MarshalMetadata(ev)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&eventRow{
+		Position:      ev.Position,
+		AggregateID:   ev.AggregateID,
+		AggregateType: ev.AggregateType,
+		CreatedAt:     ev.CreatedAt,
+		CorrelationID: ev.CorrelationID,
+		Version:       ev.Version,
+		EventID:       ev.EventID,
+		SchemaVersion: b.serializer.SchemaVersion(ev.EventID),
+		Data:          data,
+		Metadata:      metadata,
+	})
+}
+
+func (b *eventBus) unmarshal(payload []byte) (*cqrs.Event, error) {
+	row := &eventRow{}
+	if err := json.Unmarshal(payload, row); err != nil {
+		return nil, err
+	}
+	ev := &cqrs.Event{
+		EventID:       row.EventID,
+		AggregateID:   row.AggregateID,
+		AggregateType: row.AggregateType,
+		CreatedAt:     row.CreatedAt,
+		CorrelationID: row.CorrelationID,
+		Version:       row.Version,
+		Position:      row.Position,
+	}
+	var err error
+	if ev.Data, err = b.serializer.UnmarshalData(row.EventID, row.SchemaVersion, row.Data); err != nil {
+		return nil, err
+	}
+	ev.SchemaVersion = b.serializer.SchemaVersion(ev.EventID)
+	if len(row.Metadata) > 0 {
+		if err := b.serializer.UnmarshalMetadata(row.Metadata, ev); err != nil {
+			return nil, err
+		}
+	}
+	return ev, nil
+}
+
+var _ cqrs.EventBus = &eventBus{}
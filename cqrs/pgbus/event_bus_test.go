@@ -0,0 +1,62 @@
+package pgbus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/delicb/toy-cqrs/cqrs"
+)
+
+const accountOpenedID cqrs.EventID = "account.opened"
+
+type accountOpened struct {
+	Owner string `json:"owner"`
+}
+
+func newTestBus() *eventBus {
+	s := cqrs.NewEventJSONSerializer()
+	s.RegisterDataCtor(accountOpenedID, func() interface{} { return &accountOpened{} })
+	return NewEventBus(nil, DefaultChannel, s)
+}
+
+// notification is payload sent by notify_new_event trigger, row_to_json of events table row.
+const notification = `{"position":42,"aggregate_id":"0b4c8a52-4d0e-4a44-a3a3-5d1e7a8f0c11","aggregate_type":"account",
+	"created_at":"2021-05-01T12:00:00.123456+00:00","correlation_id":"6f1d7c0e-2f55-4c1b-9d7b-1a6a9d2f3e44",
+	"version":1,"event_id":"account.opened","schema_version":1,"data":{"owner":"john"},
+	"metadata":{"command_id":"account.open","actor":"admin"}}`
+
+func TestUnmarshalNotifiedRow(t *testing.T) {
+	ev, err := newTestBus().unmarshal([]byte(notification))
+	require.NoError(t, err)
+	assert.Equal(t, int64(42), ev.Position)
+	assert.Equal(t, accountOpenedID, ev.EventID)
+	assert.Equal(t, "account", ev.AggregateType)
+	assert.Equal(t, time.Date(2021, 5, 1, 12, 0, 0, 123456000, time.UTC), ev.CreatedAt.UTC())
+	assert.Equal(t, &accountOpened{Owner: "john"}, ev.Data)
+	assert.Equal(t, cqrs.CommandID("account.open"), ev.CommandID)
+	assert.Equal(t, "admin", ev.Actor)
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	bus := newTestBus()
+	ev := &cqrs.Event{
+		EventID:       accountOpenedID,
+		AggregateID:   "0b4c8a52-4d0e-4a44-a3a3-5d1e7a8f0c11",
+		AggregateType: "account",
+		CreatedAt:     time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC),
+		CorrelationID: "6f1d7c0e-2f55-4c1b-9d7b-1a6a9d2f3e44",
+		Version:       3,
+		Position:      42,
+		SchemaVersion: 1,
+		Data:          &accountOpened{Owner: "john"},
+		CausationID:   "cause",
+	}
+	payload, err := bus.marshal(ev)
+	require.NoError(t, err)
+	decoded, err := bus.unmarshal(payload)
+	require.NoError(t, err)
+	assert.Equal(t, ev, decoded)
+}
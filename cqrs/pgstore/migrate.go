@@ -0,0 +1,140 @@
+package pgstore
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migration is single step of bringing database schema up to date.
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// migrationParams are values available to migration templates.
+type migrationParams struct {
+	// Table is quoted and schema qualified name of events table.
+	Table string
+	// Name is unquoted name of events table, used as prefix of names of constraints and indexes.
+	Name string
+	// Sequence is quoted and schema qualified name of sequence assigning positions.
+	Sequence string
+	// Function is quoted and schema qualified name of function sending notifications.
+	Function string
+	// Channel is notification channel.
+	Channel string
+}
+
+var migrationFuncs = template.FuncMap{
+	// ident returns quoted identifier made of provided parts
+	"ident": func(parts ...string) string {
+		return pgx.Identifier{strings.Join(parts, "")}.Sanitize()
+	},
+	// literal returns quoted string literal
+	"literal": func(s string) string {
+		return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+	},
+}
+
+// migrations returns migrations for provided options, ordered by version.
+func migrations(opts Options) ([]migration, error) {
+	params := migrationParams{
+		Table:    opts.qualified(opts.Table),
+		Name:     opts.Table,
+		Sequence: opts.qualified(opts.Table + "_position_seq"),
+		Function: opts.qualified("notify_new_event"),
+		Channel:  opts.NotifyChannel,
+	}
+
+	files, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	result := make([]migration, 0, len(files))
+	for _, file := range files {
+		name := strings.TrimSuffix(strings.TrimPrefix(file, "migrations/"), ".sql")
+		version, err := strconv.Atoi(strings.SplitN(name, "_", 2)[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration name %v: %w", file, err)
+		}
+		t, err := template.New(name).Funcs(migrationFuncs).ParseFS(migrationFiles, file)
+		if err != nil {
+			return nil, err
+		}
+		var sql strings.Builder
+		if err := t.ExecuteTemplate(&sql, strings.TrimPrefix(file, "migrations/"), params); err != nil {
+			return nil, err
+		}
+		result = append(result, migration{version: version, name: name, sql: sql.String()})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].version < result[j].version })
+	return result, nil
+}
+
+// Migrate creates or updates tables used by event store. Applied migrations are recorded in
+// table named like events table with "_migrations" suffix, so it is safe to call Migrate
+// every time service starts, even from several instances at once.
+func (s *store) Migrate(ctx context.Context) error {
+	pending, err := migrations(s.opts)
+	if err != nil {
+		return err
+	}
+	migrationsTable := s.opts.qualified(s.opts.Table + "_migrations")
+
+	return s.db.BeginFunc(ctx, func(tx pgx.Tx) error {
+		// instances starting at the same time wait for each other, instead of
+		// applying the same migrations
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, s.opts.MigrateLockID); err != nil {
+			return err
+		}
+		if s.opts.Schema != "" {
+			if _, err := tx.Exec(ctx, `CREATE SCHEMA IF NOT EXISTS `+pgx.Identifier{s.opts.Schema}.Sanitize()); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(ctx, `
+			CREATE TABLE IF NOT EXISTS `+migrationsTable+` (
+				version integer not null,
+				name varchar(128) not null,
+				applied_at timestamp with time zone not null,
+				primary key(version)
+			)`)
+		if err != nil {
+			return err
+		}
+
+		var current int
+		err = tx.QueryRow(ctx, `SELECT coalesce(max(version), 0) FROM `+migrationsTable).Scan(&current)
+		if err != nil {
+			return err
+		}
+		for _, m := range pending {
+			if m.version <= current {
+				continue
+			}
+			if _, err := tx.Exec(ctx, m.sql); err != nil {
+				return fmt.Errorf("migration %v failed: %w", m.name, err)
+			}
+			_, err := tx.Exec(ctx,
+				`INSERT INTO `+migrationsTable+` (version, name, applied_at) VALUES ($1, $2, $3)`,
+				m.version, m.name, time.Now().UTC())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,46 @@
+package pgstore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrationsAreOrdered(t *testing.T) {
+	ms, err := migrations(Options{}.withDefaults())
+	require.NoError(t, err)
+	require.NotEmpty(t, ms)
+	for i, m := range ms {
+		assert.Equal(t, i+1, m.version, m.name)
+	}
+}
+
+func TestMigrationsUseConfiguredNames(t *testing.T) {
+	ms, err := migrations(Options{
+		Schema:        "billing",
+		Table:         "invoice_events",
+		NotifyChannel: "new_invoice_event",
+	}.withDefaults())
+	require.NoError(t, err)
+
+	var all string
+	for _, m := range ms {
+		all += m.sql
+	}
+	assert.Contains(t, all, `create table if not exists "billing"."invoice_events"`)
+	assert.Contains(t, all, `constraint "invoice_events_agg_version_uniq"`)
+	assert.Contains(t, all, `execute procedure "billing"."notify_new_event"('new_invoice_event')`)
+	assert.Contains(t, all, `nextval('"billing"."invoice_events_position_seq"')`)
+	assert.NotContains(t, all, `"events"`)
+}
+
+func TestMigrationDoesNotUseAppendLock(t *testing.T) {
+	opts := Options{}.withDefaults()
+	assert.NotEqual(t, opts.AppendLockID, opts.MigrateLockID)
+}
+
+func TestTableIsQualified(t *testing.T) {
+	assert.Equal(t, `"events"`, NewEventStore(nil, nil, Options{}).Table())
+	assert.Equal(t, `"billing"."invoice_events"`, NewEventStore(nil, nil, Options{Schema: "billing", Table: "invoice_events"}).Table())
+}
@@ -0,0 +1,18 @@
+-- events, global order is given by position, see appending lock in event store
+create table if not exists {{.Table}} (
+	position bigserial not null,
+	aggregate_id uuid not null,
+	aggregate_type varchar(64) not null,
+	created_at timestamp with time zone not null,
+	correlation_id uuid not null,
+	version integer not null,
+	event_id varchar(64) not null,
+	-- version of the structure of data, older versions are upgraded when read
+	schema_version integer not null default 1,
+	data jsonb not null,
+	-- command_id, causation_id, actor and custom headers, see cqrs.Event
+	metadata jsonb not null default '{}',
+	-- optimistic concurrency control, only one writer can append given version of an aggregate
+	constraint {{ident .Name "_agg_version_uniq"}} unique (aggregate_id, version),
+	primary key(position)
+);
@@ -0,0 +1,2 @@
+-- used for loading events of specific types, see LoadByEventID
+create index if not exists {{ident .Name "_event_id_idx"}} on {{.Table}} (event_id);
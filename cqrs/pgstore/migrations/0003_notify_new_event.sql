@@ -0,0 +1,23 @@
+-- sends row of each inserted event as notification on channel provided as trigger
+-- argument, allowing services to LISTEN for new events (see cqrs/pgbus)
+create or replace function {{.Function}} ()
+  returns trigger
+  language plpgsql
+as $$
+declare
+  channel text := TG_ARGV[0];
+begin
+  perform (
+    select pg_notify(channel, row_to_json(NEW)::text)
+  );
+  return null;
+end;
+$$;
+
+drop trigger if exists notify_new_event on {{.Table}};
+
+create trigger notify_new_event
+  after insert
+  on {{.Table}}
+  for each row
+  execute procedure {{.Function}}({{literal .Channel}});
@@ -0,0 +1,33 @@
+-- events tables created before aggregate versions were introduced have no position, version,
+-- schema_version and metadata columns (create table in the first migration leaves them as they are),
+-- existing events get versions per aggregate and positions in order they were created in
+do $$
+begin
+  if not exists (select 1 from pg_attribute
+                 where attrelid = {{literal .Table}}::regclass and attname = 'version' and not attisdropped) then
+    alter table {{.Table}} add column version integer;
+    update {{.Table}} e set version = v.version
+      from (select ctid, row_number() over (partition by aggregate_id order by created_at, ctid) as version
+            from {{.Table}}) v
+      where e.ctid = v.ctid;
+    alter table {{.Table}} alter column version set not null;
+    alter table {{.Table}} add constraint {{ident .Name "_agg_version_uniq"}} unique (aggregate_id, version);
+  end if;
+
+  if not exists (select 1 from pg_attribute
+                 where attrelid = {{literal .Table}}::regclass and attname = 'position' and not attisdropped) then
+    alter table {{.Table}} add column position bigint;
+    create sequence if not exists {{.Sequence}} owned by {{.Table}}.position;
+    update {{.Table}} e set position = p.position
+      from (select ctid, row_number() over (order by created_at, ctid) as position from {{.Table}}) p
+      where e.ctid = p.ctid;
+    perform setval({{literal .Sequence}}, coalesce((select max(position) from {{.Table}}), 0) + 1, false);
+    alter table {{.Table}} alter column position set default nextval({{literal .Sequence}});
+    alter table {{.Table}} alter column position set not null;
+    alter table {{.Table}} add primary key (position);
+  end if;
+end
+$$;
+
+alter table {{.Table}} add column if not exists schema_version integer not null default 1;
+alter table {{.Table}} add column if not exists metadata jsonb not null default '{}';
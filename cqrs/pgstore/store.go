@@ -0,0 +1,270 @@
+// Package pgstore implements cqrs.EventStore on top of Postgres database.
+//
+// Events of all aggregates are kept in a single table (events by default, see Options),
+// created by Migrate, along with trigger that notifies about new events (see cqrs/pgbus).
+// Store uses connection pool and is safe for concurrent use. Appending events is serialized
+// with advisory lock, so positions of events are committed in the same order they are
+// assigned in and readers of all events never skip over an event.
+package pgstore
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+
+	"github.com/delicb/toy-cqrs/cqrs"
+)
+
+const (
+	// DefaultTable is name of events table, if not provided in Options.
+	DefaultTable = "events"
+	// DefaultNotifyChannel is channel new events are sent to, if not provided in Options.
+	DefaultNotifyChannel = "new_event"
+	// DefaultAppendLockID is key of advisory lock held while appending events, if not provided in Options.
+	DefaultAppendLockID = 7_340_001
+	// DefaultMigrateLockID is key of advisory lock held while migrating, if not provided in Options.
+	DefaultMigrateLockID = 7_340_003
+)
+
+// uniqueViolationCode is postgres error code returned when unique constraint is violated.
+const uniqueViolationCode = "23505"
+
+// Options configures where events are stored.
+type Options struct {
+	// Schema is postgres schema of events table, schema from search_path is used if empty.
+	Schema string
+	// Table is name of events table, DefaultTable if empty.
+	Table string
+	// NotifyChannel is channel trigger sends new events to, DefaultNotifyChannel if empty.
+	NotifyChannel string
+	// AppendLockID is key of advisory lock held while appending events, DefaultAppendLockID if 0.
+	// Stores using different tables in the same database can use different locks.
+	AppendLockID int64
+	// MigrateLockID is key of advisory lock held while migrating, DefaultMigrateLockID if 0.
+	// It differs from AppendLockID, so that migrating does not block appending events.
+	MigrateLockID int64
+}
+
+func (o Options) withDefaults() Options {
+	if o.Table == "" {
+		o.Table = DefaultTable
+	}
+	if o.NotifyChannel == "" {
+		o.NotifyChannel = DefaultNotifyChannel
+	}
+	if o.AppendLockID == 0 {
+		o.AppendLockID = DefaultAppendLockID
+	}
+	if o.MigrateLockID == 0 {
+		o.MigrateLockID = DefaultMigrateLockID
+	}
+	return o
+}
+
+// qualified returns quoted name of provided table (or function) in configured schema.
+func (o Options) qualified(name string) string {
+	if o.Schema == "" {
+		return pgx.Identifier{name}.Sanitize()
+	}
+	return pgx.Identifier{o.Schema, name}.Sanitize()
+}
+
+// TxHook is called for each event in transaction it is being stored in, e.g. to store
+// something else atomically with events. Error returned by hook aborts saving.
+type TxHook func(ctx context.Context, tx pgx.Tx, ev *cqrs.Event) error
+
+type store struct {
+	db         *pgxpool.Pool
+	serializer cqrs.EventSerializer
+	opts       Options
+	table      string
+
+	mu             sync.RWMutex
+	beforeCommit   []TxHook
+	afterSaveHooks []cqrs.EventHook
+}
+
+// NewEventStore returns cqrs.EventStore keeping events in database behind provided pool,
+// serialized with provided serializer. Tables have to be created with Migrate first.
+func NewEventStore(db *pgxpool.Pool, serializer cqrs.EventSerializer, opts Options) *store {
+	opts = opts.withDefaults()
+	return &store{
+		db:         db,
+		serializer: serializer,
+		opts:       opts,
+		table:      opts.qualified(opts.Table),
+	}
+}
+
+// Table returns quoted, schema qualified name of events table, for queries that have to
+// refer to it outside of the store (e.g. to lock it).
+func (s *store) Table() string {
+	return s.table
+}
+
+func (s *store) selectEvents() string {
+	return `SELECT position, aggregate_id, aggregate_type, created_at, correlation_id, version, event_id, schema_version, data, metadata
+		FROM ` + s.table
+}
+
+func (s *store) Load(ctx context.Context, aggregateID string) ([]*cqrs.Event, error) {
+	rows, err := s.db.Query(ctx,
+		s.selectEvents()+` WHERE aggregate_id = $1 ORDER BY version ASC`, aggregateID)
+	if err != nil {
+		return nil, err
+	}
+	return s.rowsToEvents(rows)
+}
+
+func (s *store) LoadAfter(ctx context.Context, aggregateID string, version int) ([]*cqrs.Event, error) {
+	rows, err := s.db.Query(ctx,
+		s.selectEvents()+` WHERE aggregate_id = $1 AND version > $2 ORDER BY version ASC`, aggregateID, version)
+	if err != nil {
+		return nil, err
+	}
+	return s.rowsToEvents(rows)
+}
+
+func (s *store) ReadAll(ctx context.Context, fromPosition int64, limit int) ([]*cqrs.Event, error) {
+	// NULL limit means no limit
+	var limitArg *int
+	if limit > 0 {
+		limitArg = &limit
+	}
+	rows, err := s.db.Query(ctx,
+		s.selectEvents()+` WHERE position > $1 ORDER BY position ASC LIMIT $2`, fromPosition, limitArg)
+	if err != nil {
+		return nil, err
+	}
+	return s.rowsToEvents(rows)
+}
+
+// LoadByEventID returns all events with one of provided event IDs, in order they were stored in.
+func (s *store) LoadByEventID(ctx context.Context, eventIDs ...cqrs.EventID) ([]*cqrs.Event, error) {
+	IDs := make([]string, len(eventIDs))
+	for i, ID := range eventIDs {
+		IDs[i] = string(ID)
+	}
+	rows, err := s.db.Query(ctx,
+		s.selectEvents()+` WHERE event_id = ANY($1) ORDER BY position ASC`, IDs)
+	if err != nil {
+		return nil, err
+	}
+	return s.rowsToEvents(rows)
+}
+
+func (s *store) Save(ctx context.Context, events []*cqrs.Event) error {
+	s.mu.RLock()
+	beforeCommit := s.beforeCommit
+	afterSave := s.afterSaveHooks
+	s.mu.RUnlock()
+
+	txErr := s.db.BeginFunc(ctx, func(tx pgx.Tx) error {
+		// writers are serialized, so positions are committed in the same order they are
+		// assigned in, otherwise readers of all events could skip over a position
+		// that was assigned, but not yet committed
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, s.opts.AppendLockID); err != nil {
+			return err
+		}
+		for _, ev := range events {
+			// fail early with useful error if aggregate has moved on, unique constraint
+			// on (aggregate_id, version) catches the rest (concurrent transactions)
+			var current int
+			err := tx.QueryRow(ctx,
+				`SELECT coalesce(max(version), 0) FROM `+s.table+` WHERE aggregate_id = $1`, ev.AggregateID,
+			).Scan(&current)
+			if err != nil {
+				return err
+			}
+			if ev.Version != current+1 {
+				return cqrs.NewConcurrencyConflictError(ev.AggregateID, ev.Version-1, current)
+			}
+
+			data, err := s.serializer.MarshalData(ev)
+			if err != nil {
+				return err
+			}
+			metadata, err := s.serializer.MarshalMetadata(ev)
+			if err != nil {
+				return err
+			}
+			ev.SchemaVersion = s.serializer.SchemaVersion(ev.EventID)
+			err = tx.QueryRow(ctx, `
+				INSERT INTO `+s.table+`
+					(aggregate_id, aggregate_type, created_at, correlation_id, version, event_id, schema_version, data, metadata)
+				VALUES
+					($1, $2, $3, $4, $5, $6, $7, $8, $9)
+				RETURNING position`,
+				ev.AggregateID, ev.AggregateType, ev.CreatedAt, ev.CorrelationID, ev.Version, ev.EventID, ev.SchemaVersion, data, metadata,
+			).Scan(&ev.Position)
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) && pgErr.Code == uniqueViolationCode {
+				return cqrs.NewConcurrencyConflictError(ev.AggregateID, ev.Version-1, ev.Version)
+			}
+			if err != nil {
+				return err
+			}
+
+			for _, h := range beforeCommit {
+				if err := h(ctx, tx, ev); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if txErr != nil {
+		return txErr
+	}
+
+	// call save hooks
+	for _, ev := range events {
+		for _, h := range afterSave {
+			h(ev)
+		}
+	}
+	return nil
+}
+
+// AddBeforeCommitHook adds a function to be called for each event in transaction it is stored in.
+func (s *store) AddBeforeCommitHook(h TxHook) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.beforeCommit = append(s.beforeCommit, h)
+}
+
+// AddAfterSaveHook add a function to be called when event is saved.
+func (s *store) AddAfterSaveHook(h cqrs.EventHook) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.afterSaveHooks = append(s.afterSaveHooks, h)
+}
+
+func (s *store) rowsToEvents(rows pgx.Rows) ([]*cqrs.Event, error) {
+	defer rows.Close()
+	events := make([]*cqrs.Event, 0)
+	for rows.Next() {
+		ev := &cqrs.Event{}
+		var data []byte
+		var metadata []byte
+		if err := rows.Scan(&ev.Position, &ev.AggregateID, &ev.AggregateType, &ev.CreatedAt,
+			&ev.CorrelationID, &ev.Version, &ev.EventID, &ev.SchemaVersion, &data, &metadata); err != nil {
+			return nil, err
+		}
+		// data is upgraded to current schema version, if it was stored in older one
+		var err error
+		if ev.Data, err = s.serializer.UnmarshalData(ev.EventID, ev.SchemaVersion, data); err != nil {
+			return nil, err
+		}
+		ev.SchemaVersion = s.serializer.SchemaVersion(ev.EventID)
+		if err := s.serializer.UnmarshalMetadata(metadata, ev); err != nil {
+			return nil, err
+		}
+		events = append(events, ev)
+	}
+	return events, rows.Err()
+}
@@ -0,0 +1,389 @@
+package cqrs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ProcessManager (also known as saga) describes long-running workflow that reacts to events
+// by issuing commands, e.g. sending verification email after user is created. Each instance
+// of a workflow is identified by correlation ID of events it reacts to and has its own state,
+// which is persisted between events.
+type ProcessManager interface {
+	// Name uniquely identifies process manager. It is used to store its state and as name
+	// of its checkpoint, when hosted by projector.
+	Name() string
+
+	// NewState returns pointer to empty state of a process instance. State is persisted as JSON.
+	NewState() interface{}
+
+	// Handlers returns handler for each event process manager is interested in.
+	Handlers() map[EventID]ProcessHandler
+}
+
+// ProcessTimeouts is implemented by process managers that schedule timeouts
+// (see ProcessContext.ScheduleTimeout). It returns handler for each timeout name.
+type ProcessTimeouts interface {
+	Timeouts() map[string]ProcessTimeoutHandler
+}
+
+// ProcessHandler reacts to an event on behalf of process instance described by ProcessContext.
+type ProcessHandler func(ctx context.Context, p *ProcessContext, ev *Event) error
+
+// ProcessTimeoutHandler reacts to expired timeout of process instance described by ProcessContext.
+type ProcessTimeoutHandler func(ctx context.Context, p *ProcessContext) error
+
+// ProcessContext gives handlers access to state of process instance and lets them issue
+// commands, schedule timeouts and complete the process.
+type ProcessContext struct {
+	CorrelationID string
+
+	// State is value returned by ProcessManager.NewState, populated with persisted state.
+	// Changes made by handler are persisted once it returns.
+	State interface{}
+
+	commands  []Command
+	timeouts  map[string]time.Time
+	completed bool
+}
+
+// Send queues command to be sent through command bus once handler returns successfully.
+func (c *ProcessContext) Send(cmd Command) {
+	c.commands = append(c.commands, cmd)
+}
+
+// ScheduleTimeout schedules timeout with provided name to expire at provided time,
+// replacing previously scheduled timeout with the same name, if any.
+func (c *ProcessContext) ScheduleTimeout(name string, at time.Time) {
+	c.timeouts[name] = at.UTC()
+}
+
+// CancelTimeout cancels timeout with provided name, if it is scheduled.
+func (c *ProcessContext) CancelTimeout(name string) {
+	delete(c.timeouts, name)
+}
+
+// Complete marks process instance as finished. Events and timeouts of completed
+// process instances are ignored.
+func (c *ProcessContext) Complete() {
+	c.completed = true
+}
+
+// ProcessState is persisted state of a process instance.
+type ProcessState struct {
+	Process       string
+	CorrelationID string
+
+	// Version is incremented every time state is saved, and is used by process stores
+	// to detect concurrent modifications.
+	Version int
+
+	// Position is position of the last event handled by process instance, events at or
+	// before it are already handled and are skipped when delivered again.
+	Position int64
+
+	Data      []byte
+	Timeouts  map[string]time.Time
+	Completed bool
+	UpdatedAt time.Time
+}
+
+// ProcessStore is description of persistence for process instances.
+type ProcessStore interface {
+	// Load returns state of process instance, or nil if there is none.
+	Load(ctx context.Context, process, correlationID string) (*ProcessState, error)
+
+	// Save persists state of process instance. Version of provided state has to be one above
+	// the stored one (or 1 for new instance), otherwise error matching ErrConcurrencyConflict is returned.
+	Save(ctx context.Context, state *ProcessState) error
+
+	// DueTimeouts returns states of not completed instances of process with at least
+	// one timeout expiring at or before provided time.
+	DueTimeouts(ctx context.Context, process string, now time.Time) ([]*ProcessState, error)
+}
+
+const defaultProcessTimeoutInterval = 1 * time.Second
+
+type processRunner struct {
+	manager  ProcessManager
+	store    ProcessStore
+	bus      CommandBus
+	interval time.Duration
+}
+
+// Name returns name of hosted process manager, so that runner can be registered to projector.
+func (r *processRunner) Name() string { return r.manager.Name() }
+
+// Handlers returns event handlers for all events hosted process manager is interested in.
+// Together with Name, this makes runner a Projection, so it can be registered to projector,
+// which feeds it events and keeps track of its checkpoint.
+func (r *processRunner) Handlers() map[EventID]EventHandler {
+	handlers := make(map[EventID]EventHandler)
+	for ID, h := range r.manager.Handlers() {
+		h := h
+		handlers[ID] = func(ctx context.Context, ev *Event) error {
+			return r.HandleEvent(ctx, ev, h)
+		}
+	}
+	return handlers
+}
+
+// HandleEvent passes event to provided handler on behalf of process instance with event's
+// correlation ID, sends commands it issued and persists changed state. Events already handled
+// by process instance are skipped. Commands are sent before state is saved, with idempotency
+// keys derived from event, so if saving fails and event is handled again, repeated commands
+// can be recognized by idempotent command handler.
+func (r *processRunner) HandleEvent(ctx context.Context, ev *Event, h ProcessHandler) error {
+	if ev.CorrelationID == "" {
+		return nil
+	}
+	state, err := r.load(ctx, ev.CorrelationID)
+	if err != nil {
+		return err
+	}
+	if state.Completed || (ev.Position > 0 && ev.Position <= state.Position) {
+		return nil
+	}
+
+	causationID := fmt.Sprintf("%s/%d", ev.AggregateID, ev.Version)
+	err = r.run(ctx, state, causationID, func(p *ProcessContext) error {
+		return h(ctx, p, ev)
+	})
+	if err != nil {
+		return fmt.Errorf("process %v (%v) failed to handle event %v: %w", r.manager.Name(), ev.CorrelationID, ev.EventID, err)
+	}
+	if ev.Position > state.Position {
+		state.Position = ev.Position
+	}
+	return r.save(ctx, state)
+}
+
+// HandleTimeouts calls handlers of all timeouts that expired at or before provided time.
+func (r *processRunner) HandleTimeouts(ctx context.Context, now time.Time) error {
+	timeouts, ok := r.manager.(ProcessTimeouts)
+	if !ok {
+		return nil
+	}
+	handlers := timeouts.Timeouts()
+
+	states, err := r.store.DueTimeouts(ctx, r.manager.Name(), now)
+	if err != nil {
+		return err
+	}
+	for _, state := range states {
+		// handle timeouts in order they expired in
+		names := make([]string, 0, len(state.Timeouts))
+		for name, at := range state.Timeouts {
+			if !at.After(now) {
+				names = append(names, name)
+			}
+		}
+		sort.Slice(names, func(i, j int) bool { return state.Timeouts[names[i]].Before(state.Timeouts[names[j]]) })
+
+		for _, name := range names {
+			if state.Completed {
+				break
+			}
+			at := state.Timeouts[name]
+			delete(state.Timeouts, name)
+			h, ok := handlers[name]
+			if !ok {
+				log.Printf("ERROR: process %v has no handler for timeout %v, dropping it\n", r.manager.Name(), name)
+				continue
+			}
+			causationID := fmt.Sprintf("timeout/%s/%d", name, at.UnixNano())
+			err := r.run(ctx, state, causationID, func(p *ProcessContext) error {
+				return h(ctx, p)
+			})
+			if err != nil {
+				return fmt.Errorf("process %v (%v) failed to handle timeout %v: %w", r.manager.Name(), state.CorrelationID, name, err)
+			}
+		}
+		if err := r.save(ctx, state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunTimeouts checks for expired timeouts every interval (see SetTimeoutInterval) until context is done.
+// Errors are logged, and failed timeouts are handled again on the next check.
+func (r *processRunner) RunTimeouts(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := r.HandleTimeouts(ctx, now); err != nil {
+				log.Printf("ERROR: handling timeouts of process %v: %v\n", r.manager.Name(), err)
+			}
+		}
+	}
+}
+
+// SetTimeoutInterval sets how often RunTimeouts checks for expired timeouts.
+func (r *processRunner) SetTimeoutInterval(d time.Duration) {
+	r.interval = d
+}
+
+// load returns persisted state of process instance, or new state, if there is none.
+func (r *processRunner) load(ctx context.Context, correlationID string) (*ProcessState, error) {
+	state, err := r.store.Load(ctx, r.manager.Name(), correlationID)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		state = &ProcessState{
+			Process:       r.manager.Name(),
+			CorrelationID: correlationID,
+		}
+	}
+	if state.Timeouts == nil {
+		state.Timeouts = make(map[string]time.Time)
+	}
+	return state, nil
+}
+
+// run calls handler with context of process instance, sends commands it issued and updates state.
+func (r *processRunner) run(ctx context.Context, state *ProcessState, causationID string, handle func(*ProcessContext) error) error {
+	data := r.manager.NewState()
+	if len(state.Data) > 0 {
+		if err := json.Unmarshal(state.Data, data); err != nil {
+			return err
+		}
+	}
+	p := &ProcessContext{
+		CorrelationID: state.CorrelationID,
+		State:         data,
+		timeouts:      state.Timeouts,
+		completed:     state.Completed,
+	}
+	if err := handle(p); err != nil {
+		return err
+	}
+
+	for i, cmd := range p.commands {
+		if base, ok := cmd.(interface{ GetBaseCommand() *BaseCommand }); ok {
+			b := base.GetBaseCommand()
+			if b.CorrelationID == "" {
+				b.CorrelationID = state.CorrelationID
+			}
+			if b.CausationID == "" {
+				b.CausationID = causationID
+			}
+			if b.IdempotencyKey == "" {
+				b.IdempotencyKey = fmt.Sprintf("%s/%s/%s/%d", r.manager.Name(), state.CorrelationID, causationID, i)
+			}
+		}
+		if err := r.bus.Send(ctx, cmd); err != nil {
+			return fmt.Errorf("sending command %v: %w", cmd.GetCommandID(), err)
+		}
+	}
+
+	newData, err := json.Marshal(p.State)
+	if err != nil {
+		return err
+	}
+	state.Data = newData
+	state.Timeouts = p.timeouts
+	state.Completed = p.completed
+	return nil
+}
+
+func (r *processRunner) save(ctx context.Context, state *ProcessState) error {
+	state.Version++
+	state.UpdatedAt = time.Now().UTC()
+	return r.store.Save(ctx, state)
+}
+
+// NewProcessRunner returns runner that handles events and timeouts on behalf of provided process
+// manager, keeping state of its instances in provided store and sending commands through provided bus.
+// Runner is fed events either by registering it to projector (it implements Projection) or by
+// calling HandleEvent, and timeouts by running RunTimeouts.
+func NewProcessRunner(manager ProcessManager, store ProcessStore, bus CommandBus) *processRunner {
+	return &processRunner{
+		manager:  manager,
+		store:    store,
+		bus:      bus,
+		interval: defaultProcessTimeoutInterval,
+	}
+}
+
+type processKey struct {
+	process       string
+	correlationID string
+}
+
+// inMemoryProcessStore is simple implementation of ProcessStore that keeps states in memory.
+// It is safe for concurrent use, since runner handles events and timeouts concurrently.
+type inMemoryProcessStore struct {
+	mu     sync.Mutex
+	states map[processKey]*ProcessState
+}
+
+func (s *inMemoryProcessStore) Load(_ context.Context, process, correlationID string) (*ProcessState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.states[processKey{process, correlationID}]
+	if !ok {
+		return nil, nil
+	}
+	return copyProcessState(state), nil
+}
+
+func (s *inMemoryProcessStore) Save(_ context.Context, state *ProcessState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := processKey{state.Process, state.CorrelationID}
+	var current int
+	if old, ok := s.states[key]; ok {
+		current = old.Version
+	}
+	if state.Version != current+1 {
+		return NewConcurrencyConflictError(state.CorrelationID, state.Version-1, current)
+	}
+	s.states[key] = copyProcessState(state)
+	return nil
+}
+
+func (s *inMemoryProcessStore) DueTimeouts(_ context.Context, process string, now time.Time) ([]*ProcessState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due []*ProcessState
+	for key, state := range s.states {
+		if key.process != process || state.Completed {
+			continue
+		}
+		for _, at := range state.Timeouts {
+			if !at.After(now) {
+				due = append(due, copyProcessState(state))
+				break
+			}
+		}
+	}
+	return due, nil
+}
+
+// copyProcessState returns copy of state, so that stored state is not changed by handlers.
+func copyProcessState(state *ProcessState) *ProcessState {
+	c := *state
+	c.Timeouts = make(map[string]time.Time, len(state.Timeouts))
+	for name, at := range state.Timeouts {
+		c.Timeouts[name] = at
+	}
+	return &c
+}
+
+// NewInMemoryProcessStore returns ProcessStore implementation that stores process states only in memory.
+func NewInMemoryProcessStore() *inMemoryProcessStore {
+	return &inMemoryProcessStore{
+		states: make(map[processKey]*ProcessState),
+	}
+}
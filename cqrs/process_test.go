@@ -0,0 +1,159 @@
+package cqrs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	accountOpenedID  EventID   = "account.opened"
+	accountClosedID  EventID   = "account.closed"
+	sendReminderID   CommandID = "account.send.reminder"
+	reminderTimeout            = "reminder"
+	reminderInterval           = time.Hour
+)
+
+type reminderState struct {
+	AccountID string `json:"account_id"`
+}
+
+// reminderProcess sends reminder an hour after account is opened, unless it is closed before.
+type reminderProcess struct{}
+
+func (reminderProcess) Name() string          { return "reminder" }
+func (reminderProcess) NewState() interface{} { return &reminderState{} }
+
+func (reminderProcess) Handlers() map[EventID]ProcessHandler {
+	return map[EventID]ProcessHandler{
+		accountOpenedID: func(_ context.Context, p *ProcessContext, ev *Event) error {
+			p.State.(*reminderState).AccountID = ev.AggregateID
+			p.ScheduleTimeout(reminderTimeout, ev.CreatedAt.Add(reminderInterval))
+			return nil
+		},
+		accountClosedID: func(_ context.Context, p *ProcessContext, _ *Event) error {
+			p.CancelTimeout(reminderTimeout)
+			p.Complete()
+			return nil
+		},
+	}
+}
+
+func (reminderProcess) Timeouts() map[string]ProcessTimeoutHandler {
+	return map[string]ProcessTimeoutHandler{
+		reminderTimeout: func(_ context.Context, p *ProcessContext) error {
+			p.Send(&BaseCommand{CommandID: sendReminderID, AggregateID: p.State.(*reminderState).AccountID})
+			p.Complete()
+			return nil
+		},
+	}
+}
+
+type recordingBus struct {
+	sent []Command
+}
+
+func (b *recordingBus) Send(_ context.Context, cmd Command) error {
+	b.sent = append(b.sent, cmd)
+	return nil
+}
+
+func (b *recordingBus) SendAndWait(ctx context.Context, cmd Command) ([]byte, error) {
+	return nil, b.Send(ctx, cmd)
+}
+
+func (b *recordingBus) Subscribe(_ context.Context, _ CommandID, _ CommandHandler) (Subscription, error) {
+	return nil, errors.New("recording bus does not deliver commands")
+}
+
+func newAccountEvent(ID EventID, position int64, at time.Time) *Event {
+	return &Event{
+		EventID:       ID,
+		AggregateID:   "account-1",
+		CorrelationID: "corr-1",
+		Version:       int(position),
+		Position:      position,
+		CreatedAt:     at,
+	}
+}
+
+func handleProcessEvent(t *testing.T, runner *processRunner, ev *Event) {
+	h, ok := runner.Handlers()[ev.EventID]
+	require.True(t, ok)
+	require.NoError(t, h(context.Background(), ev))
+}
+
+func TestProcessTimeoutSendsCommand(t *testing.T) {
+	ctx := context.Background()
+	bus := &recordingBus{}
+	store := NewInMemoryProcessStore()
+	runner := NewProcessRunner(reminderProcess{}, store, bus)
+	opened := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	handleProcessEvent(t, runner, newAccountEvent(accountOpenedID, 1, opened))
+
+	// timeout has not expired yet
+	require.NoError(t, runner.HandleTimeouts(ctx, opened.Add(reminderInterval-time.Second)))
+	assert.Empty(t, bus.sent)
+
+	require.NoError(t, runner.HandleTimeouts(ctx, opened.Add(reminderInterval)))
+	require.Len(t, bus.sent, 1)
+	cmd := bus.sent[0]
+	assert.Equal(t, sendReminderID, cmd.GetCommandID())
+	assert.Equal(t, "account-1", cmd.GetAggregateID())
+	assert.Equal(t, "corr-1", cmd.GetCorrelationID())
+	assert.NotEmpty(t, cmd.GetCausationID())
+	assert.NotEqual(t, "corr-1", cmd.GetIdempotencyKey())
+
+	state, err := store.Load(ctx, "reminder", "corr-1")
+	require.NoError(t, err)
+	assert.True(t, state.Completed)
+	assert.Empty(t, state.Timeouts)
+
+	// completed process does not fire again
+	require.NoError(t, runner.HandleTimeouts(ctx, opened.Add(2*reminderInterval)))
+	assert.Len(t, bus.sent, 1)
+}
+
+func TestProcessCompletedBeforeTimeout(t *testing.T) {
+	ctx := context.Background()
+	bus := &recordingBus{}
+	runner := NewProcessRunner(reminderProcess{}, NewInMemoryProcessStore(), bus)
+	opened := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	handleProcessEvent(t, runner, newAccountEvent(accountOpenedID, 1, opened))
+	handleProcessEvent(t, runner, newAccountEvent(accountClosedID, 2, opened.Add(time.Minute)))
+
+	require.NoError(t, runner.HandleTimeouts(ctx, opened.Add(reminderInterval)))
+	assert.Empty(t, bus.sent)
+}
+
+func TestProcessSkipsHandledEvents(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryProcessStore()
+	runner := NewProcessRunner(reminderProcess{}, store, &recordingBus{})
+	opened := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	handleProcessEvent(t, runner, newAccountEvent(accountOpenedID, 1, opened))
+	// redelivery of the same event does not reschedule timeout
+	handleProcessEvent(t, runner, newAccountEvent(accountOpenedID, 1, opened.Add(time.Minute)))
+
+	state, err := store.Load(ctx, "reminder", "corr-1")
+	require.NoError(t, err)
+	assert.Equal(t, 1, state.Version)
+	assert.Equal(t, opened.Add(reminderInterval), state.Timeouts[reminderTimeout])
+}
+
+func TestInMemoryProcessStoreDetectsConflicts(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryProcessStore()
+	require.NoError(t, store.Save(ctx, &ProcessState{Process: "p", CorrelationID: "c", Version: 1}))
+
+	err := store.Save(ctx, &ProcessState{Process: "p", CorrelationID: "c", Version: 1})
+	assert.ErrorIs(t, err, ErrConcurrencyConflict)
+	assert.NoError(t, store.Save(ctx, &ProcessState{Process: "p", CorrelationID: "c", Version: 2}))
+}
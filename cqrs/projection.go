@@ -0,0 +1,228 @@
+package cqrs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"go.uber.org/multierr"
+)
+
+// Projection builds a read model from events.
+type Projection interface {
+	// Name uniquely identifies projection. It is used as name of its checkpoint.
+	Name() string
+
+	// Handlers returns handler for each event projection is interested in.
+	// Events without handler are skipped.
+	Handlers() map[EventID]EventHandler
+}
+
+// ProjectionStarter is implemented by projections that need to prepare (e.g. create
+// tables or warm up caches) before handling any event.
+type ProjectionStarter interface {
+	Start(ctx context.Context) error
+}
+
+// ProjectionStopper is implemented by projections that need to clean up after
+// they stop handling events.
+type ProjectionStopper interface {
+	Stop(ctx context.Context) error
+}
+
+// ErrorPolicy determines what projector does when projection fails to handle an event.
+type ErrorPolicy int
+
+const (
+	// StopOnError stops projection, leaving checkpoint before failed event,
+	// so it is handled again when projection is started next time.
+	StopOnError ErrorPolicy = iota
+
+	// SkipOnError moves on to the next event, as if failed one was handled.
+	SkipOnError
+
+	// RetryOnError handles failed event again, until it succeeds or projector is stopped.
+	RetryOnError
+)
+
+// ProjectionHook is called every time projection handles an event, with error
+// returned by handler (nil on success).
+type ProjectionHook func(projection string, ev *Event, err error)
+
+const defaultProjectionRetryDelay = 1 * time.Second
+
+type hostedProjection struct {
+	projection    Projection
+	policy        ErrorPolicy
+	notifications chan struct{}
+}
+
+type projector struct {
+	reader      EventReader
+	checkpoints CheckpointStore
+	projections []*hostedProjection
+	hooks       []ProjectionHook
+	retryDelay  time.Duration
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	errs   error
+}
+
+// Register adds projection to be run by projector, with provided error policy.
+// All projections have to be registered before projector is started.
+func (p *projector) Register(projection Projection, policy ErrorPolicy) {
+	p.projections = append(p.projections, &hostedProjection{
+		projection:    projection,
+		policy:        policy,
+		notifications: make(chan struct{}, 1),
+	})
+}
+
+// AddHook adds function to be called after each event handled by any projection.
+func (p *projector) AddHook(h ProjectionHook) {
+	p.hooks = append(p.hooks, h)
+}
+
+// SetRetryDelay sets time to wait before handling event again for projections with RetryOnError policy.
+func (p *projector) SetRetryDelay(d time.Duration) {
+	p.retryDelay = d
+}
+
+// Notify lets all projections know that new events are available, so they don't
+// wait for the next poll of event store.
+func (p *projector) Notify() {
+	for _, hp := range p.projections {
+		select {
+		case hp.notifications <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Start prepares all registered projections and starts handling events in background,
+// each projection from its own checkpoint.
+func (p *projector) Start(ctx context.Context) error {
+	for _, hp := range p.projections {
+		if starter, ok := hp.projection.(ProjectionStarter); ok {
+			if err := starter.Start(ctx); err != nil {
+				return fmt.Errorf("starting projection %v: %w", hp.projection.Name(), err)
+			}
+		}
+	}
+
+	ctx, p.cancel = context.WithCancel(ctx)
+	for _, hp := range p.projections {
+		hp := hp
+		sub := NewCatchUpSubscription(hp.projection.Name(), p.reader, p.checkpoints, p.handler(hp))
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			err := sub.Run(ctx, hp.notifications)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("ERROR: projection %v stopped: %v\n", hp.projection.Name(), err)
+				p.mu.Lock()
+				p.errs = multierr.Append(p.errs, err)
+				p.mu.Unlock()
+			}
+		}()
+	}
+	return nil
+}
+
+// Wait blocks until all projections stop, either because of an error or because projector
+// has been stopped, and returns errors that stopped projections.
+func (p *projector) Wait() error {
+	p.wg.Wait()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.errs
+}
+
+// Stop stops handling events by all projections and waits for them to finish.
+// Returned error contains errors that had stopped projections before, if any.
+// Provided context is passed to projections implementing ProjectionStopper.
+func (p *projector) Stop(ctx context.Context) error {
+	if p.cancel != nil {
+		p.cancel()
+	}
+	err := p.Wait()
+	for _, hp := range p.projections {
+		if stopper, ok := hp.projection.(ProjectionStopper); ok {
+			err = multierr.Append(err, stopper.Stop(ctx))
+		}
+	}
+	return err
+}
+
+// handler dispatches events to handlers of provided projection, applying its error policy.
+func (p *projector) handler(hp *hostedProjection) EventHandler {
+	name := hp.projection.Name()
+	handlers := hp.projection.Handlers()
+	return func(ctx context.Context, ev *Event) error {
+		h, ok := handlers[ev.EventID]
+		if !ok {
+			return nil
+		}
+		for {
+			err := h(ctx, ev)
+			for _, hook := range p.hooks {
+				hook(name, ev, err)
+			}
+			if err == nil {
+				return nil
+			}
+
+			switch hp.policy {
+			case SkipOnError:
+				log.Printf("ERROR: projection %v skipping event %d (%v): %v\n", name, ev.Position, ev.EventID, err)
+				return nil
+			case RetryOnError:
+				log.Printf("ERROR: projection %v retrying event %d (%v): %v\n", name, ev.Position, ev.EventID, err)
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(p.retryDelay):
+				}
+			default:
+				return fmt.Errorf("projection %v failed to handle event %d (%v): %w", name, ev.Position, ev.EventID, err)
+			}
+		}
+	}
+}
+
+// NewProjector returns runner that hosts multiple projections in one process, feeding them
+// events from provided reader and storing their progress in provided checkpoint store.
+// Each projection runs in its own goroutine, so checkpoint store (and hooks) are used concurrently.
+func NewProjector(reader EventReader, checkpoints CheckpointStore) *projector {
+	return &projector{
+		reader:      reader,
+		checkpoints: checkpoints,
+		retryDelay:  defaultProjectionRetryDelay,
+	}
+}
+
+type simpleProjection struct {
+	name     string
+	handlers map[EventID]EventHandler
+}
+
+func (p *simpleProjection) Name() string                       { return p.name }
+func (p *simpleProjection) Handlers() map[EventID]EventHandler { return p.handlers }
+
+// On registers handler for provided event ID, replacing previous one, if any.
+func (p *simpleProjection) On(ID EventID, h EventHandler) *simpleProjection {
+	p.handlers[ID] = h
+	return p
+}
+
+// NewProjection returns Projection with provided name, with handlers to be registered using On.
+func NewProjection(name string) *simpleProjection {
+	return &simpleProjection{
+		name:     name,
+		handlers: make(map[EventID]EventHandler),
+	}
+}
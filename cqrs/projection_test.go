@@ -0,0 +1,48 @@
+package cqrs
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProjectorRunsProjectionsSharingCheckpointStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryEventStore()
+	const events = 50
+	for i := 1; i <= events; i++ {
+		require.NoError(t, store.Save(ctx, []*Event{storeEvent(fmt.Sprintf("account-%d", i), 1)}))
+	}
+
+	checkpoints := NewInMemoryCheckpointStore()
+	p := NewProjector(store, checkpoints)
+	names := []string{"balances", "owners", "statements"}
+	counts := make([]int32, len(names))
+	for i, name := range names {
+		i := i
+		p.Register(NewProjection(name).On(accountOpenedID, func(context.Context, *Event) error {
+			atomic.AddInt32(&counts[i], 1)
+			return nil
+		}), StopOnError)
+	}
+
+	require.NoError(t, p.Start(ctx))
+	require.Eventually(t, func() bool {
+		for _, name := range names {
+			if position, _ := checkpoints.LoadCheckpoint(ctx, name); position != events {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, time.Millisecond)
+	require.NoError(t, p.Stop(ctx))
+
+	for i := range names {
+		assert.EqualValues(t, events, atomic.LoadInt32(&counts[i]), names[i])
+	}
+}
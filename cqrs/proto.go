@@ -0,0 +1,238 @@
+package cqrs
+
+import (
+	"errors"
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/delicb/toy-cqrs/cqrs/cqrspb"
+)
+
+// ProtoConverter is implemented by commands and event data that can be serialized
+// by protobuf serializers.
+type ProtoConverter interface {
+	// ToProto returns protobuf message holding the same information as receiver.
+	// It is also called on empty instances, to get message to unmarshal into.
+	ToProto() proto.Message
+
+	// FromProto populates receiver from message of the type returned by ToProto.
+	FromProto(proto.Message) error
+}
+
+type commandProtoSerializer struct {
+	ctors map[CommandID]func() Command
+}
+
+// NewCommandProtoSerializer is implementation of CommandSerializer that uses protobuf as underlying format.
+// Registered commands have to implement ProtoConverter and embed BaseCommand.
+func NewCommandProtoSerializer() *commandProtoSerializer {
+	return &commandProtoSerializer{
+		ctors: make(map[CommandID]func() Command),
+	}
+}
+
+func (s *commandProtoSerializer) RegisterCommandCtor(ID CommandID, ctor func() Command) {
+	s.ctors[ID] = ctor
+}
+
+func (s *commandProtoSerializer) ContentType() string { return ContentTypeProtobuf }
+
+func (s *commandProtoSerializer) Marshal(cmd Command) ([]byte, error) {
+	converter, ok := cmd.(ProtoConverter)
+	if !ok {
+		return nil, fmt.Errorf("command %T can not be converted to protobuf", cmd)
+	}
+	payload, err := proto.Marshal(converter.ToProto())
+	if err != nil {
+		return nil, err
+	}
+	// GetIdempotencyKey falls back to correlation ID, only explicitly set key is sent
+	idempotencyKey := cmd.GetIdempotencyKey()
+	if base, ok := cmd.(interface{ GetBaseCommand() *BaseCommand }); ok {
+		idempotencyKey = base.GetBaseCommand().IdempotencyKey
+	}
+	return proto.Marshal(&cqrspb.CommandEnvelope{
+		CommandId:      string(cmd.GetCommandID()),
+		AggregateId:    cmd.GetAggregateID(),
+		AggregateType:  cmd.GetAggregateType(),
+		CorrelationId:  cmd.GetCorrelationID(),
+		IdempotencyKey: idempotencyKey,
+		CausationId:    cmd.GetCausationID(),
+		Actor:          cmd.GetActor(),
+		Metadata:       cmd.GetMetadata(),
+		Payload:        payload,
+	})
+}
+
+func (s *commandProtoSerializer) Unmarshal(rawData []byte) (Command, error) {
+	envelope := &cqrspb.CommandEnvelope{}
+	if err := proto.Unmarshal(rawData, envelope); err != nil {
+		return nil, err
+	}
+	if envelope.CommandId == "" {
+		return nil, errors.New("raw data does not contain command_id")
+	}
+	ctor, ok := s.ctors[CommandID(envelope.CommandId)]
+	if !ok {
+		return nil, fmt.Errorf("unknown command ID: %s", envelope.CommandId)
+	}
+	cmd := ctor()
+
+	base, ok := cmd.(interface{ GetBaseCommand() *BaseCommand })
+	if !ok {
+		return nil, fmt.Errorf("command %T does not embed BaseCommand", cmd)
+	}
+	*base.GetBaseCommand() = BaseCommand{
+		CommandID:      CommandID(envelope.CommandId),
+		AggregateID:    envelope.AggregateId,
+		AggregateType:  envelope.AggregateType,
+		CorrelationID:  envelope.CorrelationId,
+		IdempotencyKey: envelope.IdempotencyKey,
+		CausationID:    envelope.CausationId,
+		Actor:          envelope.Actor,
+		Metadata:       envelope.Metadata,
+	}
+
+	converter, ok := cmd.(ProtoConverter)
+	if !ok {
+		return nil, fmt.Errorf("command %T can not be converted from protobuf", cmd)
+	}
+	msg := converter.ToProto()
+	if err := proto.Unmarshal(envelope.Payload, msg); err != nil {
+		return nil, err
+	}
+	return cmd, converter.FromProto(msg)
+}
+
+type eventProtoSerializer struct {
+	ctors map[EventID]func() interface{}
+}
+
+// NewEventProtoSerializer returns instance of EventSerializer that is using protobuf as underlying format.
+// Registered event data has to implement ProtoConverter. Protobuf messages evolve by adding
+// fields with new numbers, instead of upcasting, so schema version of every event is always 1.
+func NewEventProtoSerializer() *eventProtoSerializer {
+	return &eventProtoSerializer{
+		ctors: make(map[EventID]func() interface{}),
+	}
+}
+
+func (e *eventProtoSerializer) RegisterDataCtor(ID EventID, ctor func() interface{}) {
+	e.ctors[ID] = ctor
+}
+
+func (e *eventProtoSerializer) RegisteredData() map[EventID]interface{} {
+	return registeredData(e.ctors)
+}
+
+func (e *eventProtoSerializer) ContentType() string { return ContentTypeProtobuf }
+
+func (e *eventProtoSerializer) SchemaVersion(_ EventID) int { return 1 }
+
+func (e *eventProtoSerializer) Marshal(ev *Event) ([]byte, error) {
+	data, err := e.MarshalData(ev)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(&cqrspb.EventEnvelope{
+		EventId:       string(ev.EventID),
+		AggregateId:   ev.AggregateID,
+		AggregateType: ev.AggregateType,
+		CreatedAt:     timestamppb.New(ev.CreatedAt),
+		CorrelationId: ev.CorrelationID,
+		Version:       int64(ev.Version),
+		Position:      ev.Position,
+		SchemaVersion: int32(e.SchemaVersion(ev.EventID)),
+		Data:          data,
+		Metadata:      eventMetadataToProto(ev),
+	})
+}
+
+func (e *eventProtoSerializer) Unmarshal(rawData []byte) (*Event, error) {
+	envelope := &cqrspb.EventEnvelope{}
+	if err := proto.Unmarshal(rawData, envelope); err != nil {
+		return nil, err
+	}
+	if envelope.EventId == "" {
+		return nil, errors.New("raw event does not contain event_id")
+	}
+	eventID := EventID(envelope.EventId)
+	data, err := e.UnmarshalData(eventID, int(envelope.SchemaVersion), envelope.Data)
+	if err != nil {
+		return nil, err
+	}
+	ev := &Event{
+		EventID:       eventID,
+		AggregateID:   envelope.AggregateId,
+		AggregateType: envelope.AggregateType,
+		CreatedAt:     envelope.CreatedAt.AsTime(),
+		CorrelationID: envelope.CorrelationId,
+		Version:       int(envelope.Version),
+		Position:      envelope.Position,
+		SchemaVersion: e.SchemaVersion(eventID),
+		Data:          data,
+	}
+	eventMetadataFromProto(envelope.Metadata, ev)
+	return ev, nil
+}
+
+func (e *eventProtoSerializer) MarshalData(ev *Event) ([]byte, error) {
+	converter, ok := ev.Data.(ProtoConverter)
+	if !ok {
+		return nil, fmt.Errorf("data %T of event %v can not be converted to protobuf", ev.Data, ev.EventID)
+	}
+	return proto.Marshal(converter.ToProto())
+}
+
+func (e *eventProtoSerializer) UnmarshalData(eventID EventID, _ int, data []byte) (interface{}, error) {
+	ctor, ok := e.ctors[eventID]
+	if !ok {
+		return nil, fmt.Errorf("unknown event ID: %v", eventID)
+	}
+	eventData := ctor()
+	converter, ok := eventData.(ProtoConverter)
+	if !ok {
+		return nil, fmt.Errorf("data %T of event %v can not be converted from protobuf", eventData, eventID)
+	}
+	msg := converter.ToProto()
+	if err := proto.Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+	return eventData, converter.FromProto(msg)
+}
+
+func (e *eventProtoSerializer) MarshalMetadata(ev *Event) ([]byte, error) {
+	return proto.Marshal(eventMetadataToProto(ev))
+}
+
+func (e *eventProtoSerializer) UnmarshalMetadata(data []byte, ev *Event) error {
+	metadata := &cqrspb.EventMetadata{}
+	if err := proto.Unmarshal(data, metadata); err != nil {
+		return err
+	}
+	eventMetadataFromProto(metadata, ev)
+	return nil
+}
+
+func eventMetadataToProto(ev *Event) *cqrspb.EventMetadata {
+	return &cqrspb.EventMetadata{
+		CommandId:   string(ev.CommandID),
+		CausationId: ev.CausationID,
+		Actor:       ev.Actor,
+		Headers:     ev.Metadata,
+	}
+}
+
+func eventMetadataFromProto(metadata *cqrspb.EventMetadata, ev *Event) {
+	if metadata == nil {
+		return
+	}
+	ev.CommandID = CommandID(metadata.CommandId)
+	ev.CausationID = metadata.CausationId
+	ev.Actor = metadata.Actor
+	if len(metadata.Headers) > 0 {
+		ev.Metadata = metadata.Headers
+	}
+}
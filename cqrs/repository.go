@@ -1,16 +1,17 @@
 package cqrs
 
 import (
+	"context"
 	"fmt"
 )
 
 // Repository manages aggregate root objects.
 type Repository interface {
 	// Load creates and returns aggregate root with provided id.
-	Load(typ, aggregateID string) (AggregateRoot, error)
+	Load(ctx context.Context, typ, aggregateID string) (AggregateRoot, error)
 
 	// Save stores new events from provided aggregate root.
-	Save(root AggregateRoot) error
+	Save(ctx context.Context, root AggregateRoot) error
 }
 
 // AggregateRootCtor is a function that returns empty instance of an aggregate root.
@@ -21,7 +22,7 @@ type simpleRepository struct {
 	store EventStore
 }
 
-func (r *simpleRepository) Load(typ, aggregateID string) (AggregateRoot, error) {
+func (r *simpleRepository) Load(ctx context.Context, typ, aggregateID string) (AggregateRoot, error) {
 	ctor, ok := r.ctors[typ]
 	if !ok {
 		return nil, fmt.Errorf("unknown aggregate type: %v", typ)
@@ -35,24 +36,43 @@ func (r *simpleRepository) Load(typ, aggregateID string) (AggregateRoot, error)
 	}
 
 	// otherwise load old events and apply them
-	oldEvents, err := r.store.Load(aggregateID)
+	oldEvents, err := r.store.Load(ctx, aggregateID)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, ev := range oldEvents {
+	if err := applyEvents(root, oldEvents); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+// applyEvents applies already stored events to aggregate root and moves its version along.
+func applyEvents(root AggregateRoot, events []*Event) error {
+	for _, ev := range events {
 		if err := root.Apply(false, ev); err != nil {
-			return nil, err
+			return err
 		}
+		root.SetVersion(ev.Version)
 	}
-	return root, nil
+	return nil
 }
 
-func (r *simpleRepository) Save(root AggregateRoot) error {
-	err := r.store.Save(root.GetChanges())
+func (r *simpleRepository) Save(ctx context.Context, root AggregateRoot) error {
+	// number new events, continuing from the version aggregate root was loaded at,
+	// store will refuse them if someone else saved events in the meantime
+	changes := root.GetChanges()
+	version := root.GetVersion()
+	for _, ev := range changes {
+		version++
+		ev.Version = version
+	}
+
+	err := r.store.Save(ctx, changes)
 	if err != nil {
 		return err
 	}
+	root.SetVersion(version)
 	root.ClearChanges()
 	return nil
 }
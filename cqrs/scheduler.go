@@ -0,0 +1,234 @@
+package cqrs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ScheduledCommand is command waiting to be sent at a later time.
+type ScheduledCommand struct {
+	// ID is assigned by ScheduleStore when command is added.
+	ID            int64
+	CommandID     CommandID
+	CorrelationID string
+	DueAt         time.Time
+	// Data is command serialized by scheduler's CommandSerializer.
+	Data      []byte
+	CreatedAt time.Time
+}
+
+// ScheduleStore is description of persistence for scheduled commands.
+type ScheduleStore interface {
+	// Add stores scheduled command and sets its ID.
+	Add(ctx context.Context, sc *ScheduledCommand) error
+
+	// Dispatch takes up to limit commands due at or before provided time, ordered by due time,
+	// passes them to send and deletes ones send succeeded for. It stops at the first command send
+	// fails for and returns its error. Commands being dispatched by someone else at the same time
+	// (e.g. scheduler in another instance) are skipped, so each command is sent by only one of
+	// them. Returned number is number of commands taken.
+	Dispatch(ctx context.Context, now time.Time, limit int, send func(sc *ScheduledCommand) error) (int, error)
+
+	// Cancel deletes all scheduled commands with provided correlation ID and
+	// returns number of deleted commands.
+	Cancel(ctx context.Context, correlationID string) (int, error)
+}
+
+const (
+	defaultSchedulerBatchSize    = 100
+	defaultSchedulerPollInterval = 1 * time.Second
+)
+
+type scheduler struct {
+	store        ScheduleStore
+	serializer   CommandSerializer
+	bus          CommandBus
+	batchSize    int
+	pollInterval time.Duration
+}
+
+// Schedule stores command to be sent once provided time comes.
+func (s *scheduler) Schedule(ctx context.Context, cmd Command, at time.Time) (*ScheduledCommand, error) {
+	data, err := s.serializer.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+	sc := &ScheduledCommand{
+		CommandID:     cmd.GetCommandID(),
+		CorrelationID: cmd.GetCorrelationID(),
+		DueAt:         at.UTC(),
+		Data:          data,
+		CreatedAt:     time.Now().UTC(),
+	}
+	if err := s.store.Add(ctx, sc); err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+// Cancel cancels all commands with provided correlation ID that have not been sent yet
+// and returns number of cancelled commands.
+func (s *scheduler) Cancel(ctx context.Context, correlationID string) (int, error) {
+	return s.store.Cancel(ctx, correlationID)
+}
+
+// DispatchDue sends all commands due at or before provided time and returns number of sent commands.
+// Command is removed from the store only after it is sent, so it can be sent more than once if
+// removing fails, handlers should recognize repeated commands (see IdempotencyMiddleware).
+// Commands that can not be unmarshaled are logged and dropped, since they would never succeed.
+func (s *scheduler) DispatchDue(ctx context.Context, now time.Time) (int, error) {
+	sent := 0
+	for {
+		taken, err := s.store.Dispatch(ctx, now, s.batchSize, func(sc *ScheduledCommand) error {
+			cmd, err := s.serializer.Unmarshal(sc.Data)
+			if err != nil {
+				log.Printf("ERROR: dropping scheduled command %d (%v): %v\n", sc.ID, sc.CommandID, err)
+				return nil
+			}
+			if err := s.bus.Send(ctx, cmd); err != nil {
+				return fmt.Errorf("sending scheduled command %d (%v): %w", sc.ID, sc.CommandID, err)
+			}
+			sent++
+			return nil
+		})
+		if err != nil {
+			return sent, err
+		}
+		if taken < s.batchSize {
+			return sent, nil
+		}
+	}
+}
+
+// Run sends due commands every poll interval until context is done. Since scheduled commands
+// are read from the store, commands that became due while scheduler was not running are sent
+// as soon as it starts. Errors are logged, and failed commands are sent again on the next poll.
+func (s *scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := s.DispatchDue(ctx, time.Now().UTC()); err != nil && ctx.Err() == nil {
+			log.Printf("ERROR: dispatching scheduled commands: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// SetPollInterval sets how often Run checks for due commands.
+func (s *scheduler) SetPollInterval(d time.Duration) {
+	s.pollInterval = d
+}
+
+// SetBatchSize sets maximal number of due commands read from the store at once.
+func (s *scheduler) SetBatchSize(n int) {
+	s.batchSize = n
+}
+
+// NewScheduler returns scheduler that keeps commands in provided store, serialized with
+// provided serializer, and sends them through provided bus once they are due.
+func NewScheduler(store ScheduleStore, serializer CommandSerializer, bus CommandBus) *scheduler {
+	return &scheduler{
+		store:        store,
+		serializer:   serializer,
+		bus:          bus,
+		batchSize:    defaultSchedulerBatchSize,
+		pollInterval: defaultSchedulerPollInterval,
+	}
+}
+
+// inMemoryScheduleStore is simple implementation of ScheduleStore that keeps commands in memory.
+// It is safe for concurrent use, since commands are usually scheduled while scheduler is running.
+type inMemoryScheduleStore struct {
+	mu          sync.Mutex
+	lastID      int64
+	commands    map[int64]*ScheduledCommand
+	dispatching map[int64]struct{}
+}
+
+func (s *inMemoryScheduleStore) Add(_ context.Context, sc *ScheduledCommand) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastID++
+	sc.ID = s.lastID
+	c := *sc
+	s.commands[sc.ID] = &c
+	return nil
+}
+
+func (s *inMemoryScheduleStore) Dispatch(_ context.Context, now time.Time, limit int, send func(sc *ScheduledCommand) error) (int, error) {
+	due := s.take(now, limit)
+
+	var sendErr error
+	sent := 0
+	for _, sc := range due {
+		if sendErr = send(sc); sendErr != nil {
+			break
+		}
+		sent++
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, sc := range due {
+		if i < sent {
+			delete(s.commands, sc.ID)
+		}
+		delete(s.dispatching, sc.ID)
+	}
+	return len(due), sendErr
+}
+
+// take returns up to limit due commands that are not being dispatched and marks them as being dispatched.
+func (s *inMemoryScheduleStore) take(now time.Time, limit int) []*ScheduledCommand {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due []*ScheduledCommand
+	for _, sc := range s.commands {
+		if _, ok := s.dispatching[sc.ID]; !ok && !sc.DueAt.After(now) {
+			c := *sc
+			due = append(due, &c)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if due[i].DueAt.Equal(due[j].DueAt) {
+			return due[i].ID < due[j].ID
+		}
+		return due[i].DueAt.Before(due[j].DueAt)
+	})
+	if limit > 0 && len(due) > limit {
+		due = due[:limit]
+	}
+	for _, sc := range due {
+		s.dispatching[sc.ID] = struct{}{}
+	}
+	return due
+}
+
+func (s *inMemoryScheduleStore) Cancel(_ context.Context, correlationID string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cancelled := 0
+	for ID, sc := range s.commands {
+		if sc.CorrelationID == correlationID {
+			delete(s.commands, ID)
+			cancelled++
+		}
+	}
+	return cancelled, nil
+}
+
+// NewInMemoryScheduleStore returns ScheduleStore implementation that stores scheduled commands only in memory.
+func NewInMemoryScheduleStore() *inMemoryScheduleStore {
+	return &inMemoryScheduleStore{
+		commands:    make(map[int64]*ScheduledCommand),
+		dispatching: make(map[int64]struct{}),
+	}
+}
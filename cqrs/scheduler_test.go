@@ -0,0 +1,123 @@
+package cqrs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestScheduler() (*scheduler, *recordingBus) {
+	serializer := NewCommandJSONSerializer()
+	serializer.RegisterCommandCtor(sendReminderID, func() Command { return &BaseCommand{} })
+	bus := &recordingBus{}
+	return NewScheduler(NewInMemoryScheduleStore(), serializer, bus), bus
+}
+
+func newReminderCommand(correlationID string) *BaseCommand {
+	return &BaseCommand{CommandID: sendReminderID, AggregateID: "account-1", CorrelationID: correlationID}
+}
+
+func TestSchedulerDispatchesDueCommandsInOrder(t *testing.T) {
+	ctx := context.Background()
+	s, bus := newTestScheduler()
+	s.SetBatchSize(1)
+	now := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	_, err := s.Schedule(ctx, newReminderCommand("later"), now.Add(2*time.Hour))
+	require.NoError(t, err)
+	_, err = s.Schedule(ctx, newReminderCommand("second"), now.Add(time.Hour))
+	require.NoError(t, err)
+	_, err = s.Schedule(ctx, newReminderCommand("first"), now.Add(time.Minute))
+	require.NoError(t, err)
+
+	sent, err := s.DispatchDue(ctx, now.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 2, sent)
+	require.Len(t, bus.sent, 2)
+	assert.Equal(t, "first", bus.sent[0].GetCorrelationID())
+	assert.Equal(t, "second", bus.sent[1].GetCorrelationID())
+	assert.Equal(t, "account-1", bus.sent[0].GetAggregateID())
+
+	// sent commands are not sent again
+	sent, err = s.DispatchDue(ctx, now.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 0, sent)
+}
+
+func TestSchedulerCancel(t *testing.T) {
+	ctx := context.Background()
+	s, bus := newTestScheduler()
+	now := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	_, err := s.Schedule(ctx, newReminderCommand("cancelled"), now)
+	require.NoError(t, err)
+	_, err = s.Schedule(ctx, newReminderCommand("kept"), now)
+	require.NoError(t, err)
+
+	cancelled, err := s.Cancel(ctx, "cancelled")
+	require.NoError(t, err)
+	assert.Equal(t, 1, cancelled)
+
+	_, err = s.DispatchDue(ctx, now)
+	require.NoError(t, err)
+	require.Len(t, bus.sent, 1)
+	assert.Equal(t, "kept", bus.sent[0].GetCorrelationID())
+}
+
+func TestInMemoryScheduleStoreSkipsCommandsBeingDispatched(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryScheduleStore()
+	now := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, corr := range []string{"first", "second"} {
+		require.NoError(t, store.Add(ctx, &ScheduledCommand{CommandID: sendReminderID, CorrelationID: corr, DueAt: now}))
+	}
+
+	var outer, inner []string
+	taken, err := store.Dispatch(ctx, now, 1, func(sc *ScheduledCommand) error {
+		outer = append(outer, sc.CorrelationID)
+		// another scheduler dispatching at the same time gets only the other command
+		_, err := store.Dispatch(ctx, now, 10, func(sc *ScheduledCommand) error {
+			inner = append(inner, sc.CorrelationID)
+			return nil
+		})
+		return err
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, taken)
+	assert.Equal(t, []string{"first"}, outer)
+	assert.Equal(t, []string{"second"}, inner)
+
+	taken, err = store.Dispatch(ctx, now, 10, func(_ *ScheduledCommand) error { return nil })
+	require.NoError(t, err)
+	assert.Equal(t, 0, taken)
+}
+
+func TestInMemoryScheduleStoreKeepsCommandsNotSent(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryScheduleStore()
+	now := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, corr := range []string{"sent", "failed", "not-tried"} {
+		require.NoError(t, store.Add(ctx, &ScheduledCommand{CommandID: sendReminderID, CorrelationID: corr, DueAt: now}))
+	}
+
+	sendErr := errors.New("nats unavailable")
+	_, err := store.Dispatch(ctx, now, 10, func(sc *ScheduledCommand) error {
+		if sc.CorrelationID == "failed" {
+			return sendErr
+		}
+		return nil
+	})
+	assert.ErrorIs(t, err, sendErr)
+
+	var remaining []string
+	_, err = store.Dispatch(ctx, now, 10, func(sc *ScheduledCommand) error {
+		remaining = append(remaining, sc.CorrelationID)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"failed", "not-tried"}, remaining)
+}
@@ -0,0 +1,167 @@
+package cqrs
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Snapshot is serialized state of an aggregate root at certain version.
+type Snapshot struct {
+	AggregateID   string
+	AggregateType string
+
+	// Version is version of the last event applied to aggregate root before snapshot was taken.
+	Version int
+
+	// SchemaVersion is version of serialization format of Data, as reported by
+	// aggregate root at the time snapshot was taken.
+	SchemaVersion int
+
+	CreatedAt time.Time
+	Data      []byte
+}
+
+// SnapshotStore is description of persistence for aggregate root snapshots.
+type SnapshotStore interface {
+	// Load returns the latest snapshot for provided aggregate root id, or nil if there is none.
+	Load(ctx context.Context, aggregateID string) (*Snapshot, error)
+
+	// Save persists provided snapshot, replacing older snapshots for the same aggregate root.
+	Save(ctx context.Context, snapshot *Snapshot) error
+}
+
+// SnapshotAggregateRoot is an aggregate root whose state can be serialized to a snapshot.
+// Aggregate roots not implementing this interface are always loaded by replaying all events.
+type SnapshotAggregateRoot interface {
+	AggregateRoot
+
+	// SnapshotSchemaVersion returns version of the format produced by MarshalSnapshot.
+	// It should be changed every time that format changes, snapshots with different
+	// schema version are ignored and aggregate root is rebuilt from events instead.
+	SnapshotSchemaVersion() int
+
+	// MarshalSnapshot serializes current state of aggregate root.
+	MarshalSnapshot() ([]byte, error)
+
+	// UnmarshalSnapshot restores state of aggregate root from serialized data.
+	UnmarshalSnapshot([]byte) error
+}
+
+type snapshotRepository struct {
+	*simpleRepository
+	snapshots SnapshotStore
+	every     int
+}
+
+func (r *snapshotRepository) Load(ctx context.Context, typ, aggregateID string) (AggregateRoot, error) {
+	ctor, ok := r.ctors[typ]
+	if !ok {
+		return r.simpleRepository.Load(ctx, typ, aggregateID)
+	}
+	root, ok := ctor().(SnapshotAggregateRoot)
+	if !ok || aggregateID == "" {
+		return r.simpleRepository.Load(ctx, typ, aggregateID)
+	}
+
+	snapshot, err := r.snapshots.Load(ctx, aggregateID)
+	if err != nil {
+		return nil, err
+	}
+	if snapshot == nil || snapshot.AggregateType != typ || snapshot.SchemaVersion != root.SnapshotSchemaVersion() {
+		// nothing usable, full replay it is
+		return r.simpleRepository.Load(ctx, typ, aggregateID)
+	}
+	if err := root.UnmarshalSnapshot(snapshot.Data); err != nil {
+		log.Printf("ERROR: failed to restore snapshot of %v at version %d, replaying all events: %v\n",
+			aggregateID, snapshot.Version, err)
+		return r.simpleRepository.Load(ctx, typ, aggregateID)
+	}
+	root.SetVersion(snapshot.Version)
+
+	newEvents, err := r.store.LoadAfter(ctx, aggregateID, snapshot.Version)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyEvents(root, newEvents); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+func (r *snapshotRepository) Save(ctx context.Context, root AggregateRoot) error {
+	oldVersion := root.GetVersion()
+	changes := root.GetChanges()
+	if err := r.simpleRepository.Save(ctx, root); err != nil {
+		return err
+	}
+
+	snapshotRoot, ok := root.(SnapshotAggregateRoot)
+	if !ok || r.every <= 0 || len(changes) == 0 || root.GetVersion()/r.every == oldVersion/r.every {
+		return nil
+	}
+
+	// events are already stored at this point, failure to take a snapshot
+	// only makes next load slower, so it is not reported to the caller
+	if err := r.takeSnapshot(ctx, changes[0].AggregateType, snapshotRoot); err != nil {
+		log.Printf("ERROR: failed to take snapshot of %v at version %d: %v\n", root.GetID(), root.GetVersion(), err)
+	}
+	return nil
+}
+
+func (r *snapshotRepository) takeSnapshot(ctx context.Context, typ string, root SnapshotAggregateRoot) error {
+	data, err := root.MarshalSnapshot()
+	if err != nil {
+		return err
+	}
+	return r.snapshots.Save(ctx, &Snapshot{
+		AggregateID:   root.GetID(),
+		AggregateType: typ,
+		Version:       root.GetVersion(),
+		SchemaVersion: root.SnapshotSchemaVersion(),
+		CreatedAt:     time.Now().UTC(),
+		Data:          data,
+	})
+}
+
+// NewSnapshotRepository returns Repository that stores snapshot of aggregate roots every
+// given number of events and uses them to avoid replaying all events when loading.
+// Only aggregate roots implementing SnapshotAggregateRoot are snapshotted.
+func NewSnapshotRepository(store EventStore, snapshots SnapshotStore, every int) *snapshotRepository {
+	return &snapshotRepository{
+		simpleRepository: NewSimpleRepository(store),
+		snapshots:        snapshots,
+		every:            every,
+	}
+}
+
+// inMemorySnapshotStore is simple implementation of SnapshotStore that keeps
+// the latest snapshot for each aggregate root in memory. It is safe for concurrent use.
+type inMemorySnapshotStore struct {
+	mu    sync.RWMutex
+	state map[string]*Snapshot
+}
+
+func (s *inMemorySnapshotStore) Load(_ context.Context, aggregateID string) (*Snapshot, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.state[aggregateID], nil
+}
+
+func (s *inMemorySnapshotStore) Save(_ context.Context, snapshot *Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.state[snapshot.AggregateID]; ok && old.Version > snapshot.Version {
+		return nil
+	}
+	s.state[snapshot.AggregateID] = snapshot
+	return nil
+}
+
+// NewInMemorySnapshotStore returns SnapshotStore implementation that stores snapshots only in memory.
+func NewInMemorySnapshotStore() *inMemorySnapshotStore {
+	return &inMemorySnapshotStore{
+		state: make(map[string]*Snapshot),
+	}
+}
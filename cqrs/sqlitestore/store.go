@@ -0,0 +1,296 @@
+// Package sqlitestore implements cqrs.EventStore and cqrs.CheckpointStore on top of SQLite
+// database, so that all services can run on a single machine against one database file,
+// without postgres.
+//
+// Tables have the same layout as ones in schema.sql. Database is opened in WAL mode, so
+// readers in other processes (e.g. denormalizer reading events) do not block writer, and
+// writers wait for each other (up to busy timeout) instead of failing.
+package sqlitestore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+
+	"github.com/delicb/toy-cqrs/cqrs"
+)
+
+// schema creates tables used by event and checkpoint stores, if they do not exist.
+const schema = `
+create table if not exists events (
+	-- global order of events, writers are serialized, so positions are committed in order
+	position integer primary key autoincrement,
+	aggregate_id text not null,
+	aggregate_type varchar(64) not null,
+	created_at timestamp not null,
+	correlation_id text not null,
+	version integer not null,
+	event_id varchar(64) not null,
+	-- version of the structure of data, older versions are upgraded when read
+	schema_version integer not null default 1,
+	data blob not null,
+	-- command_id, causation_id, actor and custom headers, see cqrs.Event
+	metadata blob not null default '{}',
+	-- optimistic concurrency control, only one writer can append given version of an aggregate
+	constraint events_agg_version_uniq unique (aggregate_id, version)
+);
+
+create index if not exists events_event_id_idx on events (event_id);
+
+create table if not exists projection_checkpoints (
+	name varchar(128) not null,
+	position integer not null,
+	updated_at timestamp not null,
+	primary key(name)
+);
+`
+
+// busyTimeout is how long writer waits for other writers (possibly in other processes) to finish.
+const busyTimeout = 5 * time.Second
+
+// Open opens SQLite database in file at provided path, creating it if needed, along with
+// tables used by this package. Additional statements (e.g. creating tables of projections)
+// are executed after that, they should not fail if their tables already exist.
+func Open(path string, statements ...string) (*sql.DB, error) {
+	// immediate transactions take write lock when they begin, so concurrent writers wait
+	// for each other, instead of failing when they find out someone else has written
+	dsn := fmt.Sprintf("file:%s?_journal_mode=WAL&_busy_timeout=%d&_txlock=immediate",
+		path, busyTimeout.Milliseconds())
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range append([]string{schema}, statements...) {
+		if _, err := db.Exec(s); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// OpenReadOnly opens existing SQLite database in file at provided path for reading.
+// Nothing is created or changed, opening fails if the file does not exist.
+func OpenReadOnly(path string) (*sql.DB, error) {
+	// sqlite would create missing file even in read-only mode
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	dsn := fmt.Sprintf("file:%s?mode=ro&_busy_timeout=%d", path, busyTimeout.Milliseconds())
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+type store struct {
+	db         *sql.DB
+	serializer cqrs.EventSerializer
+
+	mu             sync.RWMutex
+	afterSaveHooks []cqrs.EventHook
+}
+
+// NewEventStore returns cqrs.EventStore keeping events in events table of provided
+// database (see Open), serialized with provided serializer.
+func NewEventStore(db *sql.DB, serializer cqrs.EventSerializer) *store {
+	return &store{
+		db:             db,
+		serializer:     serializer,
+		afterSaveHooks: make([]cqrs.EventHook, 0),
+	}
+}
+
+const selectEvents = `SELECT position, aggregate_id, aggregate_type, created_at, correlation_id, version, event_id, schema_version, data, metadata
+	FROM events`
+
+func (s *store) Load(ctx context.Context, aggregateID string) ([]*cqrs.Event, error) {
+	rows, err := s.db.QueryContext(ctx,
+		selectEvents+` WHERE aggregate_id = ? ORDER BY version ASC`, aggregateID)
+	if err != nil {
+		return nil, err
+	}
+	return s.rowsToEvents(rows)
+}
+
+func (s *store) LoadAfter(ctx context.Context, aggregateID string, version int) ([]*cqrs.Event, error) {
+	rows, err := s.db.QueryContext(ctx,
+		selectEvents+` WHERE aggregate_id = ? AND version > ? ORDER BY version ASC`, aggregateID, version)
+	if err != nil {
+		return nil, err
+	}
+	return s.rowsToEvents(rows)
+}
+
+func (s *store) ReadAll(ctx context.Context, fromPosition int64, limit int) ([]*cqrs.Event, error) {
+	// negative limit means no limit
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := s.db.QueryContext(ctx,
+		selectEvents+` WHERE position > ? ORDER BY position ASC LIMIT ?`, fromPosition, limit)
+	if err != nil {
+		return nil, err
+	}
+	return s.rowsToEvents(rows)
+}
+
+// LoadByEventID returns all events with one of provided event IDs, in order they were stored in.
+func (s *store) LoadByEventID(ctx context.Context, eventIDs ...cqrs.EventID) ([]*cqrs.Event, error) {
+	if len(eventIDs) == 0 {
+		return []*cqrs.Event{}, nil
+	}
+	args := make([]interface{}, len(eventIDs))
+	for i, ID := range eventIDs {
+		args[i] = string(ID)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(eventIDs)), ", ")
+	rows, err := s.db.QueryContext(ctx,
+		selectEvents+` WHERE event_id IN (`+placeholders+`) ORDER BY position ASC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	return s.rowsToEvents(rows)
+}
+
+func (s *store) Save(ctx context.Context, events []*cqrs.Event) error {
+	s.mu.RLock()
+	afterSave := s.afterSaveHooks
+	s.mu.RUnlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// rollback is no-op once transaction is committed
+	defer tx.Rollback()
+
+	for _, ev := range events {
+		// fail early with useful error if aggregate has moved on, unique constraint
+		// on (aggregate_id, version) catches the rest
+		var current int
+		err := tx.QueryRowContext(ctx,
+			`SELECT coalesce(max(version), 0) FROM events WHERE aggregate_id = ?`, ev.AggregateID,
+		).Scan(&current)
+		if err != nil {
+			return err
+		}
+		if ev.Version != current+1 {
+			return cqrs.NewConcurrencyConflictError(ev.AggregateID, ev.Version-1, current)
+		}
+
+		data, err := s.serializer.MarshalData(ev)
+		if err != nil {
+			return err
+		}
+		metadata, err := s.serializer.MarshalMetadata(ev)
+		if err != nil {
+			return err
+		}
+		ev.SchemaVersion = s.serializer.SchemaVersion(ev.EventID)
+		res, err := tx.ExecContext(ctx, `
+			INSERT INTO events
+				(aggregate_id, aggregate_type, created_at, correlation_id, version, event_id, schema_version, data, metadata)
+			VALUES
+				(?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			ev.AggregateID, ev.AggregateType, ev.CreatedAt, ev.CorrelationID, ev.Version, string(ev.EventID), ev.SchemaVersion, data, metadata,
+		)
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+			return cqrs.NewConcurrencyConflictError(ev.AggregateID, ev.Version-1, ev.Version)
+		}
+		if err != nil {
+			return err
+		}
+		if ev.Position, err = res.LastInsertId(); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	// call save hooks
+	for _, ev := range events {
+		for _, h := range afterSave {
+			h(ev)
+		}
+	}
+	return nil
+}
+
+// AddAfterSaveHook add a function to be called when event is saved.
+func (s *store) AddAfterSaveHook(h cqrs.EventHook) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.afterSaveHooks = append(s.afterSaveHooks, h)
+}
+
+func (s *store) rowsToEvents(rows *sql.Rows) ([]*cqrs.Event, error) {
+	defer rows.Close()
+	events := make([]*cqrs.Event, 0)
+	for rows.Next() {
+		ev := &cqrs.Event{}
+		var eventID string
+		var data []byte
+		var metadata []byte
+		if err := rows.Scan(&ev.Position, &ev.AggregateID, &ev.AggregateType, &ev.CreatedAt,
+			&ev.CorrelationID, &ev.Version, &eventID, &ev.SchemaVersion, &data, &metadata); err != nil {
+			return nil, err
+		}
+		ev.EventID = cqrs.EventID(eventID)
+		// data is upgraded to current schema version, if it was stored in older one
+		var err error
+		if ev.Data, err = s.serializer.UnmarshalData(ev.EventID, ev.SchemaVersion, data); err != nil {
+			return nil, err
+		}
+		ev.SchemaVersion = s.serializer.SchemaVersion(ev.EventID)
+		if err := s.serializer.UnmarshalMetadata(metadata, ev); err != nil {
+			return nil, err
+		}
+		events = append(events, ev)
+	}
+	return events, rows.Err()
+}
+
+type checkpointStore struct {
+	db *sql.DB
+}
+
+// NewCheckpointStore returns cqrs.CheckpointStore keeping checkpoints in
+// projection_checkpoints table of provided database (see Open).
+func NewCheckpointStore(db *sql.DB) *checkpointStore {
+	return &checkpointStore{db: db}
+}
+
+func (s *checkpointStore) LoadCheckpoint(ctx context.Context, name string) (int64, error) {
+	var position int64
+	err := s.db.QueryRowContext(ctx,
+		`SELECT position FROM projection_checkpoints WHERE name = ?`, name,
+	).Scan(&position)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return position, err
+}
+
+func (s *checkpointStore) SaveCheckpoint(ctx context.Context, name string, position int64) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO projection_checkpoints (name, position, updated_at)
+		VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET position = excluded.position, updated_at = excluded.updated_at`,
+		name, position, time.Now().UTC())
+	return err
+}
@@ -0,0 +1,149 @@
+package sqlitestore
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/delicb/toy-cqrs/cqrs"
+)
+
+const (
+	accountOpenedID cqrs.EventID = "account.opened"
+	accountClosedID cqrs.EventID = "account.closed"
+)
+
+type accountOpened struct {
+	Owner string `json:"owner"`
+}
+
+type accountClosed struct {
+	Reason string `json:"reason"`
+}
+
+func newStore(t *testing.T) *store {
+	db, err := Open(filepath.Join(t.TempDir(), "events.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	s := cqrs.NewEventJSONSerializer()
+	s.RegisterDataCtor(accountOpenedID, func() interface{} { return &accountOpened{} })
+	s.RegisterDataCtor(accountClosedID, func() interface{} { return &accountClosed{} })
+	return NewEventStore(db, s)
+}
+
+func newEvent(aggregateID string, version int, eventID cqrs.EventID, data interface{}) *cqrs.Event {
+	return &cqrs.Event{
+		EventID:       eventID,
+		AggregateID:   aggregateID,
+		AggregateType: "account",
+		CreatedAt:     time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC),
+		CorrelationID: "corr-" + aggregateID,
+		Version:       version,
+		Data:          data,
+	}
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	ctx := context.Background()
+	s := newStore(t)
+	var hooked []int64
+	s.AddAfterSaveHook(func(ev *cqrs.Event) { hooked = append(hooked, ev.Position) })
+
+	require.NoError(t, s.Save(ctx, []*cqrs.Event{
+		newEvent("a", 1, accountOpenedID, &accountOpened{Owner: "alice"}),
+		newEvent("b", 1, accountOpenedID, &accountOpened{Owner: "bob"}),
+	}))
+	require.NoError(t, s.Save(ctx, []*cqrs.Event{
+		newEvent("a", 2, accountClosedID, &accountClosed{Reason: "moved"}),
+	}))
+	assert.Equal(t, []int64{1, 2, 3}, hooked)
+
+	events, err := s.Load(ctx, "a")
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, &accountOpened{Owner: "alice"}, events[0].Data)
+	assert.Equal(t, &accountClosed{Reason: "moved"}, events[1].Data)
+	assert.Equal(t, "corr-a", events[1].CorrelationID)
+	assert.True(t, events[1].CreatedAt.Equal(time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)))
+
+	events, err = s.LoadAfter(ctx, "a", 1)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, int64(3), events[0].Position)
+
+	events, err = s.ReadAll(ctx, 1, 0)
+	require.NoError(t, err)
+	assert.Len(t, events, 2)
+	events, err = s.ReadAll(ctx, 0, 1)
+	require.NoError(t, err)
+	assert.Len(t, events, 1)
+
+	events, err = s.LoadByEventID(ctx, accountClosedID)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, "a", events[0].AggregateID)
+}
+
+func TestSaveDetectsConflict(t *testing.T) {
+	ctx := context.Background()
+	s := newStore(t)
+	require.NoError(t, s.Save(ctx, []*cqrs.Event{newEvent("a", 1, accountOpenedID, &accountOpened{})}))
+
+	err := s.Save(ctx, []*cqrs.Event{
+		newEvent("b", 1, accountOpenedID, &accountOpened{}),
+		newEvent("a", 1, accountOpenedID, &accountOpened{}),
+	})
+	assert.ErrorIs(t, err, cqrs.ErrConcurrencyConflict)
+
+	// batch is saved all or nothing
+	events, err := s.ReadAll(ctx, 0, 0)
+	require.NoError(t, err)
+	assert.Len(t, events, 1)
+}
+
+func TestCheckpoints(t *testing.T) {
+	ctx := context.Background()
+	checkpoints := NewCheckpointStore(newStore(t).db)
+
+	position, err := checkpoints.LoadCheckpoint(ctx, "users")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), position)
+
+	require.NoError(t, checkpoints.SaveCheckpoint(ctx, "users", 5))
+	require.NoError(t, checkpoints.SaveCheckpoint(ctx, "users", 7))
+	position, err = checkpoints.LoadCheckpoint(ctx, "users")
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), position)
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "events.db")
+
+	_, err := OpenReadOnly(path)
+	require.Error(t, err)
+	assert.NoFileExists(t, path)
+
+	db, err := Open(path)
+	require.NoError(t, err)
+	writer := NewEventStore(db, cqrs.NewEventJSONSerializer())
+	require.NoError(t, writer.Save(ctx, []*cqrs.Event{newEvent("a", 1, accountOpenedID, &accountOpened{Owner: "alice"})}))
+	require.NoError(t, db.Close())
+
+	db, err = OpenReadOnly(path)
+	require.NoError(t, err)
+	defer db.Close()
+	s := cqrs.NewEventJSONSerializer()
+	s.RegisterDataCtor(accountOpenedID, func() interface{} { return &accountOpened{} })
+	reader := NewEventStore(db, s)
+	events, err := reader.Load(ctx, "a")
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, "alice", events[0].Data.(*accountOpened).Owner)
+	assert.Error(t, reader.Save(ctx, []*cqrs.Event{newEvent("a", 2, accountClosedID, &accountClosed{})}))
+}
@@ -0,0 +1,149 @@
+package cqrs
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// EventReader reads events of all aggregates in order of their positions.
+// Every EventStore is also an EventReader.
+type EventReader interface {
+	// ReadAll returns up to limit events with position greater than provided one, ordered by position.
+	ReadAll(ctx context.Context, fromPosition int64, limit int) ([]*Event, error)
+}
+
+// CheckpointStore persists position of the last event processed by a named subscriber,
+// so that processing can continue where it stopped after restart. It has to be safe for
+// concurrent use, since projector runs projections sharing the same store concurrently.
+type CheckpointStore interface {
+	// LoadCheckpoint returns position of the last processed event, or 0 if nothing has been processed.
+	LoadCheckpoint(ctx context.Context, name string) (int64, error)
+
+	// SaveCheckpoint stores position of the last processed event.
+	SaveCheckpoint(ctx context.Context, name string, position int64) error
+}
+
+// EventHandler processes single event. Returning error stops processing.
+type EventHandler func(ctx context.Context, ev *Event) error
+
+const (
+	defaultSubscriptionBatchSize    = 100
+	defaultSubscriptionPollInterval = 5 * time.Second
+)
+
+type catchUpSubscription struct {
+	name         string
+	reader       EventReader
+	checkpoints  CheckpointStore
+	handler      EventHandler
+	batchSize    int
+	pollInterval time.Duration
+}
+
+// Run delivers all events stored after the last checkpoint to handler and then waits
+// for notifications about new events, reading them from the store every time one
+// arrives. Since events are always read from the store, in order, no event is skipped,
+// regardless of notifications that might have been lost, and notification is merely a hint
+// to read sooner. Store is also read every poll interval, in case notifications stop coming.
+// Checkpoint is saved after every handled event, so event might be handled again if
+// process stops between handling and saving checkpoint. Handler should be idempotent.
+// Run blocks until context is done or handler or store return an error.
+func (s *catchUpSubscription) Run(ctx context.Context, notifications <-chan struct{}) error {
+	position, err := s.checkpoints.LoadCheckpoint(ctx, s.name)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		position, err = s.catchUp(ctx, position)
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-notifications:
+		case <-ticker.C:
+		}
+	}
+}
+
+// catchUp handles all events after provided position and returns position of the last handled event.
+func (s *catchUpSubscription) catchUp(ctx context.Context, position int64) (int64, error) {
+	for {
+		events, err := s.reader.ReadAll(ctx, position, s.batchSize)
+		if err != nil {
+			return position, err
+		}
+		if len(events) == 0 {
+			return position, nil
+		}
+		for _, ev := range events {
+			if err := ctx.Err(); err != nil {
+				return position, err
+			}
+			if err := s.handler(ctx, ev); err != nil {
+				return position, err
+			}
+			if err := s.checkpoints.SaveCheckpoint(ctx, s.name, ev.Position); err != nil {
+				return position, err
+			}
+			position = ev.Position
+		}
+	}
+}
+
+// SetPollInterval sets how often store is checked for new events when there are no notifications.
+func (s *catchUpSubscription) SetPollInterval(d time.Duration) {
+	s.pollInterval = d
+}
+
+// SetBatchSize sets maximal number of events read from the store at once.
+func (s *catchUpSubscription) SetBatchSize(n int) {
+	s.batchSize = n
+}
+
+// NewCatchUpSubscription returns subscription with provided name (used as checkpoint name)
+// that delivers events from reader to handler, starting after the last saved checkpoint.
+func NewCatchUpSubscription(name string, reader EventReader, checkpoints CheckpointStore, handler EventHandler) *catchUpSubscription {
+	return &catchUpSubscription{
+		name:         name,
+		reader:       reader,
+		checkpoints:  checkpoints,
+		handler:      handler,
+		batchSize:    defaultSubscriptionBatchSize,
+		pollInterval: defaultSubscriptionPollInterval,
+	}
+}
+
+// inMemoryCheckpointStore is simple implementation of CheckpointStore that keeps checkpoints
+// in memory. It is safe for concurrent use.
+type inMemoryCheckpointStore struct {
+	mu          sync.Mutex
+	checkpoints map[string]int64
+}
+
+func (s *inMemoryCheckpointStore) LoadCheckpoint(_ context.Context, name string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.checkpoints[name], nil
+}
+
+func (s *inMemoryCheckpointStore) SaveCheckpoint(_ context.Context, name string, position int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkpoints[name] = position
+	return nil
+}
+
+// NewInMemoryCheckpointStore returns CheckpointStore implementation that stores checkpoints only in memory.
+func NewInMemoryCheckpointStore() *inMemoryCheckpointStore {
+	return &inMemoryCheckpointStore{
+		checkpoints: make(map[string]int64),
+	}
+}
@@ -0,0 +1,100 @@
+package cqrs
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// TypedRoot is partial implementation of AggregateRoot that dispatches events and commands
+// to functions registered for their types (see On and Handle), instead of type switches.
+// Intended usage is by embedding it to concrete aggregate root and registering functions in
+// its constructor, e.g.
+//
+//	func NewUser() *User {
+//		u := &User{}
+//		cqrs.On(&u.TypedRoot, func(ev *cqrs.Event, data *users.UserCreated) { u.Email = data.Email })
+//		cqrs.Handle(&u.TypedRoot, u.create)
+//		return u
+//	}
+type TypedRoot struct {
+	Root
+	appliers map[reflect.Type]func(*Event)
+	handlers map[reflect.Type]func(Command) error
+}
+
+// On registers function applying events with data of type D (e.g. *users.UserCreated)
+// to aggregate root, replacing previous one, if any.
+func On[D any](r *TypedRoot, apply func(ev *Event, data D)) {
+	if r.appliers == nil {
+		r.appliers = make(map[reflect.Type]func(*Event))
+	}
+	r.appliers[typeOf[D]()] = func(ev *Event) {
+		apply(ev, ev.Data.(D))
+	}
+}
+
+// Handle registers function handling commands of type C (e.g. *users.CreateUser),
+// replacing previous one, if any. Handler should generate events and apply them with
+// Apply(true, ev).
+func Handle[C Command](r *TypedRoot, handle func(cmd C) error) {
+	if r.handlers == nil {
+		r.handlers = make(map[reflect.Type]func(Command) error)
+	}
+	r.handlers[typeOf[C]()] = func(cmd Command) error {
+		return handle(cmd.(C))
+	}
+}
+
+// typeOf returns type T, even when T is an interface.
+func typeOf[T any]() reflect.Type {
+	return reflect.TypeOf((*T)(nil)).Elem()
+}
+
+// Apply applies event using function registered for type of its data. Unknown events
+// are not applied nor recorded as changes, and error matching ErrUnknownEvent is returned.
+func (r *TypedRoot) Apply(new bool, ev *Event) error {
+	apply, ok := r.appliers[reflect.TypeOf(ev.Data)]
+	if !ok {
+		return fmt.Errorf("%w: %v (%T)", ErrUnknownEvent, ev.EventID, ev.Data)
+	}
+	apply(ev)
+	if new {
+		r.Changes = append(r.Changes, ev)
+	}
+	return nil
+}
+
+// HandleCommand handles command using function registered for its type, or returns
+// error matching ErrUnknownCommand, if there is none.
+func (r *TypedRoot) HandleCommand(cmd Command) error {
+	handle, ok := r.handlers[reflect.TypeOf(cmd)]
+	if !ok {
+		return fmt.Errorf("%w: %v (%T)", ErrUnknownCommand, cmd.GetCommandID(), cmd)
+	}
+	return handle(cmd)
+}
+
+// CheckAppliers returns error listing events known to provided registry (typically an
+// EventSerializer) that aggregate root has no applier for. It is intended to be called on
+// startup, so that missing applier is noticed before such event is loaded.
+func (r *TypedRoot) CheckAppliers(registry EventDataRegistry) error {
+	var missing []string
+	for ID, data := range registry.RegisteredData() {
+		if _, ok := r.appliers[reflect.TypeOf(data)]; !ok {
+			missing = append(missing, fmt.Sprintf("%v (%T)", ID, data))
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+	return fmt.Errorf("%w: no applier for %v", ErrUnknownEvent, strings.Join(missing, ", "))
+}
+
+// EventDataRegistry is implemented by event serializers, allowing to list events they know about.
+type EventDataRegistry interface {
+	// RegisteredData returns empty instance of data of each registered event.
+	RegisteredData() map[EventID]interface{}
+}
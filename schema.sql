@@ -1,15 +1,115 @@
--- event store
+-- event store, also created by migrations of cqrs/pgstore (run by userservice), keep them in sync
 create table if not exists events (
+	-- global order of events, see pg_advisory_xact_lock in event store
+	position bigserial not null,
 	aggregate_id uuid not null,
 	aggregate_type varchar(64) not null,
 	created_at timestamp with time zone not null,
 	correlation_id uuid not null,
+	version integer not null,
 	event_id varchar(64) not null,
-	data jsonb not null
+	-- version of the structure of data, older versions are upgraded when read
+	schema_version integer not null default 1,
+	data jsonb not null,
+	-- command_id, causation_id, actor and custom headers, see cqrs.Event
+	metadata jsonb not null default '{}',
+	-- optimistic concurrency control, only one writer can append given version of an aggregate
+	constraint events_agg_version_uniq unique (aggregate_id, version),
+	primary key(position)
 );
 
--- most common query should benefit from this
-create index events_agg_time_idx ON events (aggregate_id, created_at);
+-- events table created before aggregate versions were introduced is not changed by create table above,
+-- existing events get versions per aggregate and positions in order they were created in
+do $$
+begin
+  if not exists (select 1 from pg_attribute
+                 where attrelid = 'events'::regclass and attname = 'version' and not attisdropped) then
+    alter table events add column version integer;
+    update events e set version = v.version
+      from (select ctid, row_number() over (partition by aggregate_id order by created_at, ctid) as version
+            from events) v
+      where e.ctid = v.ctid;
+    alter table events alter column version set not null;
+    alter table events add constraint events_agg_version_uniq unique (aggregate_id, version);
+  end if;
+
+  if not exists (select 1 from pg_attribute
+                 where attrelid = 'events'::regclass and attname = 'position' and not attisdropped) then
+    alter table events add column position bigint;
+    create sequence if not exists events_position_seq owned by events.position;
+    update events e set position = p.position
+      from (select ctid, row_number() over (order by created_at, ctid) as position from events) p
+      where e.ctid = p.ctid;
+    perform setval('events_position_seq', coalesce((select max(position) from events), 0) + 1, false);
+    alter table events alter column position set default nextval('events_position_seq');
+    alter table events alter column position set not null;
+    alter table events add primary key (position);
+  end if;
+end
+$$;
+
+alter table events add column if not exists schema_version integer not null default 1;
+alter table events add column if not exists metadata jsonb not null default '{}';
+
+-- used for loading events of specific types, e.g. by validator in userservice
+create index if not exists events_event_id_idx on events (event_id);
+
+-- events waiting to be published to nats, written in the same transaction as events
+-- and published by outbox relay in userservice
+create table if not exists outbox (
+	position bigint not null references events (position),
+	subject varchar(256) not null,
+	payload bytea not null,
+	created_at timestamp with time zone not null,
+	sent_at timestamp with time zone,
+	primary key(position)
+);
+
+create index if not exists outbox_unsent_idx on outbox (position) where sent_at is null;
+
+-- used by outbox relay to delete sent events after retention period
+create index if not exists outbox_sent_idx on outbox (sent_at) where sent_at is not null;
+
+-- latest snapshot of each aggregate, allows loading aggregate without replaying all events
+create table if not exists snapshots (
+	aggregate_id uuid not null,
+	aggregate_type varchar(64) not null,
+	version integer not null,
+	schema_version integer not null,
+	created_at timestamp with time zone not null,
+	data bytea not null,
+	primary key(aggregate_id)
+);
+
+-- outcomes of handled commands, by idempotency key, used to detect repeated commands
+create table if not exists processed_commands (
+	key varchar(128) not null,
+	command_id varchar(64) not null,
+	error text not null,
+	-- key is reserved while command is being handled, see cqrs.IdempotencyStore.Reserve
+	pending boolean not null default false,
+	processed_at timestamp with time zone not null,
+	primary key(key)
+);
+
+alter table processed_commands add column if not exists pending boolean not null default false;
+
+create index if not exists processed_commands_time_idx on processed_commands (processed_at);
+
+-- commands to be sent to userservice at a later time, see cqrs.NewScheduler
+create table if not exists scheduled_commands (
+	id bigserial not null,
+	command_id varchar(64) not null,
+	correlation_id uuid not null,
+	due_at timestamp with time zone not null,
+	-- command serialized by users.CommandSerializer
+	data bytea not null,
+	created_at timestamp with time zone not null,
+	primary key(id)
+);
+
+create index if not exists scheduled_commands_due_idx on scheduled_commands (due_at);
+create index if not exists scheduled_commands_correlation_idx on scheduled_commands (correlation_id);
 
 -- users view only schema, used by API, populated by denormalizer, could be different DB completely
 create table if not exists users (
@@ -22,6 +122,34 @@ create table if not exists users (
 	primary key(id)
 );
 
+-- position of the last event processed by each projection (e.g. denormalizer's users table),
+-- allows projections to catch up with events stored while they were not running
+create table if not exists projection_checkpoints (
+	name varchar(128) not null,
+	position bigint not null,
+	updated_at timestamp with time zone not null,
+	primary key(name)
+);
+
+-- state of process manager instances (see cqrs.ProcessManager), one row per process and correlation ID
+create table if not exists process_states (
+	process varchar(128) not null,
+	correlation_id uuid not null,
+	-- optimistic concurrency control, incremented on every save
+	version integer not null,
+	-- position of the last event handled by process instance
+	position bigint not null,
+	data jsonb not null,
+	-- scheduled timeouts by name, next_timeout is the earliest of them
+	timeouts jsonb not null default '{}',
+	next_timeout timestamp with time zone,
+	completed bool not null,
+	updated_at timestamp with time zone not null,
+	primary key(process, correlation_id)
+);
+
+create index if not exists process_states_timeout_idx on process_states (process, next_timeout) where not completed;
+
 -- function called by trigger on every insert to events table
 -- sends notification on channel, allowing services to subscribe
 -- to events when new events are created
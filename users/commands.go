@@ -8,18 +8,42 @@ import (
 )
 
 var (
+	// CommandSerializer marshals commands to format set by SetCommandContentType (JSON by default)
+	// and unmarshals commands in any of the supported formats.
 	CommandSerializer cqrs.CommandSerializer
+
+	commandNegotiator interface {
+		SetPreferred(contentType string) error
+	}
 )
 
 func init() {
-	serializer := cqrs.NewCommandJSONSerializer()
-	serializer.RegisterCommandCtor(CreateUserID, func() cqrs.Command { return &CreateUser{} })
-	serializer.RegisterCommandCtor(ChangeUserEmailID, func() cqrs.Command { return &ChangeUserEmail{} })
-	serializer.RegisterCommandCtor(ChangeUserPasswordID, func() cqrs.Command { return &ChangeUserPassword{} })
-	serializer.RegisterCommandCtor(EnableUserID, func() cqrs.Command { return &EnableUser{} })
-	serializer.RegisterCommandCtor(DisableUserID, func() cqrs.Command { return &DisableUser{} })
-
-	CommandSerializer = serializer
+	ctors := map[cqrs.CommandID]func() cqrs.Command{
+		CreateUserID:         func() cqrs.Command { return &CreateUser{} },
+		ChangeUserEmailID:    func() cqrs.Command { return &ChangeUserEmail{} },
+		ChangeUserPasswordID: func() cqrs.Command { return &ChangeUserPassword{} },
+		EnableUserID:         func() cqrs.Command { return &EnableUser{} },
+		DisableUserID:        func() cqrs.Command { return &DisableUser{} },
+	}
+	jsonSerializer := cqrs.NewCommandJSONSerializer()
+	protoSerializer := cqrs.NewCommandProtoSerializer()
+	for ID, ctor := range ctors {
+		jsonSerializer.RegisterCommandCtor(ID, ctor)
+		protoSerializer.RegisterCommandCtor(ID, ctor)
+	}
+
+	negotiator := cqrs.NewCommandNegotiator()
+	negotiator.Register(cqrs.ContentTypeJSON, jsonSerializer)
+	negotiator.Register(cqrs.ContentTypeProtobuf, protoSerializer)
+
+	CommandSerializer = negotiator
+	commandNegotiator = negotiator
+}
+
+// SetCommandContentType sets format in which CommandSerializer marshals commands,
+// either cqrs.ContentTypeJSON or cqrs.ContentTypeProtobuf.
+func SetCommandContentType(contentType string) error {
+	return commandNegotiator.SetPreferred(contentType)
 }
 
 const CreateUserID cqrs.CommandID = "user.create"
@@ -28,6 +52,9 @@ const ChangeUserPasswordID cqrs.CommandID = "user.change.password"
 const EnableUserID cqrs.CommandID = "user.enable"
 const DisableUserID cqrs.CommandID = "user.disable"
 
+// CommandIDs lists IDs of all user commands, e.g. for subscribing to them.
+var CommandIDs = []cqrs.CommandID{CreateUserID, ChangeUserEmailID, ChangeUserPasswordID, EnableUserID, DisableUserID}
+
 // CreateUser is command indicating that new user should be created.
 type CreateUser struct {
 	cqrs.BaseCommand `mapstructure:",squash"`
@@ -5,18 +5,32 @@ import (
 )
 
 var (
+	// EventSerializer marshals events to JSON and unmarshals events in any of the supported
+	// formats. JSON is always used for marshaling, since event stores keep event data and
+	// metadata in JSON columns.
 	EventSerializer cqrs.EventSerializer
 )
 
 func init() {
-	serializer := cqrs.NewEventJSONSerializer()
-	serializer.RegisterDataCtor(UserCreatedID, func() interface{} { return &UserCreated{} })
-	serializer.RegisterDataCtor(EmailChangedID, func() interface{} { return &UserEmailChanged{} })
-	serializer.RegisterDataCtor(PasswordChangedID, func() interface{} { return &UserPasswordChanged{} })
-	serializer.RegisterDataCtor(EnabledID, func() interface{} { return &UserEnabled{} })
-	serializer.RegisterDataCtor(DisabledID, func() interface{} { return &UserDisabled{} })
-
-	EventSerializer = serializer
+	ctors := map[cqrs.EventID]func() interface{}{
+		UserCreatedID:     func() interface{} { return &UserCreated{} },
+		EmailChangedID:    func() interface{} { return &UserEmailChanged{} },
+		PasswordChangedID: func() interface{} { return &UserPasswordChanged{} },
+		EnabledID:         func() interface{} { return &UserEnabled{} },
+		DisabledID:        func() interface{} { return &UserDisabled{} },
+	}
+	jsonSerializer := cqrs.NewEventJSONSerializer()
+	protoSerializer := cqrs.NewEventProtoSerializer()
+	for ID, ctor := range ctors {
+		jsonSerializer.RegisterDataCtor(ID, ctor)
+		protoSerializer.RegisterDataCtor(ID, ctor)
+	}
+
+	negotiator := cqrs.NewEventNegotiator()
+	negotiator.Register(cqrs.ContentTypeJSON, jsonSerializer)
+	negotiator.Register(cqrs.ContentTypeProtobuf, protoSerializer)
+
+	EventSerializer = negotiator
 }
 
 const UserCreatedID cqrs.EventID = "user.created"
@@ -0,0 +1,144 @@
+package users
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/delicb/toy-cqrs/users/userspb"
+)
+
+// Conversions between commands and event data in this package and their protobuf
+// representation, used by protobuf serializers (see cqrs.ProtoConverter).
+
+func unexpectedMessage(expected, got proto.Message) error {
+	return fmt.Errorf("expected protobuf message %T, got %T", expected, got)
+}
+
+func (c *CreateUser) ToProto() proto.Message {
+	return &userspb.CreateUser{Email: c.Email, Password: c.Password}
+}
+
+func (c *CreateUser) FromProto(msg proto.Message) error {
+	m, ok := msg.(*userspb.CreateUser)
+	if !ok {
+		return unexpectedMessage(&userspb.CreateUser{}, msg)
+	}
+	c.Email = m.Email
+	c.Password = m.Password
+	return nil
+}
+
+func (c *ChangeUserEmail) ToProto() proto.Message {
+	return &userspb.ChangeUserEmail{Email: c.Email}
+}
+
+func (c *ChangeUserEmail) FromProto(msg proto.Message) error {
+	m, ok := msg.(*userspb.ChangeUserEmail)
+	if !ok {
+		return unexpectedMessage(&userspb.ChangeUserEmail{}, msg)
+	}
+	c.Email = m.Email
+	return nil
+}
+
+func (c *ChangeUserPassword) ToProto() proto.Message {
+	return &userspb.ChangeUserPassword{Password: c.Password}
+}
+
+func (c *ChangeUserPassword) FromProto(msg proto.Message) error {
+	m, ok := msg.(*userspb.ChangeUserPassword)
+	if !ok {
+		return unexpectedMessage(&userspb.ChangeUserPassword{}, msg)
+	}
+	c.Password = m.Password
+	return nil
+}
+
+func (c *EnableUser) ToProto() proto.Message {
+	return &userspb.EnableUser{}
+}
+
+func (c *EnableUser) FromProto(msg proto.Message) error {
+	if _, ok := msg.(*userspb.EnableUser); !ok {
+		return unexpectedMessage(&userspb.EnableUser{}, msg)
+	}
+	return nil
+}
+
+func (c *DisableUser) ToProto() proto.Message {
+	return &userspb.DisableUser{}
+}
+
+func (c *DisableUser) FromProto(msg proto.Message) error {
+	if _, ok := msg.(*userspb.DisableUser); !ok {
+		return unexpectedMessage(&userspb.DisableUser{}, msg)
+	}
+	return nil
+}
+
+func (e *UserCreated) ToProto() proto.Message {
+	return &userspb.UserCreated{Id: e.ID, Email: e.Email, Password: e.Password, IsEnabled: e.IsEnabled}
+}
+
+func (e *UserCreated) FromProto(msg proto.Message) error {
+	m, ok := msg.(*userspb.UserCreated)
+	if !ok {
+		return unexpectedMessage(&userspb.UserCreated{}, msg)
+	}
+	e.ID = m.Id
+	e.Email = m.Email
+	e.Password = m.Password
+	e.IsEnabled = m.IsEnabled
+	return nil
+}
+
+func (e *UserEmailChanged) ToProto() proto.Message {
+	return &userspb.UserEmailChanged{NewEmail: e.NewEmail, OldEmail: e.OldEmail}
+}
+
+func (e *UserEmailChanged) FromProto(msg proto.Message) error {
+	m, ok := msg.(*userspb.UserEmailChanged)
+	if !ok {
+		return unexpectedMessage(&userspb.UserEmailChanged{}, msg)
+	}
+	e.NewEmail = m.NewEmail
+	e.OldEmail = m.OldEmail
+	return nil
+}
+
+func (e *UserPasswordChanged) ToProto() proto.Message {
+	return &userspb.UserPasswordChanged{NewPassword: e.NewPassword, OldPassword: e.OldPassword}
+}
+
+func (e *UserPasswordChanged) FromProto(msg proto.Message) error {
+	m, ok := msg.(*userspb.UserPasswordChanged)
+	if !ok {
+		return unexpectedMessage(&userspb.UserPasswordChanged{}, msg)
+	}
+	e.NewPassword = m.NewPassword
+	e.OldPassword = m.OldPassword
+	return nil
+}
+
+func (e *UserEnabled) ToProto() proto.Message {
+	return &userspb.UserEnabled{}
+}
+
+func (e *UserEnabled) FromProto(msg proto.Message) error {
+	if _, ok := msg.(*userspb.UserEnabled); !ok {
+		return unexpectedMessage(&userspb.UserEnabled{}, msg)
+	}
+	return nil
+}
+
+func (e *UserDisabled) ToProto() proto.Message {
+	return &userspb.UserDisabled{}
+}
+
+func (e *UserDisabled) FromProto(msg proto.Message) error {
+	if _, ok := msg.(*userspb.UserDisabled); !ok {
+		return unexpectedMessage(&userspb.UserDisabled{}, msg)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package users
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/delicb/toy-cqrs/cqrs"
+)
+
+func newBaseCommand(ID cqrs.CommandID) cqrs.BaseCommand {
+	return cqrs.BaseCommand{
+		CommandID:      ID,
+		AggregateID:    "5b7c3a2e-8f4d-4c61-9d1e-2f0a6b8c9d10",
+		AggregateType:  "user",
+		CorrelationID:  "0e6f1c55-3b2a-4d8e-a7f9-6c4d2b1e0f3a",
+		IdempotencyKey: "signup-42",
+		CausationID:    "9a8b7c6d-5e4f-4a3b-8c2d-1e0f9a8b7c6d",
+		Actor:          "admin@example.com",
+		Metadata:       map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+	}
+}
+
+func testCommands() []cqrs.Command {
+	return []cqrs.Command{
+		&CreateUser{BaseCommand: newBaseCommand(CreateUserID), Email: "john@example.com", Password: "bcrypt:hash"},
+		&ChangeUserEmail{BaseCommand: newBaseCommand(ChangeUserEmailID), Email: "johnny@example.com"},
+		&ChangeUserPassword{BaseCommand: newBaseCommand(ChangeUserPasswordID), Password: "bcrypt:other"},
+		&EnableUser{BaseCommand: newBaseCommand(EnableUserID)},
+		&DisableUser{BaseCommand: newBaseCommand(DisableUserID)},
+	}
+}
+
+func newTestEvent(ID cqrs.EventID, version int, data interface{}) *cqrs.Event {
+	return &cqrs.Event{
+		EventID:       ID,
+		AggregateID:   "5b7c3a2e-8f4d-4c61-9d1e-2f0a6b8c9d10",
+		AggregateType: "user",
+		CreatedAt:     time.Date(2021, 5, 1, 12, 0, 0, 123456789, time.UTC),
+		CorrelationID: "0e6f1c55-3b2a-4d8e-a7f9-6c4d2b1e0f3a",
+		Version:       version,
+		Position:      int64(100 + version),
+		SchemaVersion: EventSerializer.SchemaVersion(ID),
+		Data:          data,
+		CommandID:     CreateUserID,
+		CausationID:   "9a8b7c6d-5e4f-4a3b-8c2d-1e0f9a8b7c6d",
+		Actor:         "admin@example.com",
+		Metadata:      map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+	}
+}
+
+func testEvents() []*cqrs.Event {
+	return []*cqrs.Event{
+		newTestEvent(UserCreatedID, 1, &UserCreated{ID: "5b7c3a2e-8f4d-4c61-9d1e-2f0a6b8c9d10", Email: "john@example.com", Password: "bcrypt:hash", IsEnabled: true}),
+		newTestEvent(EmailChangedID, 2, &UserEmailChanged{NewEmail: "johnny@example.com", OldEmail: "john@example.com"}),
+		newTestEvent(PasswordChangedID, 3, &UserPasswordChanged{NewPassword: "bcrypt:other", OldPassword: "bcrypt:hash"}),
+		newTestEvent(DisabledID, 4, &UserDisabled{}),
+		newTestEvent(EnabledID, 5, &UserEnabled{}),
+	}
+}
+
+// newEventProtoSerializer returns protobuf serializer with all user events registered,
+// EventSerializer always marshals events to JSON.
+func newEventProtoSerializer() cqrs.EventSerializer {
+	s := cqrs.NewEventProtoSerializer()
+	s.RegisterDataCtor(UserCreatedID, func() interface{} { return &UserCreated{} })
+	s.RegisterDataCtor(EmailChangedID, func() interface{} { return &UserEmailChanged{} })
+	s.RegisterDataCtor(PasswordChangedID, func() interface{} { return &UserPasswordChanged{} })
+	s.RegisterDataCtor(EnabledID, func() interface{} { return &UserEnabled{} })
+	s.RegisterDataCtor(DisabledID, func() interface{} { return &UserDisabled{} })
+	return s
+}
+
+// setCommandContentType changes format of CommandSerializer for the duration of a test.
+func setCommandContentType(t *testing.T, contentType string) {
+	require.NoError(t, SetCommandContentType(contentType))
+	t.Cleanup(func() { require.NoError(t, SetCommandContentType(cqrs.ContentTypeJSON)) })
+}
+
+func TestCommandsRoundTripThroughProtobuf(t *testing.T) {
+	for _, cmd := range testCommands() {
+		t.Run(string(cmd.GetCommandID()), func(t *testing.T) {
+			jsonData, err := CommandSerializer.Marshal(cmd)
+			require.NoError(t, err)
+			fromJSON, err := CommandSerializer.Unmarshal(jsonData)
+			require.NoError(t, err)
+
+			setCommandContentType(t, cqrs.ContentTypeProtobuf)
+			protoData, err := CommandSerializer.Marshal(fromJSON)
+			require.NoError(t, err)
+			require.Equal(t, cqrs.ContentTypeProtobuf, cqrs.DetectContentType(protoData))
+			fromProto, err := CommandSerializer.Unmarshal(protoData)
+			require.NoError(t, err)
+			assert.Equal(t, cmd, fromProto)
+
+			require.NoError(t, SetCommandContentType(cqrs.ContentTypeJSON))
+			again, err := CommandSerializer.Marshal(fromProto)
+			require.NoError(t, err)
+			assert.JSONEq(t, string(jsonData), string(again))
+		})
+	}
+}
+
+func TestEventsRoundTripThroughProtobuf(t *testing.T) {
+	protoSerializer := newEventProtoSerializer()
+	for _, ev := range testEvents() {
+		t.Run(string(ev.EventID), func(t *testing.T) {
+			jsonData, err := EventSerializer.Marshal(ev)
+			require.NoError(t, err)
+			fromJSON, err := EventSerializer.Unmarshal(jsonData)
+			require.NoError(t, err)
+
+			protoData, err := protoSerializer.Marshal(fromJSON)
+			require.NoError(t, err)
+			fromProto, err := EventSerializer.Unmarshal(protoData)
+			require.NoError(t, err)
+			assert.Equal(t, ev, fromProto)
+
+			again, err := EventSerializer.Marshal(fromProto)
+			require.NoError(t, err)
+			assert.JSONEq(t, string(jsonData), string(again))
+		})
+	}
+}
+
+func TestNegotiationOfMixedFormats(t *testing.T) {
+	protoSerializer := newEventProtoSerializer()
+	events := testEvents()
+	for i, ev := range events {
+		var data []byte
+		var err error
+		switch i % 3 {
+		case 0:
+			data, err = protoSerializer.Marshal(ev)
+		case 1:
+			data, err = EventSerializer.Marshal(ev)
+		default:
+			// e.g. pretty printed or written by hand, followed by newline
+			data, err = EventSerializer.Marshal(ev)
+			data = append(append([]byte("\n  \t"), data...), '\n')
+		}
+		require.NoError(t, err)
+
+		decoded, err := EventSerializer.Unmarshal(data)
+		require.NoError(t, err, "event %v", ev.EventID)
+		assert.Equal(t, ev, decoded)
+	}
+
+	for i, cmd := range testCommands() {
+		contentType := cqrs.ContentTypeJSON
+		if i%2 == 0 {
+			contentType = cqrs.ContentTypeProtobuf
+		}
+		setCommandContentType(t, contentType)
+		data, err := CommandSerializer.Marshal(cmd)
+		require.NoError(t, err)
+		if contentType == cqrs.ContentTypeJSON {
+			data = append([]byte(" \r\n"), data...)
+		}
+
+		decoded, err := CommandSerializer.Unmarshal(data)
+		require.NoError(t, err, "command %v", cmd.GetCommandID())
+		assert.Equal(t, cmd, decoded)
+	}
+}
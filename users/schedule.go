@@ -0,0 +1,24 @@
+package users
+
+import (
+	"time"
+)
+
+const (
+	// ScheduleSubject is nats subject userservice receives ScheduleRequest on.
+	ScheduleSubject = "schedule.user.add"
+	// CancelScheduleSubject is nats subject userservice receives CancelScheduleRequest on.
+	CancelScheduleSubject = "schedule.user.cancel"
+)
+
+// ScheduleRequest asks userservice to handle command at provided time.
+type ScheduleRequest struct {
+	DueAt time.Time `json:"due_at"`
+	// Command is command serialized by CommandSerializer.
+	Command []byte `json:"command"`
+}
+
+// CancelScheduleRequest asks userservice to cancel all scheduled commands with provided correlation ID.
+type CancelScheduleRequest struct {
+	CorrelationID string `json:"correlation_id"`
+}
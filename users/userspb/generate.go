@@ -0,0 +1,4 @@
+// Package userspb contains protobuf messages for user commands and events.
+package userspb
+
+//go:generate protoc -I ../.. --go_out=../.. --go_opt=paths=source_relative users/userspb/users.proto